@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"server/accounts"
+	"server/audit"
+	"server/db"
+	"server/pubsub"
+	"time"
+)
+
+// ExportDataHandler downloads the archive of the data of the user.
+// The archive is built in the background: while it isn't ready the response is
+// 202 Accepted with the state of the export, ask again later to download it.
+// GET /api/users/me/export
+func (cfg *ApiConfig) ExportDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	export, err := cfg.db.LatestDataExport(r.Context(), userID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	expired := export.ExpiresAt != nil && !export.ExpiresAt.After(time.Now())
+	if err != nil || export.Status == accounts.StatusFailed || expired {
+		export, err = cfg.db.RequestDataExport(r.Context(), userID)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+	}
+
+	if export.Status != accounts.StatusReady {
+		// 202 Accepted
+		respondWithJSON(w, http.StatusAccepted, export)
+		return
+	}
+
+	archive, err := cfg.exports.Get(r.Context(), export.BlobKey)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	defer archive.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, export.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, archive)
+}
+
+// DeleteAccountHandler deletes the account of the user after the grace period.
+// The account disappears and every session ends right away, logging in again
+// before the grace period is over cancels the deletion.
+// DELETE /api/users/me {"password": "..."}
+func (cfg *ApiConfig) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Password string `json:"password" validate:"required"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	// a stolen access token isn't enough to delete the account
+	err = cfg.db.VerifyPassword(r.Context(), userID, params.Password)
+	if err != nil {
+		cfg.audit(r, audit.Entry{
+			Action:  actionAccountDelete,
+			ActorID: &userID,
+			Outcome: auditOutcome(err),
+			Details: map[string]string{"reason": "wrong password"},
+		})
+		respondWithErr(w, r, err)
+		return
+	}
+
+	deleteAfter := time.Now().Add(cfg.AccountDeletionGrace)
+	err = cfg.db.DeleteAccount(r.Context(), userID, deleteAfter)
+	cfg.audit(r, audit.Entry{
+		Action:  actionAccountDelete,
+		ActorID: &userID,
+		Outcome: auditOutcome(err),
+		Details: map[string]string{"delete_after": deleteAfter.UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// close the live connections of the user
+	cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: userID})
+
+	// 202 Accepted
+	respondWithJSON(w, http.StatusAccepted, map[string]time.Time{"delete_after": deleteAfter.UTC()})
+}
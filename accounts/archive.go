@@ -0,0 +1,72 @@
+package accounts
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"server/storage"
+	"sort"
+)
+
+// Data is everything a user has stored
+type Data struct {
+	// Documents are written as indented JSON files, e.g. "chirps.json"
+	Documents map[string]interface{}
+	// Media are the blob keys of the files of the user, they are written under media/
+	Media []string
+}
+
+// WriteArchive writes data as a zip archive to w.
+// Media that no longer exist in blobs are left out.
+func WriteArchive(ctx context.Context, w io.Writer, data Data, blobs storage.BlobStore) error {
+	zw := zip.NewWriter(w)
+
+	names := make([]string, 0, len(data.Documents))
+	for name := range data.Documents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(data.Documents[name]); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range data.Media {
+		err := writeMedia(ctx, zw, key, blobs)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeMedia(ctx context.Context, zw *zip.Writer, key string, blobs storage.BlobStore) error {
+	r, err := blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// images are already compressed
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join("media", key), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
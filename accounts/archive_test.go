@@ -0,0 +1,70 @@
+package accounts
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"server/storage"
+	"strings"
+	"testing"
+)
+
+func TestWriteArchive(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := storage.NewLocalStore(t.TempDir(), "/app/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blobs.Put(ctx, "chirps/a.png", strings.NewReader("png data"), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := Data{
+		Documents: map[string]interface{}{
+			"profile.json": map[string]string{"handle": "jane"},
+			"chirps.json":  []string{"hello"},
+		},
+		// a missing file doesn't fail the export
+		Media: []string{"chirps/a.png", "chirps/missing.png"},
+	}
+
+	var buf bytes.Buffer
+	err = WriteArchive(ctx, &buf, data, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	var names []string
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+		names = append(names, f.Name)
+	}
+
+	want := []string{"chirps.json", "profile.json", "media/chirps/a.png"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	if got := files["media/chirps/a.png"]; got != "png data" {
+		t.Errorf("media = %q, want %q", got, "png data")
+	}
+	if got := files["profile.json"]; got != "{\n  \"handle\": \"jane\"\n}\n" {
+		t.Errorf("profile.json = %q", got)
+	}
+}
@@ -0,0 +1,196 @@
+// Package accounts builds the data exports of users and purges deleted accounts
+// once their grace period is over.
+package accounts
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"server/storage"
+	"strings"
+	"time"
+)
+
+// export statuses
+const (
+	StatusPending = "pending"
+	StatusReady   = "ready"
+	StatusFailed  = "failed"
+)
+
+// exportsPrefix starts the blob keys of the archives
+const exportsPrefix = "exports/"
+
+// ExportJob is an export waiting to be built
+type ExportJob struct {
+	ID     int
+	UserID int
+	// Attempts is the number of attempts made before this one
+	Attempts int
+}
+
+// Store keeps the export jobs and the accounts waiting to be purged
+type Store interface {
+	// ClaimExportJobs returns up to limit pending exports and hides them
+	// from other workers for the lease duration
+	ClaimExportJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]ExportJob, error)
+	// ExportData returns everything a user has stored
+	ExportData(ctx context.Context, userID int) (Data, error)
+	// CompleteExportJob marks an export as ready to be downloaded from the blob key
+	CompleteExportJob(ctx context.Context, jobID int, key string, expiresAt time.Time) error
+	// FailExportJob marks an export as failed, it isn't retried
+	FailExportJob(ctx context.Context, jobID int, msg string) error
+	// ExpireExports removes the exports that expired and returns their blob keys
+	ExpireExports(ctx context.Context, now time.Time) ([]string, error)
+	// PurgeDeletedUsers hard deletes up to limit accounts whose grace period is over.
+	// It returns the number of purged accounts and the blob keys they referenced.
+	PurgeDeletedUsers(ctx context.Context, now time.Time, limit int) (int, []string, error)
+}
+
+// Worker runs the export jobs and the purges in the background
+type Worker struct {
+	store Store
+	blobs storage.BlobStore
+	// exports keeps the archives, it must not be publicly readable
+	exports storage.BlobStore
+
+	BatchSize int
+	// Lease must be longer than building the largest export
+	Lease time.Duration
+	// MaxAttempts is how often an export is tried before it fails
+	MaxAttempts int
+	// ExportTTL is how long a finished export can be downloaded
+	ExportTTL time.Duration
+
+	now func() time.Time
+}
+
+// NewWorker creates a worker that reads the files of the users from blobs and
+// stores the archives in the private store exports under exports/
+func NewWorker(store Store, blobs storage.BlobStore, exports storage.BlobStore) *Worker {
+	return &Worker{
+		store:       store,
+		blobs:       blobs,
+		exports:     exports,
+		BatchSize:   5,
+		Lease:       10 * time.Minute,
+		MaxAttempts: 3,
+		ExportTTL:   7 * 24 * time.Hour,
+		now:         time.Now,
+	}
+}
+
+// Run builds pending exports and purges deleted accounts every interval until ctx is done
+func (w *Worker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.ProcessExports(ctx); err != nil {
+			slog.Error("build data exports", "err", err)
+		}
+		if _, err := w.Purge(ctx); err != nil {
+			slog.Error("purge deleted accounts", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessExports builds one batch of pending exports and returns how many were attempted
+func (w *Worker) ProcessExports(ctx context.Context) (int, error) {
+	jobs, err := w.store.ClaimExportJobs(ctx, w.now(), w.BatchSize, w.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, job := range jobs {
+		key, err := w.build(ctx, job)
+		if err == nil {
+			err = w.store.CompleteExportJob(ctx, job.ID, key, w.now().Add(w.ExportTTL))
+			if err != nil {
+				w.deleteBlobs(ctx, []string{key})
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		slog.Warn("build data export", "export_id", job.ID, "attempt", job.Attempts+1, "err", err)
+		// the job is claimed again when its lease is over
+		if job.Attempts+1 >= w.MaxAttempts {
+			errs = append(errs, w.store.FailExportJob(ctx, job.ID, err.Error()))
+		}
+	}
+
+	// expired exports are removed on the same schedule
+	keys, err := w.store.ExpireExports(ctx, w.now())
+	w.deleteBlobs(ctx, keys)
+	errs = append(errs, err)
+
+	return len(jobs), errors.Join(errs...)
+}
+
+// build writes the archive of a job to a temporary file and stores it
+func (w *Worker) build(ctx context.Context, job ExportJob) (string, error) {
+	data, err := w.store.ExportData(ctx, job.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "chirpy-export-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = WriteArchive(ctx, f, data, w.blobs)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	key, err := storage.NewKey("exports", ".zip")
+	if err != nil {
+		return "", err
+	}
+	err = w.exports.Put(ctx, key, f, "application/zip")
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Purge hard deletes the accounts whose grace period is over and removes their files
+func (w *Worker) Purge(ctx context.Context) (int, error) {
+	n, keys, err := w.store.PurgeDeletedUsers(ctx, w.now(), w.BatchSize)
+	w.deleteBlobs(ctx, keys)
+	if n > 0 {
+		slog.Info("purged deleted accounts", "count", n)
+	}
+	return n, err
+}
+
+// deleteBlobs removes files that are no longer referenced, failures are only logged
+func (w *Worker) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		stores := []storage.BlobStore{w.blobs}
+		if strings.HasPrefix(key, exportsPrefix) {
+			// archives built before they had their own store were kept with the public files
+			stores = []storage.BlobStore{w.exports, w.blobs}
+		}
+		for _, store := range stores {
+			if err := store.Delete(ctx, key); err != nil {
+				slog.Error("delete blob", "key", key, "err", err)
+			}
+		}
+	}
+}
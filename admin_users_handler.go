@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"server/db"
+	"server/pubsub"
+	"strconv"
+	"time"
+)
+
+// SuspendUserHandler suspends a user for a duration, or bans them when no duration is given
+// POST /api/admin/users/{userID}/suspension {"reason": "spam", "duration_hours": 72, "hide_chirps": true}
+func (cfg *ApiConfig) SuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid user ID")
+		return
+	}
+
+	var params struct {
+		Reason        string `json:"reason" validate:"required,max=500"`
+		DurationHours int    `json:"duration_hours" validate:"min=0"`
+		HideChirps    bool   `json:"hide_chirps"`
+	}
+	err = decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	adminID := r.Context().Value(userIDKey).(int)
+	if userID == adminID {
+		respondWithError(w, http.StatusBadRequest, "can't suspend yourself")
+		return
+	}
+
+	_, err = cfg.db.GetUserByID(r.Context(), userID)
+	if errors.Is(err, db.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	var until *time.Time
+	if params.DurationHours > 0 {
+		t := time.Now().Add(time.Duration(params.DurationHours) * time.Hour)
+		until = &t
+	}
+
+	suspension, err := cfg.db.SuspendUser(r.Context(), userID, params.Reason, until, params.HideChirps, adminID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// close the live connections of the user
+	cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: userID})
+
+	respondWithJSON(w, http.StatusCreated, suspension)
+}
+
+// LiftSuspensionHandler lifts every active suspension and ban of a user
+// DELETE /api/admin/users/{userID}/suspension
+func (cfg *ApiConfig) LiftSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid user ID")
+		return
+	}
+
+	adminID := r.Context().Value(userIDKey).(int)
+
+	err = cfg.db.LiftSuspension(r.Context(), userID, adminID, r.URL.Query().Get("note"))
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// GetSuspensionsHandler lists the suspension history of a user
+// GET /api/admin/users/{userID}/suspensions
+func (cfg *ApiConfig) GetSuspensionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid user ID")
+		return
+	}
+
+	suspensions, err := cfg.db.GetSuspensions(r.Context(), userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, suspensions)
+}
+
+// GetDuplicateEmailsHandler lists the emails shared by several accounts.
+// The unique email index is only created once this list is empty.
+// GET /api/admin/users/duplicate-emails
+func (cfg *ApiConfig) GetDuplicateEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	duplicates, err := cfg.db.DuplicateEmails(r.Context())
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, duplicates)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"server/db"
+	"server/logging"
+	"strconv"
+	"time"
+)
+
+// GetWebhookDeliveriesHandler lists stored inbound webhook deliveries
+// GET /api/admin/webhooks/deliveries?source=polka&event=user.upgraded&outcome=failed&since=2024-05-01T00:00:00Z&until=...&limit=50
+func (cfg *ApiConfig) GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := db.WebhookDeliveryFilter{
+		Source:  query.Get("source"),
+		Event:   query.Get("event"),
+		Outcome: query.Get("outcome"),
+		Limit:   50,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid until")
+			return
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		filter.Limit, err = strconv.Atoi(l)
+		if err != nil || filter.Limit <= 0 || filter.Limit > 500 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	deliveries, err := cfg.db.GetWebhookDeliveries(r.Context(), filter)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// GetWebhookDeliveryHandler returns a single stored delivery
+// GET /api/admin/webhooks/deliveries/{deliveryID}
+func (cfg *ApiConfig) GetWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.Atoi(r.PathValue("deliveryID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid delivery ID")
+		return
+	}
+
+	delivery, err := cfg.db.GetWebhookDelivery(r.Context(), deliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, delivery)
+}
+
+// ReplayWebhookDeliveryHandler runs a stored delivery through its handler again.
+// Only deliveries that passed verification can be replayed, the replay is logged as a new delivery.
+// Event ids that were already processed are deduplicated by the handler. Deliveries without an
+// event id are refused once processed, and at most one replay of them is processed.
+// POST /api/admin/webhooks/deliveries/{deliveryID}/replay
+func (cfg *ApiConfig) ReplayWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.Atoi(r.PathValue("deliveryID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid delivery ID")
+		return
+	}
+
+	original, err := cfg.db.GetWebhookDelivery(r.Context(), deliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	err = original.CheckReplay()
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	handler, ok := cfg.webhookReplayHandlers()[original.Source]
+	if !ok {
+		respondWithError(w, http.StatusConflict, "unknown webhook source")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, (&url.URL{Path: "/replay"}).String(), nil)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	for name, values := range original.Headers {
+		req.Header[name] = values
+	}
+
+	// replays of a delivery without event id share a key, so only one of them is applied
+	replayKey := ""
+	if original.EventID == "" {
+		replayKey = original.ReplayKey()
+		claimed, err := cfg.db.ClaimWebhookEvent(r.Context(), original.Source, replayKey, original.Event)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+		if !claimed {
+			respondWithErr(w, r, db.ErrUnsafeReplay)
+			return
+		}
+	}
+
+	// the stored delivery was verified when it was received,
+	// replays point at the delivery that was received
+	replayOf := original.ID
+	if original.ReplayOf != nil {
+		replayOf = *original.ReplayOf
+	}
+	replay := db.WebhookDelivery{
+		Source:             original.Source,
+		Headers:            original.Headers,
+		Body:               original.Body,
+		Verified:           true,
+		VerificationMethod: "replay",
+		ReplayOf:           &replayOf,
+	}
+	saved, err := cfg.runLoggedWebhook(&replay, handler, &discardResponseWriter{}, req, []byte(original.Body))
+	if replayKey != "" && (err != nil || saved.Outcome != db.WebhookProcessed) {
+		// nothing was applied, the delivery can be replayed again
+		if err := cfg.db.ReleaseWebhookEvent(context.WithoutCancel(r.Context()), original.Source, replayKey); err != nil {
+			logging.FromContext(r.Context()).Error("release webhook replay", "delivery_id", original.ID, "err", err)
+		}
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, saved)
+}
+
+// webhookReplayHandlers maps webhook sources to their handlers without the verification middleware
+func (cfg *ApiConfig) webhookReplayHandlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		"polka": http.HandlerFunc(cfg.PolkaWebhookHandler),
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"server/db"
+	"server/logging"
+	"server/media"
+	"server/storage"
+)
+
+const (
+	maxAttachments      = 4
+	maxAttachmentBytes  = 10 << 20
+	maxChirpUploadBytes = maxAttachments*maxAttachmentBytes + 1<<20
+)
+
+// readChirpUpload parses a multipart/form-data chirp with a "body" field
+// and up to maxAttachments images in "attachments" fields
+func readChirpUpload(w http.ResponseWriter, r *http.Request) (string, []media.Image, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxChirpUploadBytes)
+
+	err := r.ParseMultipartForm(1 << 20)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", nil, err
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: invalid multipart form", db.ErrInvalid)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["attachments"]
+	if len(files) > maxAttachments {
+		return "", nil, fmt.Errorf("%w: at most %d attachments are allowed", db.ErrInvalid, maxAttachments)
+	}
+
+	var images []media.Image
+	for _, header := range files {
+		if header.Size > maxAttachmentBytes {
+			return "", nil, fmt.Errorf("%w: %s is too large", db.ErrInvalid, header.Filename)
+		}
+
+		f, err := header.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxAttachmentBytes))
+		f.Close()
+		if err != nil {
+			return "", nil, err
+		}
+
+		// the type is sniffed from the content, the file name is ignored
+		img, err := media.Sanitize(data)
+		if err != nil {
+			return "", nil, invalidImage(header.Filename, err)
+		}
+		images = append(images, img)
+	}
+
+	return r.FormValue("body"), images, nil
+}
+
+// invalidImage reports the images media.Sanitize refused as invalid requests, other errors are internal
+func invalidImage(name string, err error) error {
+	if !errors.Is(err, media.ErrUnsupportedType) && !errors.Is(err, media.ErrInvalidImage) && !errors.Is(err, media.ErrImageTooLarge) {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("%w: %w", db.ErrInvalid, err)
+	}
+	return fmt.Errorf("%w: %s: %w", db.ErrInvalid, name, err)
+}
+
+// storeAttachments saves the images in the blob store
+// if one of them fails the ones already stored are removed
+func (cfg *ApiConfig) storeAttachments(ctx context.Context, images []media.Image) ([]db.Attachment, error) {
+	var attachments []db.Attachment
+	for _, img := range images {
+		key, err := storage.NewKey("chirps", img.Ext)
+		if err != nil {
+			cfg.deleteBlobs(ctx, attachmentKeys(attachments))
+			return nil, err
+		}
+
+		err = cfg.blobs.Put(ctx, key, bytes.NewReader(img.Data), img.ContentType)
+		if err != nil {
+			cfg.deleteBlobs(ctx, attachmentKeys(attachments))
+			return nil, err
+		}
+
+		attachments = append(attachments, db.Attachment{
+			Key:         key,
+			ContentType: img.ContentType,
+			Size:        len(img.Data),
+			Width:       img.Width,
+			Height:      img.Height,
+		})
+	}
+	return attachments, nil
+}
+
+// deleteBlobs removes blobs that are no longer referenced, failures are only logged
+func (cfg *ApiConfig) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		err := cfg.blobs.Delete(ctx, key)
+		if err != nil {
+			logging.FromContext(ctx).Error("delete blob", "key", key, "err", err)
+		}
+	}
+}
+
+// withAttachmentURLs fills in the public url of every attachment
+func (cfg *ApiConfig) withAttachmentURLs(chirps []db.Chirp) []db.Chirp {
+	for i := range chirps {
+		for j := range chirps[i].Attachments {
+			a := &chirps[i].Attachments[j]
+			a.URL = cfg.blobs.URL(a.Key)
+			a.Variants = imageVariantURLs(a.Key)
+		}
+	}
+	return chirps
+}
+
+func attachmentKeys(attachments []db.Attachment) []string {
+	keys := make([]string, len(attachments))
+	for i, a := range attachments {
+		keys[i] = a.Key
+	}
+	return keys
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"server/audit"
+	"server/db"
+	"server/logging"
+	"strconv"
+	"strings"
+)
+
+// audited actions, admin routes are recorded as "admin." + their name
+const (
+	actionLogin          = "auth.login"
+	actionTokenRefresh   = "auth.token_refresh"
+	actionTokenRevoke    = "auth.token_revoke"
+	actionRoleDenied     = "auth.role_denied"
+	actionPasswordChange = "user.password_change"
+	actionEmailChange    = "user.email_change"
+	actionAccountDelete  = "user.delete"
+	actionChirpDelete    = "chirp.delete"
+	// polka events are recorded as "polka." + the event, e.g. "polka.user.upgraded"
+	actionPolkaPrefix = "polka."
+	actionAdminPrefix = "admin."
+)
+
+// audit appends an entry to the audit log with the IP and user agent of the request.
+// Failures are logged, they never fail the request.
+func (cfg *ApiConfig) audit(r *http.Request, e audit.Entry) {
+	e.IP = cfg.clientIP(r)
+	e.UserAgent = strings.ToValidUTF8(r.UserAgent(), "�")
+
+	// the entry is still written when the client goes away
+	_, err := cfg.db.AppendAudit(context.WithoutCancel(r.Context()), e)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("append audit log", "action", e.Action, "err", err)
+	}
+}
+
+// auditOutcome is the outcome of an audited action that returned err
+func auditOutcome(err error) string {
+	switch {
+	case err == nil:
+		return audit.OutcomeSuccess
+	case errors.Is(err, db.ErrForbidden):
+		return audit.OutcomeDenied
+	default:
+		return audit.OutcomeFailure
+	}
+}
+
+// actorOf returns the id of the authenticated user, nil for anonymous requests
+func actorOf(r *http.Request) *int {
+	if userID, ok := r.Context().Value(userIDKey).(int); ok {
+		return &userID
+	}
+	return nil
+}
+
+// userActor returns a pointer to userID, nil when the user is unknown
+func userActor(userID int) *int {
+	if userID == 0 {
+		return nil
+	}
+	return &userID
+}
+
+// targetID formats the id of a target, "" when it is unknown
+func targetID(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(id)
+}
+
+// clientIP is the address of the client. Behind TrustedProxyHops proxies it is the X-Forwarded-For
+// address added by the outermost proxy, the addresses left of it are sent by the client and can be forged.
+func (cfg *ApiConfig) clientIP(r *http.Request) string {
+	if cfg.TrustedProxyHops > 0 {
+		if ip := forwardedClientIP(r.Header.Values("X-Forwarded-For"), cfg.TrustedProxyHops); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedClientIP returns the address hops entries from the right of the X-Forwarded-For headers,
+// "" when it isn't an IP. With fewer entries every one was added by a trusted proxy and the first is used.
+func forwardedClientIP(headers []string, hops int) string {
+	var addrs []string
+	for _, header := range headers {
+		for _, addr := range strings.Split(header, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	if len(addrs) == 0 {
+		return ""
+	}
+
+	i := len(addrs) - hops
+	if i < 0 {
+		i = 0
+	}
+	ip := net.ParseIP(addrs[i])
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// auditTargets are the path values that name the target of an admin route
+var auditTargets = []struct {
+	pathValue  string
+	targetType string
+}{
+	{"userID", "user"},
+	{"chirpID", "chirp"},
+	{"deliveryID", "webhook_delivery"},
+}
+
+// auditAdmin records every request to an admin route as "admin." + name.
+// The outcome follows the status of the response: denied for 401 and 403, failure for other errors.
+func (cfg *ApiConfig) auditAdmin(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		e := audit.Entry{
+			Action:  actionAdminPrefix + name,
+			ActorID: actorOf(r),
+			Outcome: audit.OutcomeSuccess,
+			Details: map[string]string{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"status": strconv.Itoa(rec.Status()),
+			},
+		}
+		for _, target := range auditTargets {
+			if id := r.PathValue(target.pathValue); id != "" {
+				e.TargetType, e.TargetID = target.targetType, id
+				break
+			}
+		}
+
+		switch status := rec.Status(); {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			e.Outcome = audit.OutcomeDenied
+		case status >= http.StatusBadRequest:
+			e.Outcome = audit.OutcomeFailure
+		}
+
+		cfg.audit(r, e)
+	})
+}
@@ -0,0 +1,85 @@
+// Package audit describes the entries of the audit log. Every entry includes the hash
+// of the entry before it, so changing, inserting or removing an entry breaks the chain.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeDenied is an attempt that was refused, e.g. a suspended user logging in
+	OutcomeDenied = "denied"
+)
+
+// Entry is one event of the audit log
+type Entry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	ActorID    *int      `json:"actor_id"`
+	TargetType string    `json:"target_type,omitempty"`
+	TargetID   string    `json:"target_id,omitempty"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Outcome    string    `json:"outcome"`
+	// Details are extra facts about the event, e.g. the email of a failed login
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// hashed are the fields covered by the hash, the order of the fields is part of the format
+type hashed struct {
+	PrevHash   string            `json:"prev_hash"`
+	Time       string            `json:"time"`
+	Action     string            `json:"action"`
+	ActorID    *int              `json:"actor_id"`
+	TargetType string            `json:"target_type"`
+	TargetID   string            `json:"target_id"`
+	IP         string            `json:"ip"`
+	UserAgent  string            `json:"user_agent"`
+	Outcome    string            `json:"outcome"`
+	Details    map[string]string `json:"details"`
+}
+
+// ComputeHash returns the hex sha256 of the entry chained to its PrevHash.
+// The id isn't covered, the chain itself orders the entries.
+func (e Entry) ComputeHash() string {
+	// no details and empty details are the same
+	details := e.Details
+	if len(details) == 0 {
+		details = nil
+	}
+
+	// json.Marshal sorts the keys of the details
+	b, err := json.Marshal(hashed{
+		PrevHash:   e.PrevHash,
+		Time:       e.Time.UTC().Format(time.RFC3339Nano),
+		Action:     e.Action,
+		ActorID:    e.ActorID,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		IP:         e.IP,
+		UserAgent:  e.UserAgent,
+		Outcome:    e.Outcome,
+		Details:    details,
+	})
+	if err != nil {
+		// only strings and ints are encoded
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Follows reports whether e is intact and comes right after the entry with prevHash.
+// The first entry of the log follows "".
+func (e Entry) Follows(prevHash string) bool {
+	return e.PrevHash == prevHash && e.ComputeHash() == e.Hash
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"testing"
+	"time"
+)
+
+// chain links the entries like the log does when they are appended
+func chain(entries []Entry) []Entry {
+	prev := ""
+	for i := range entries {
+		entries[i].PrevHash = prev
+		entries[i].Hash = entries[i].ComputeHash()
+		prev = entries[i].Hash
+	}
+	return entries
+}
+
+// broken returns the index of the first entry that doesn't follow the one before it, -1 when intact
+func broken(entries []Entry) int {
+	prev := ""
+	for i, e := range entries {
+		if !e.Follows(prev) {
+			return i
+		}
+		prev = e.Hash
+	}
+	return -1
+}
+
+func TestChain(t *testing.T) {
+	actor := 7
+	newLog := func() []Entry {
+		start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		return chain([]Entry{
+			{Time: start, Action: "auth.login", ActorID: &actor, IP: "10.0.0.1", Outcome: OutcomeSuccess},
+			{Time: start.Add(time.Second), Action: "auth.login", IP: "10.0.0.2", Outcome: OutcomeFailure,
+				Details: map[string]string{"email": "bob@example.com"}},
+			{Time: start.Add(2 * time.Second), Action: "chirp.delete", ActorID: &actor, TargetType: "chirp", TargetID: "3", Outcome: OutcomeSuccess},
+		})
+	}
+
+	tests := []struct {
+		name   string
+		tamper func([]Entry) []Entry
+		want   int
+	}{
+		{name: "Intact", tamper: func(e []Entry) []Entry { return e }, want: -1},
+		{
+			name:   "Changed details",
+			tamper: func(e []Entry) []Entry { e[1].Details["email"] = "alice@example.com"; return e },
+			want:   1,
+		},
+		{
+			name:   "Changed actor",
+			tamper: func(e []Entry) []Entry { other := 8; e[0].ActorID = &other; return e },
+			want:   0,
+		},
+		{
+			name:   "Removed entry",
+			tamper: func(e []Entry) []Entry { return append(e[:1], e[2:]...) },
+			want:   1,
+		},
+		{
+			name:   "Rehashed entry",
+			tamper: func(e []Entry) []Entry { e[1].Outcome = OutcomeSuccess; e[1].Hash = e[1].ComputeHash(); return e },
+			want:   2,
+		},
+		{
+			name: "Same instant in another time zone",
+			tamper: func(e []Entry) []Entry {
+				e[2].Time = e[2].Time.In(time.FixedZone("CEST", 2*60*60))
+				return e
+			},
+			want: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := broken(tt.tamper(newLog())); got != tt.want {
+				t.Errorf("first broken entry = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{name: "Proxy headers not trusted", hops: 0, forwarded: []string{"203.0.113.7"}, want: "192.0.2.1"},
+		{name: "One proxy", hops: 1, forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "Forged address left of the proxy", hops: 1, forwarded: []string{"10.0.0.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "Two proxies", hops: 2, forwarded: []string{"10.0.0.1, 203.0.113.7, 198.51.100.2"}, want: "203.0.113.7"},
+		{name: "Several headers", hops: 2, forwarded: []string{"10.0.0.1", "203.0.113.7", "198.51.100.2"}, want: "203.0.113.7"},
+		{name: "Fewer addresses than proxies", hops: 2, forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "Not an IP", hops: 1, forwarded: []string{"203.0.113.7, unknown"}, want: "192.0.2.1"},
+		{name: "No header", hops: 1, want: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ApiConfig{TrustedProxyHops: tt.hops}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := cfg.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
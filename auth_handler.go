@@ -1,11 +1,69 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
+	"server/db"
+	"server/jwt"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	// errUnknownTokenUser is returned for valid tokens of users that no longer exist
+	errUnknownTokenUser = fmt.Errorf("%w: user not found", jwt.ErrInvalidToken)
+	// errTokenRevoked is returned for tokens issued before the last password change
+	errTokenRevoked = fmt.Errorf("%w: session was revoked", jwt.ErrInvalidToken)
+	// errMissingToken is returned when the Authorization header doesn't carry a bearer token
+	errMissingToken = fmt.Errorf("%w: missing bearer token", jwt.ErrInvalidToken)
+	// errMissingApiKey is returned when the Authorization header doesn't carry an api key
+	errMissingApiKey = fmt.Errorf("%w: invalid api key", db.ErrUnauthorized)
+)
+
+// authenticateToken returns the user of an access token and when the token expires.
+// The user must exist, must not be suspended and the token must be issued after
+// the last password change.
+func (cfg *ApiConfig) authenticateToken(ctx context.Context, token string) (int, time.Time, error) {
+	claims, err := jwt.ParseJwtToken(ctx, token, cfg.JwtSecret)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, time.Time{}, jwt.ErrInvalidToken
+	}
+
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, time.Time{}, errUnknownTokenUser
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if user.TokensValidAfter != nil && (claims.IssuedAt == nil || claims.IssuedAt.Before(*user.TokensValidAfter)) {
+		return 0, time.Time{}, errTokenRevoked
+	}
+
+	// suspended and banned users can't use their tokens
+	err = cfg.db.CheckNotSuspended(ctx, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	return userID, expiresAt, nil
+}
+
 // getUserFromToken
 // header "Authorization: Bearer <token>"
 func GetTokenFromHeader(r *http.Request) (string, error) {
@@ -19,9 +77,30 @@ func GetTokenFromHeader(r *http.Request) (string, error) {
 
 	}
 
-	return "", errors.New("invalid token")
+	return "", errMissingToken
+}
+
+// polka webhook signature headers
+const (
+	polkaSignatureHeader = "X-Polka-Signature"
+	polkaTimestampHeader = "X-Polka-Timestamp"
+)
+
+// signedDeliveryID identifies a signed polka delivery by its timestamp and signature,
+// "" for unsigned deliveries. The signature covers the timestamp and the body, a
+// captured delivery can't be sent again under another id.
+func signedDeliveryID(r *http.Request) string {
+	sig := r.Header.Get(polkaSignatureHeader)
+	timestamp, err := strconv.ParseInt(r.Header.Get(polkaTimestampHeader), 10, 64)
+	if sig == "" || err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strconv.FormatInt(timestamp, 10) + "." + sig))
+	return "sig_" + hex.EncodeToString(sum[:])
 }
 
+// GetPolkaApiKeyFromHeader
+// header "Authorization: ApiKey <key>"
 func GetPolkaApiKeyFromHeader(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	keyParts := strings.Split(authHeader, " ")
@@ -33,5 +112,5 @@ func GetPolkaApiKeyFromHeader(r *http.Request) (string, error) {
 
 	}
 
-	return "", errors.New("invalid api key")
+	return "", errMissingApiKey
 }
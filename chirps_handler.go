@@ -1,13 +1,18 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"net/http"
-	"regexp"
+	"server/audit"
 	"server/db"
+	"server/logging"
+	"server/media"
+	"server/moderation"
+	"server/pubsub"
+	"server/validation"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (cfg *ApiConfig) getChirpByIDHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,15 +27,21 @@ func (cfg *ApiConfig) getChirpByIDHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	chirp, err := cfg.db.GetChirpByID(chirpIDInt)
+	chirp, err := cfg.db.GetChirpByID(r.Context(), chirpIDInt)
 
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+		respondWithErr(w, r, err)
+		return
+	}
+
+	chirps, err := cfg.expandChirps(r, []db.Chirp{chirp})
+	if err != nil {
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// 200 OK
-	respondWithJSON(w, http.StatusOK, chirp)
+	respondWithJSON(w, http.StatusOK, chirps[0])
 }
 
 func (cfg *ApiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
@@ -53,10 +64,16 @@ func (cfg *ApiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Get all chirps by the specified author
-		chirps, err := cfg.db.GetChirpsByAuthorID(userIDInt, sortOrder)
+		chirps, err := cfg.db.GetChirpsByAuthorID(r.Context(), userIDInt, sortOrder)
+
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
 
+		chirps, err = cfg.expandChirps(r, chirps)
 		if err != nil {
-			respondWithError(w, http.StatusNotFound, err.Error())
+			respondWithErr(w, r, err)
 			return
 		}
 
@@ -66,10 +83,16 @@ func (cfg *ApiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get all chirps from the database
-	chirps, err := cfg.db.GetChirps(sortOrder)
+	chirps, err := cfg.db.GetChirps(r.Context(), sortOrder)
+
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
 
+	chirps, err = cfg.expandChirps(r, chirps)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
@@ -91,79 +114,244 @@ func (cfg *ApiConfig) deleteChirpByIDHandler(w http.ResponseWriter, r *http.Requ
 
 	userID := r.Context().Value(userIDKey).(int)
 
-	err = cfg.db.DeleteChirpByID(chirpIDInt, userID)
-
+	// the chirp is only marked as deleted, the files are removed when it is purged
+	err = cfg.db.DeleteChirpByID(r.Context(), chirpIDInt, userID)
+	cfg.audit(r, audit.Entry{
+		Action:     actionChirpDelete,
+		ActorID:    &userID,
+		TargetType: "chirp",
+		TargetID:   chirpID,
+		Outcome:    auditOutcome(err),
+	})
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
+	cfg.announceChirpDeleted(r.Context(), chirpIDInt, userID)
+
 	// 204 No Content
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
-func (cfg *ApiConfig) CreateChirpHandler(w http.ResponseWriter, r *http.Request) {
+// undoDeleteChirpHandler restores a chirp the user deleted less than ChirpUndoWindow ago
+// POST /api/chirps/{chirpID}/restore
+func (cfg *ApiConfig) undoDeleteChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid chirp ID")
+		return
+	}
 
-	var chirp db.Chirp
-	err := json.NewDecoder(r.Body).Decode(&chirp)
+	userID := r.Context().Value(userIDKey).(int)
 
+	chirp, visible, err := cfg.db.UndoDeleteChirp(r.Context(), chirpID, userID, cfg.ChirpUndoWindow)
 	if err != nil {
-		// 500 Internal Server Error
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		respondWithErr(w, r, err)
 		return
+	}
+
+	cfg.respondWithRestoredChirp(w, r, chirp, visible)
+}
+
+// restoreChirpHandler restores any deleted chirp that wasn't purged yet
+// POST /api/admin/chirps/{chirpID}/restore
+func (cfg *ApiConfig) restoreChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid chirp ID")
+		return
+	}
+
+	chirp, visible, err := cfg.db.RestoreChirp(r.Context(), chirpID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	cfg.respondWithRestoredChirp(w, r, chirp, visible)
+}
+
+// respondWithRestoredChirp shows a restored chirp to the stream subscribers and the webhooks again
+// and returns it, chirps that are still hidden by moderation or by a suspension aren't announced
+func (cfg *ApiConfig) respondWithRestoredChirp(w http.ResponseWriter, r *http.Request, chirp db.Chirp, visible bool) {
+	cfg.withAttachmentURLs([]db.Chirp{chirp})
+
+	if visible {
+		cfg.publishChirp(r.Context(), chirp)
+	}
+
+	// 200 OK
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func (cfg *ApiConfig) CreateChirpHandler(w http.ResponseWriter, r *http.Request) {
+
+	var chirp chirpRequest
+	var images []media.Image
+	var err error
+
+	// images are uploaded as multipart/form-data, text only chirps as JSON
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		chirp.Body, images, err = readChirpUpload(w, r)
+		if err != nil {
+			// 400 Bad Request
+			respondWithErr(w, r, err)
+			return
+		}
+		// scheduled chirps are text only
+		if r.FormValue("publish_at") != "" {
+			respondWithError(w, http.StatusBadRequest, "attachments can't be scheduled, send scheduled chirps as JSON")
+			return
+		}
+		err = validation.Struct(&chirp)
+	} else {
+		err = decodeRequest(w, r, &chirp)
+	}
+
+	// a chirp needs a body unless it has images
+	if err == nil && chirp.Body == "" && len(images) == 0 {
+		err = validation.Errors{{Field: "body", Message: "is required"}}
+	}
 
+	if err != nil {
+		// 422 Unprocessable Entity
+		respondWithErr(w, r, err)
+		return
 	}
 
-	validatedChirp, err := validateChirp(chirp)
+	// scheduled chirps are only counted by the moderation rules when they are published
+	validate := cfg.validateChirp
+	if chirp.PublishAt != nil {
+		validate = cfg.checkChirp
+	}
+	validatedChirp, moderationResult, err := validate(db.Chirp{Body: chirp.Body})
 
 	if err != nil {
-		// 400 Bad Request
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		// 422 Unprocessable Entity
+		respondWithErr(w, r, err)
+		return
 	}
 
 	//  use r.context.Value("userID") instead of parsing the JWT token again
 	userID := r.Context().Value(userIDKey).(int)
 
-	// Save the chirp to the database
-	newChirp, err := cfg.db.CreateChirp(validatedChirp.Body, userID)
+	// scheduled chirps are saved as drafts, moderation runs again when they are published
+	if chirp.PublishAt != nil {
+		err = validatePublishAt(*chirp.PublishAt)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+
+		draft, err := cfg.db.CreateDraft(r.Context(), userID, chirp.Body, chirp.PublishAt)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+
+		// 202 Accepted
+		respondWithJSON(w, http.StatusAccepted, draft)
+		return
+	}
+
+	// Save the attachments to the blob store
+	attachments, err := cfg.storeAttachments(r.Context(), images)
 
 	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// Save the chirp to the database
+	newChirp, err := cfg.db.CreateChirpWithAttachments(r.Context(), validatedChirp.Body, userID, attachments)
 
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err != nil {
+		cfg.deleteBlobs(r.Context(), attachmentKeys(attachments))
+		respondWithErr(w, r, err)
 		return
 	}
 
+	cfg.withAttachmentURLs([]db.Chirp{newChirp})
+	cfg.announceChirp(r.Context(), newChirp, moderationResult)
+
 	// 200 OK
 	respondWithJSON(w, http.StatusOK, newChirp)
 }
 
-// validateChirp validates the chirp and returns a cleaned version of the chirp
-func validateChirp(chirp db.Chirp) (validateChirp db.Chirp, err error) {
-
-	// Check if chirp is too long
-	if len(chirp.Body) > 140 {
-		err = errors.New("chirp is too long")
-		return db.Chirp{}, err
+// announceChirp queues a new chirp for review when a moderation rule flagged it and
+// notifies the stream subscribers and the webhooks. Scheduled chirps go through it as well.
+func (cfg *ApiConfig) announceChirp(ctx context.Context, chirp db.Chirp, moderationResult moderation.Result) {
+	// queue flagged chirps for review
+	if flagged := moderationResult.Rules(moderation.Flag); len(flagged) > 0 {
+		err := cfg.db.FlagChirp(ctx, chirp.ID, flagged)
+		if err != nil {
+			logging.FromContext(ctx).Error("flag chirp", "chirp_id", chirp.ID, "err", err)
+		}
 	}
 
-	// Replace bad words with "****"
-	cleanedBody := replaceBadWords(chirp.Body)
+	cfg.publishChirp(ctx, chirp)
+	cfg.metrics.ChirpCreated()
+}
 
-	validatedChirp := db.Chirp{Body: cleanedBody}
+// publishChirp notifies the stream subscribers and the webhooks of a chirp that became visible
+func (cfg *ApiConfig) publishChirp(ctx context.Context, chirp db.Chirp) {
+	cfg.hub.Publish(pubsub.Event{
+		Type:     chirpCreatedEvent,
+		AuthorID: chirp.AuthID,
+		Data:     chirp,
+	})
+	cfg.emitWebhook(ctx, chirpCreatedEvent, chirp.AuthID, chirp)
+}
 
-	return validatedChirp, nil
+// announceChirpDeleted notifies the stream subscribers and the webhooks that a chirp is gone,
+// whether its author deleted it or a moderator removed or hid it
+func (cfg *ApiConfig) announceChirpDeleted(ctx context.Context, chirpID int, authorID int) {
+	cfg.hub.Publish(pubsub.Event{
+		Type:     chirpDeletedEvent,
+		AuthorID: authorID,
+		Data:     deletedChirp{ID: chirpID, AuthID: authorID},
+	})
+	cfg.emitWebhook(ctx, chirpDeletedEvent, authorID, deletedChirp{ID: chirpID, AuthID: authorID})
 }
 
-// replaceBadWords replaces bad words with "****"
-func replaceBadWords(chirp string) string {
-	wordsToReplace := []string{"kerfuffle", "sharbert", "fornax"}
-	replacement := "****"
+// chirpRequest is the body of CreateChirpHandler, the length is counted in characters (runes).
+// A chirp with publish_at is scheduled instead of posted.
+type chirpRequest struct {
+	Body      string     `json:"body" validate:"max=140"`
+	PublishAt *time.Time `json:"publish_at"`
+}
 
-	// Create a regular expression to match words irrespective of case, excluding adjacent punctuation
-	re := regexp.MustCompile(`(?i)\b(` + strings.Join(wordsToReplace, "|") + `)\b`)
+// validateChirp validates the chirp that is being published and returns a cleaned version of the chirp
+// together with the moderation result that tells which rules fired
+func (cfg *ApiConfig) validateChirp(chirp db.Chirp) (db.Chirp, moderation.Result, error) {
+	return moderateChirp(chirp, cfg.moderation.Run)
+}
+
+// checkChirp validates a chirp that is only saved for later like validateChirp,
+// the rules that fired are counted when it is published
+func (cfg *ApiConfig) checkChirp(chirp db.Chirp) (db.Chirp, moderation.Result, error) {
+	return moderateChirp(chirp, cfg.moderation.Check)
+}
+
+// moderateChirp checks the length of the chirp and runs it through the moderation pipeline
+func moderateChirp(chirp db.Chirp, run func(text string) moderation.Result) (db.Chirp, moderation.Result, error) {
+
+	// Check if chirp is too long
+	err := validation.Struct(chirpRequest{Body: chirp.Body})
+	if err != nil {
+		return db.Chirp{}, moderation.Result{}, err
+	}
+
+	// Run the moderation pipeline, masked words are replaced with "****"
+	result := run(chirp.Body)
+
+	if result.Action == moderation.Reject {
+		msg := "rejected by rule " + strings.Join(result.Rules(moderation.Reject), ", ")
+		return db.Chirp{}, result, validation.Errors{{Field: "body", Message: msg}}
+	}
 
-	// Replace matching words with "****"
-	modifiedChirp := re.ReplaceAllString(chirp, replacement)
+	validatedChirp := db.Chirp{Body: result.Body}
 
-	return modifiedChirp
+	return validatedChirp, result, nil
 }
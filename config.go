@@ -2,14 +2,36 @@ package main
 
 import (
 	"server/db"
-	"sync"
+	"server/mailer"
+	"server/media"
+	"server/metrics"
+	"server/moderation"
+	"server/pubsub"
+	"server/storage"
+	"time"
 )
 
 type ApiConfig struct {
-	fileserverHits int
-	mu             sync.Mutex
+	metrics        *metrics.Metrics
 	db             db.DB
 	JwtSecret      string
 	JwtExpireSec   int64
 	UserFreshTokenExpireSec int64
+	hub                     *pubsub.Broker
+	blobs                   storage.BlobStore
+	// exports keeps the data export archives, it isn't served by the file server
+	exports                 storage.BlobStore
+	variants                *media.VariantCache
+	moderation              *moderation.Pipeline
+	ReportHideThreshold     int
+	PolkaApiKey             string
+	PolkaWebhookSecret      string
+	PolkaSignatureTolerance time.Duration
+	PolkaRequireSignature   bool
+	mailer                  mailer.Mailer
+	AccountDeletionGrace    time.Duration
+	ChirpUndoWindow         time.Duration
+	// TrustedProxyHops is the number of proxies in front of the server that append to X-Forwarded-For,
+	// the client IP is the address added by the outermost one. 0 uses the address of the connection.
+	TrustedProxyHops        int
 }
@@ -0,0 +1,401 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"server/accounts"
+	"time"
+)
+
+// ErrExportNotFound is returned when the user never asked for an export
+var ErrExportNotFound = newError(ErrNotFound, "export not found")
+
+// DataExport is an archive of the data of a user
+type DataExport struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	BlobKey     string     `json:"-"`
+}
+
+const dataExportColumns = "id, status, error, created_at, completed_at, expires_at, blob_key"
+
+func scanDataExport(row *sql.Row) (DataExport, error) {
+	var e DataExport
+	var completedAt, expiresAt sql.NullTime
+	err := row.Scan(&e.ID, &e.Status, &e.Error, &e.CreatedAt, &completedAt, &expiresAt, &e.BlobKey)
+	if err != nil {
+		return DataExport{}, err
+	}
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	return e, nil
+}
+
+// RequestDataExport 为用户创建一个导出任务, 已经有等待中的任务时返回它
+func (db *DB) RequestDataExport(ctx context.Context, userID int) (_ DataExport, err error) {
+	ctx, end := db.startOp(ctx, "RequestDataExport")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"INSERT INTO data_exports (user_id) VALUES ($1) ON CONFLICT (user_id) WHERE status = 'pending' DO NOTHING",
+		userID,
+	)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	return db.latestDataExport(ctx, userID)
+}
+
+// LatestDataExport 返回用户最近的导出任务
+func (db *DB) LatestDataExport(ctx context.Context, userID int) (_ DataExport, err error) {
+	ctx, end := db.startOp(ctx, "LatestDataExport")
+	defer end(&err)
+
+	return db.latestDataExport(ctx, userID)
+}
+
+func (db *DB) latestDataExport(ctx context.Context, userID int) (DataExport, error) {
+	export, err := scanDataExport(db.DataBase.QueryRowContext(ctx,
+		"SELECT "+dataExportColumns+" FROM data_exports WHERE user_id = $1 ORDER BY id DESC LIMIT 1",
+		userID,
+	))
+	if err == sql.ErrNoRows {
+		return DataExport{}, ErrExportNotFound
+	}
+	return export, err
+}
+
+// ClaimExportJobs 领取等待中的导出任务, lease 期间其他 worker 看不到这些任务
+func (db *DB) ClaimExportJobs(ctx context.Context, now time.Time, limit int, lease time.Duration) (_ []accounts.ExportJob, err error) {
+	ctx, end := db.startOp(ctx, "ClaimExportJobs")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`UPDATE data_exports SET lease_until = $1::timestamp + $3 * INTERVAL '1 millisecond', attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM data_exports
+			WHERE status = 'pending' AND lease_until <= $1
+			ORDER BY id LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, attempts - 1`,
+		now, limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []accounts.ExportJob
+	for rows.Next() {
+		var job accounts.ExportJob
+		if err = rows.Scan(&job.ID, &job.UserID, &job.Attempts); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// CompleteExportJob 导出完成, 在 expiresAt 之前可以下载
+func (db *DB) CompleteExportJob(ctx context.Context, jobID int, key string, expiresAt time.Time) (err error) {
+	ctx, end := db.startOp(ctx, "CompleteExportJob")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"UPDATE data_exports SET status = 'ready', blob_key = $2, completed_at = NOW(), expires_at = $3 WHERE id = $1",
+		jobID, key, expiresAt,
+	)
+	return err
+}
+
+// FailExportJob 导出失败, 不再重试
+func (db *DB) FailExportJob(ctx context.Context, jobID int, msg string) (err error) {
+	ctx, end := db.startOp(ctx, "FailExportJob")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"UPDATE data_exports SET status = 'failed', error = $2, completed_at = NOW() WHERE id = $1",
+		jobID, msg,
+	)
+	return err
+}
+
+// ExpireExports 删除过期的导出, 返回它们的文件
+func (db *DB) ExpireExports(ctx context.Context, now time.Time) (_ []string, err error) {
+	ctx, end := db.startOp(ctx, "ExpireExports")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"DELETE FROM data_exports WHERE expires_at <= $1 RETURNING blob_key",
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanBlobKeys(rows)
+}
+
+// exportedChirp is a chirp in the archive, attachments point into media/
+type exportedChirp struct {
+	ID          int      `json:"id"`
+	Body        string   `json:"body"`
+	Hidden      bool     `json:"hidden"`
+	Deleted     bool     `json:"deleted"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// ExportData 返回用户保存的所有数据, 包括被隐藏的 chirp
+func (db *DB) ExportData(ctx context.Context, userID int) (_ accounts.Data, err error) {
+	ctx, end := db.startOp(ctx, "ExportData")
+	defer end(&err)
+
+	var profile struct {
+		ID            int        `json:"id"`
+		Email         string     `json:"email"`
+		EmailVerified bool       `json:"email_verified"`
+		Handle        string     `json:"handle"`
+		DisplayName   string     `json:"display_name"`
+		Bio           string     `json:"bio"`
+		Avatar        string     `json:"avatar,omitempty"`
+		IsChirpyRed   bool       `json:"is_chirpy_red"`
+		Role          string     `json:"role"`
+		DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	}
+	var sessions struct {
+		RefreshTokenExpiresAt *time.Time `json:"refresh_token_expires_at"`
+		TokensValidAfter      *time.Time `json:"tokens_valid_after"`
+	}
+	var avatarKey string
+	var deletedAt, refreshExpiresAt, tokensValidAfter sql.NullTime
+	err = db.DataBase.QueryRowContext(ctx,
+		`SELECT id, email, email_verified_at IS NOT NULL, handle, display_name, bio, avatar_key, `+chirpyRed+`, role,
+			deleted_at, refresh_token_expire_time, tokens_valid_after
+		FROM users WHERE id = $1`,
+		userID,
+	).Scan(&profile.ID, &profile.Email, &profile.EmailVerified, &profile.Handle, &profile.DisplayName, &profile.Bio,
+		&avatarKey, &profile.IsChirpyRed, &profile.Role, &deletedAt, &refreshExpiresAt, &tokensValidAfter)
+	if err != nil {
+		return accounts.Data{}, err
+	}
+	if deletedAt.Valid {
+		profile.DeletedAt = &deletedAt.Time
+	}
+	if refreshExpiresAt.Valid {
+		sessions.RefreshTokenExpiresAt = &refreshExpiresAt.Time
+	}
+	if tokensValidAfter.Valid {
+		sessions.TokensValidAfter = &tokensValidAfter.Time
+	}
+
+	var media []string
+	if avatarKey != "" {
+		profile.Avatar = path.Join("media", avatarKey)
+		media = append(media, avatarKey)
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, body, hidden_at IS NOT NULL, deleted_at IS NOT NULL FROM chirps WHERE author_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return accounts.Data{}, err
+	}
+	var chirps []Chirp
+	hidden := make(map[int]bool)
+	deleted := make(map[int]bool)
+	for rows.Next() {
+		var chirp Chirp
+		var isHidden, isDeleted bool
+		if err = rows.Scan(&chirp.ID, &chirp.Body, &isHidden, &isDeleted); err != nil {
+			rows.Close()
+			return accounts.Data{}, err
+		}
+		hidden[chirp.ID] = isHidden
+		deleted[chirp.ID] = isDeleted
+		chirps = append(chirps, chirp)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return accounts.Data{}, err
+	}
+	if err = db.loadAttachments(ctx, chirps); err != nil {
+		return accounts.Data{}, err
+	}
+
+	exported := []exportedChirp{}
+	for _, chirp := range chirps {
+		e := exportedChirp{ID: chirp.ID, Body: chirp.Body, Hidden: hidden[chirp.ID], Deleted: deleted[chirp.ID]}
+		for _, a := range chirp.Attachments {
+			e.Attachments = append(e.Attachments, path.Join("media", a.Key))
+			media = append(media, a.Key)
+		}
+		exported = append(exported, e)
+	}
+
+	rows, err = db.DataBase.QueryContext(ctx,
+		"SELECT u.handle FROM follows f JOIN users u ON u.id = f.followed_id WHERE f.follower_id = $1 ORDER BY f.created_at",
+		userID,
+	)
+	if err != nil {
+		return accounts.Data{}, err
+	}
+	following := []string{}
+	for rows.Next() {
+		var handle string
+		if err = rows.Scan(&handle); err != nil {
+			rows.Close()
+			return accounts.Data{}, err
+		}
+		following = append(following, handle)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return accounts.Data{}, err
+	}
+
+	drafts, err := db.GetDrafts(ctx, userID, "")
+	if err != nil {
+		return accounts.Data{}, err
+	}
+
+	return accounts.Data{
+		Documents: map[string]interface{}{
+			"profile.json":   profile,
+			"chirps.json":    exported,
+			"drafts.json":    drafts,
+			"following.json": following,
+			"sessions.json":  sessions,
+		},
+		Media: media,
+	}, nil
+}
+
+// DeleteAccount 删除账号: 账号立即不可见并退出所有会话, deleteAfter 之后被彻底删除.
+// 在这之前登录会取消删除.
+func (db *DB) DeleteAccount(ctx context.Context, userID int, deleteAfter time.Time) (err error) {
+	ctx, end := db.startOp(ctx, "DeleteAccount")
+	defer end(&err)
+
+	// 和 jwt 的签发时间用同一个时钟, jwt 的时间精确到秒
+	var id int
+	err = db.DataBase.QueryRowContext(ctx,
+		`UPDATE users SET deleted_at = NOW(), delete_after = $2,
+			refresh_token = NULL, refresh_token_expire_time = NULL, tokens_valid_after = $3
+		WHERE id = $1 RETURNING id`,
+		userID, deleteAfter, time.Now().Truncate(time.Second),
+	).Scan(&id)
+	return err
+}
+
+// PurgeDeletedUsers 彻底删除宽限期已过的账号, 一个账号一个事务.
+// 返回删除的账号数和不再使用的文件.
+func (db *DB) PurgeDeletedUsers(ctx context.Context, now time.Time, limit int) (_ int, _ []string, err error) {
+	ctx, end := db.startOp(ctx, "PurgeDeletedUsers")
+	defer end(&err)
+
+	var keys []string
+	for n := 0; n < limit; n++ {
+		purged, err := db.purgeDeletedUser(ctx, now)
+		if err != nil {
+			return n, keys, err
+		}
+		if purged == nil {
+			return n, keys, nil
+		}
+		keys = append(keys, purged...)
+	}
+	return limit, keys, nil
+}
+
+// purgeDeletedUser deletes one account whose grace period is over and returns its blob keys,
+// nil when there is nothing to purge
+func (db *DB) purgeDeletedUser(ctx context.Context, now time.Time) ([]string, error) {
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var avatarKey string
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, avatar_key FROM users WHERE delete_after <= $1
+		ORDER BY delete_after LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		now,
+	).Scan(&userID, &avatarKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	if avatarKey != "" {
+		keys = append(keys, avatarKey)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT a.blob_key FROM chirp_attachments a JOIN chirps c ON c.id = a.chirp_id WHERE c.author_id = $1
+		UNION ALL
+		SELECT blob_key FROM data_exports WHERE user_id = $1 AND blob_key <> ''`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	blobKeys, err := scanBlobKeys(rows)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, blobKeys...)
+
+	statements := []string{
+		// messages stay in the conversations of the other members without their sender
+		"UPDATE messages SET sender_id = NULL WHERE sender_id = $1",
+		// reports have no foreign key to the chirps
+		"DELETE FROM chirp_reports WHERE chirp_id IN (SELECT id FROM chirps WHERE author_id = $1)",
+		// attachments and flags are deleted with the chirps
+		"DELETE FROM chirps WHERE author_id = $1",
+		// tokens are columns of users, the other rows of the user are deleted by the foreign keys
+		"DELETE FROM users WHERE id = $1",
+	}
+	for _, statement := range statements {
+		if _, err = tx.ExecContext(ctx, statement, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// scanBlobKeys reads a single column of blob keys and closes rows
+func scanBlobKeys(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"github.com/lib/pq"
+)
+
+// Attachment is a file uploaded with a chirp, the blob itself lives in a storage.BlobStore
+type Attachment struct {
+	ID          int    `json:"id"`
+	Key         string `json:"-"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	// Variants maps variant names (thumbnail, medium, original) to their urls
+	Variants map[string]string `json:"variants,omitempty"`
+}
+
+// loadAttachments 查询并填充 chirps 的附件
+func (db *DB) loadAttachments(ctx context.Context, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int, len(chirps))
+	ids := make([]int, len(chirps))
+	for i, chirp := range chirps {
+		index[chirp.ID] = i
+		ids[i] = chirp.ID
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, chirp_id, blob_key, content_type, size, width, height FROM chirp_attachments WHERE chirp_id = ANY($1) ORDER BY id",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		var chirpID int
+		err = rows.Scan(&a.ID, &chirpID, &a.Key, &a.ContentType, &a.Size, &a.Width, &a.Height)
+		if err != nil {
+			return err
+		}
+		chirp := &chirps[index[chirpID]]
+		chirp.Attachments = append(chirp.Attachments, a)
+	}
+
+	return rows.Err()
+}
+
+// BlobVisible 检查 blob key 是否属于一个没有被删除或隐藏的 chirp 的附件, 或者一个没有注销的用户的头像
+func (db *DB) BlobVisible(ctx context.Context, key string) (_ bool, err error) {
+	ctx, end := db.startOp(ctx, "BlobVisible")
+	defer end(&err)
+
+	var exists bool
+	err = db.DataBase.QueryRowContext(ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM chirp_attachments a JOIN chirps c ON c.id = a.chirp_id
+			WHERE a.blob_key = $1 AND c.deleted_at IS NULL AND c.hidden_at IS NULL
+		) OR EXISTS (
+			SELECT 1 FROM users WHERE avatar_key = $1 AND deleted_at IS NULL
+		)`,
+		key,
+	).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"server/audit"
+	"strings"
+	"time"
+)
+
+// AuditFilter selects entries of the audit log, zero fields match everything
+type AuditFilter struct {
+	ActorID    *int
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	Since      time.Time
+	Until      time.Time
+	// BeforeID pages backwards through the log
+	BeforeID int64
+	// Limit is the maximum number of entries, 0 returns every entry
+	Limit int
+}
+
+const auditColumns = "id, created_at, action, actor_id, target_type, target_id, ip, user_agent, outcome, details, prev_hash, hash"
+
+// AppendAudit 在审计日志末尾追加一条记录, 记录的 hash 链接到上一条记录.
+// 追加是串行的, 链不会分叉.
+func (db *DB) AppendAudit(ctx context.Context, e audit.Entry) (_ audit.Entry, err error) {
+	ctx, end := db.startOp(ctx, "AppendAudit")
+	defer end(&err)
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// TIMESTAMP 没有时区并且精确到微秒, 保存的时间和计算 hash 的时间必须一致
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+	if e.Details == nil {
+		details = []byte("{}")
+	}
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('audit_log'))")
+	if err != nil {
+		return audit.Entry{}, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return audit.Entry{}, err
+	}
+	e.Hash = e.ComputeHash()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO audit_log (created_at, action, actor_id, target_type, target_id, ip, user_agent, outcome, details, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		e.Time, e.Action, e.ActorID, e.TargetType, e.TargetID, e.IP, e.UserAgent, e.Outcome, details, e.PrevHash, e.Hash,
+	).Scan(&e.ID)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+
+	return e, tx.Commit()
+}
+
+// GetAuditEntries 返回符合条件的记录, 最新的在前
+func (db *DB) GetAuditEntries(ctx context.Context, f AuditFilter) (_ []audit.Entry, err error) {
+	ctx, end := db.startOp(ctx, "GetAuditEntries")
+	defer end(&err)
+
+	entries := []audit.Entry{}
+	err = db.eachAuditEntry(ctx, f, func(e audit.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExportAuditEntries 按顺序把符合条件的记录交给 fn, 最新的在前, 不会把整个日志读进内存
+func (db *DB) ExportAuditEntries(ctx context.Context, f AuditFilter, fn func(audit.Entry) error) (err error) {
+	ctx, end := db.startOp(ctx, "ExportAuditEntries")
+	defer end(&err)
+
+	return db.eachAuditEntry(ctx, f, fn)
+}
+
+func (db *DB) eachAuditEntry(ctx context.Context, f AuditFilter, fn func(audit.Entry) error) error {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.ActorID != nil {
+		add("actor_id = $%d", *f.ActorID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if f.Outcome != "" {
+		add("outcome = $%d", f.Outcome)
+	}
+	// created_at is saved in UTC
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until.UTC())
+	}
+	if f.BeforeID > 0 {
+		add("id < $%d", f.BeforeID)
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanAuditEntry(rows *sql.Rows) (audit.Entry, error) {
+	var e audit.Entry
+	var actorID sql.NullInt64
+	var details []byte
+	err := rows.Scan(&e.ID, &e.Time, &e.Action, &actorID, &e.TargetType, &e.TargetID,
+		&e.IP, &e.UserAgent, &e.Outcome, &details, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+	e.Time = e.Time.UTC()
+	e.ActorID = nullIntPtr(actorID)
+	if err = json.Unmarshal(details, &e.Details); err != nil {
+		return audit.Entry{}, err
+	}
+	if len(e.Details) == 0 {
+		e.Details = nil
+	}
+	return e, nil
+}
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	Valid   bool `json:"valid"`
+	Entries int  `json:"entries"`
+	// BrokenAt is the id of the first entry that was changed or doesn't follow the entry before it
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+// VerifyAuditLog 从头检查审计日志的 hash 链
+func (db *DB) VerifyAuditLog(ctx context.Context) (_ AuditVerification, err error) {
+	ctx, end := db.startOp(ctx, "VerifyAuditLog")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx, "SELECT "+auditColumns+" FROM audit_log ORDER BY id")
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	defer rows.Close()
+
+	result := AuditVerification{Valid: true}
+	prev := ""
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		result.Entries++
+		if !e.Follows(prev) {
+			return AuditVerification{Valid: false, Entries: result.Entries, BrokenAt: e.ID}, nil
+		}
+		prev = e.Hash
+	}
+	return result, rows.Err()
+}
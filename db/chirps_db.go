@@ -1,15 +1,37 @@
 package db
 
-import "fmt"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrChirpDeleted is returned when the chirp was deleted and isn't purged yet
+	ErrChirpDeleted = newError(ErrGone, "chirp was deleted")
+	// ErrChirpNotDeleted is returned when restoring a chirp that isn't deleted
+	ErrChirpNotDeleted = newError(ErrConflict, "chirp is not deleted")
+	// ErrUndoExpired is returned when the author restores a chirp after the undo window
+	ErrUndoExpired = newError(ErrForbidden, "the chirp can no longer be restored")
+)
 
 type Chirp struct {
-	ID     int    `json:"id"`
-	Body   string `json:"body"`
-	AuthID int    `json:"author_id"`
+	ID          int          `json:"id"`
+	Body        string       `json:"body"`
+	AuthID      int          `json:"author_id"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Author is only loaded by LoadAuthors
+	Author *Author `json:"author,omitempty"`
 }
 
 // GetChirpsByAuthorID returns all chirps by author id
-func (db *DB) GetChirpsByAuthorID(userID int, sort string) ([]Chirp, error) {
+func (db *DB) GetChirpsByAuthorID(ctx context.Context, userID int, sort string) (_ []Chirp, err error) {
+	ctx, end := db.startOp(ctx, "GetChirpsByAuthorID")
+	defer end(&err)
+
 	if sort == "desc" {
 		sort = "DESC"
 	} else {
@@ -19,8 +41,8 @@ func (db *DB) GetChirpsByAuthorID(userID int, sort string) ([]Chirp, error) {
 	var chirps []Chirp
 
 	// 执行查询 并以Continue sorting the chirps by id in "sort" order.
-	rows, err := db.DataBase.Query(
-		"SELECT id, body, author_id FROM chirps WHERE author_id = $1 ORDER BY id "+sort,
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, body, author_id FROM chirps WHERE author_id = $1 AND hidden_at IS NULL AND deleted_at IS NULL AND "+visibleChirp+" ORDER BY id "+sort,
 		userID,
 	)
 
@@ -44,14 +66,26 @@ func (db *DB) GetChirpsByAuthorID(userID int, sort string) ([]Chirp, error) {
 		return nil, err
 	}
 
+	// 查询附件
+	if err = db.loadAttachments(ctx, chirps); err != nil {
+		return nil, err
+	}
+
 	return chirps, nil
 
 }
 
-// DeleteChirpByID deletes a single chirp by id
-func (db *DB) DeleteChirpByID(id int, userID int) error {
+// DeleteChirpByID soft deletes a single chirp by id, the author can restore it during the undo window.
+// The row and its attachments are removed by PurgeDeletedChirps after the retention period.
+func (db *DB) DeleteChirpByID(ctx context.Context, id int, userID int) (err error) {
+	ctx, end := db.startOp(ctx, "DeleteChirpByID")
+	defer end(&err)
+
 	// 执行删除
-	result, err := db.DataBase.Exec("DELETE FROM chirps WHERE id = $1 AND author_id = $2", id, userID)
+	result, err := db.DataBase.ExecContext(ctx,
+		"UPDATE chirps SET deleted_at = NOW(), deleted_by = $2 WHERE id = $1 AND author_id = $2 AND deleted_at IS NULL",
+		id, userID,
+	)
 	if err != nil {
 		return err
 	}
@@ -62,18 +96,164 @@ func (db *DB) DeleteChirpByID(id int, userID int) error {
 		return err
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("no chirp found with id %d for user %d", id, userID)
+		return fmt.Errorf("%w: no chirp found with id %d for user %d", ErrNotFound, id, userID)
 	}
 
 	return nil
 }
 
+// UndoDeleteChirp restores a chirp that its author deleted less than window ago,
+// visible is false when the chirp is still hidden by moderation or by a suspension
+func (db *DB) UndoDeleteChirp(ctx context.Context, id int, userID int, window time.Duration) (_ Chirp, visible bool, err error) {
+	ctx, end := db.startOp(ctx, "UndoDeleteChirp")
+	defer end(&err)
+
+	return db.restoreChirp(ctx, id, userID, window)
+}
+
+// RestoreChirp restores any deleted chirp that wasn't purged yet, it is meant for admins.
+// visible is false when the chirp is still hidden by moderation or by a suspension
+func (db *DB) RestoreChirp(ctx context.Context, id int) (_ Chirp, visible bool, err error) {
+	ctx, end := db.startOp(ctx, "RestoreChirp")
+	defer end(&err)
+
+	return db.restoreChirp(ctx, id, 0, 0)
+}
+
+// restoreChirp clears the deletion of a chirp. When userID isn't 0 the chirp must be theirs
+// and must have been deleted less than window ago.
+func (db *DB) restoreChirp(ctx context.Context, id int, userID int, window time.Duration) (Chirp, bool, error) {
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Chirp{}, false, err
+	}
+	defer tx.Rollback()
+
+	// 用数据库的时钟判断撤销期限, 和 deleted_at 一致
+	var authorID int
+	var deletedBy sql.NullInt64
+	var deleted, inWindow bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT author_id, deleted_by, deleted_at IS NOT NULL, COALESCE(deleted_at > NOW() - $2 * INTERVAL '1 millisecond', false)
+		FROM chirps WHERE id = $1 FOR UPDATE`,
+		id, window.Milliseconds(),
+	).Scan(&authorID, &deletedBy, &deleted, &inWindow)
+	if err == sql.ErrNoRows || (err == nil && userID != 0 && authorID != userID) {
+		return Chirp{}, false, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, false, err
+	}
+	if !deleted {
+		return Chirp{}, false, ErrChirpNotDeleted
+	}
+	// chirps removed by a moderator can only be restored by an admin
+	if userID != 0 && (!inWindow || deletedBy.Int64 != int64(userID)) {
+		return Chirp{}, false, ErrUndoExpired
+	}
+
+	// a restored chirp can still be hidden by the reports or by a suspension of its author
+	var chirp Chirp
+	var visible bool
+	err = tx.QueryRowContext(ctx,
+		"UPDATE chirps SET deleted_at = NULL, deleted_by = NULL WHERE id = $1 RETURNING id, body, author_id, hidden_at IS NULL AND "+visibleChirp,
+		id,
+	).Scan(&chirp.ID, &chirp.Body, &chirp.AuthID, &visible)
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Chirp{}, false, err
+	}
+
+	chirps := []Chirp{chirp}
+	if err = db.loadAttachments(ctx, chirps); err != nil {
+		return Chirp{}, false, err
+	}
+	return chirps[0], visible, nil
+}
+
+// PurgeDeletedChirps hard deletes up to limit chirps deleted before the cutoff together with
+// their attachments, and returns the blob keys of the attachments.
+// Chirps with open reports are kept until a moderator resolves them, resolved reports are
+// kept as evidence of the moderation.
+func (db *DB) PurgeDeletedChirps(ctx context.Context, before time.Time, limit int) (_ int, _ []string, err error) {
+	ctx, end := db.startOp(ctx, "PurgeDeletedChirps")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id FROM chirps c WHERE deleted_at <= $1
+		AND NOT EXISTS (SELECT 1 FROM chirp_reports r WHERE r.chirp_id = c.id AND r.status = $3)
+		ORDER BY deleted_at LIMIT $2 FOR UPDATE SKIP LOCKED`,
+		before, limit, ReportOpen,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	rows, err = tx.QueryContext(ctx, "DELETE FROM chirp_attachments WHERE chirp_id = ANY($1) RETURNING blob_key", pq.Array(ids))
+	if err != nil {
+		return 0, nil, err
+	}
+	keys, err := scanBlobKeys(rows)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM chirps WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return len(ids), keys, nil
+}
+
 // CreateChirp creates a new chirp and saves it to database
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
+func (db *DB) CreateChirp(ctx context.Context, body string, userID int) (Chirp, error) {
+	return db.CreateChirpWithAttachments(ctx, body, userID, nil)
+}
+
+// CreateChirpWithAttachments creates a new chirp together with its attachments
+// the blobs must already be stored
+func (db *DB) CreateChirpWithAttachments(ctx context.Context, body string, userID int, attachments []Attachment) (_ Chirp, err error) {
+	ctx, end := db.startOp(ctx, "CreateChirpWithAttachments")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
 
 	// 插入chirp到数据库
 	var chirp Chirp
-	err := db.DataBase.QueryRow(
+	err = tx.QueryRowContext(ctx,
 		// "INSERT INTO chirps (body) VALUES ($1) RETURNING id, body",
 		"INSERT INTO chirps (body, author_id) VALUES ($1, $2) RETURNING id, body, author_id",
 		body, userID,
@@ -81,30 +261,60 @@ func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
 	if err != nil {
 		return Chirp{}, err
 	}
+
+	for _, a := range attachments {
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO chirp_attachments (chirp_id, blob_key, content_type, size, width, height) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			chirp.ID, a.Key, a.ContentType, a.Size, a.Width, a.Height,
+		).Scan(&a.ID)
+		if err != nil {
+			return Chirp{}, err
+		}
+		chirp.Attachments = append(chirp.Attachments, a)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
 	return chirp, nil
 
 }
 
-// GetChirpByID returns a single chirp by id
-func (db *DB) GetChirpByID(id int) (Chirp, error) {
+// GetChirpByID returns a single chirp by id, ErrChirpDeleted when it was deleted but not purged yet
+func (db *DB) GetChirpByID(ctx context.Context, id int) (_ Chirp, err error) {
+	ctx, end := db.startOp(ctx, "GetChirpByID")
+	defer end(&err)
 
 	var chirp Chirp
+	var deleted bool
 
 	// 执行查询
-	err := db.DataBase.QueryRow(
-		"SELECT id, body, author_id FROM chirps WHERE id = $1",
+	err = db.DataBase.QueryRowContext(ctx,
+		"SELECT id, body, author_id, deleted_at IS NOT NULL FROM chirps WHERE id = $1 AND hidden_at IS NULL AND "+visibleChirp,
 		id,
-	).Scan(&chirp.ID, &chirp.Body, &chirp.AuthID)
+	).Scan(&chirp.ID, &chirp.Body, &chirp.AuthID, &deleted)
 	if err != nil {
 		return Chirp{}, err
 	}
+	if deleted {
+		return Chirp{}, ErrChirpDeleted
+	}
 
-	return chirp, nil
+	// 查询附件
+	chirps := []Chirp{chirp}
+	if err = db.loadAttachments(ctx, chirps); err != nil {
+		return Chirp{}, err
+	}
+
+	return chirps[0], nil
 
 }
 
 // GetChirps returns all chirps in the database
-func (db *DB) GetChirps(sort string) ([]Chirp, error) {
+func (db *DB) GetChirps(ctx context.Context, sort string) (_ []Chirp, err error) {
+	ctx, end := db.startOp(ctx, "GetChirps")
+	defer end(&err)
 
 	if sort == "desc" {
 		sort = "DESC"
@@ -115,8 +325,8 @@ func (db *DB) GetChirps(sort string) ([]Chirp, error) {
 	var chirps []Chirp
 
 	// 执行查询 并以Continue sorting the chirps by id in "sort" order.
-	rows, err := db.DataBase.Query(
-		"SELECT id, body, author_id FROM chirps ORDER BY id "+sort,
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, body, author_id FROM chirps WHERE hidden_at IS NULL AND deleted_at IS NULL AND "+visibleChirp+" ORDER BY id "+sort,
 	)
 	if err != nil {
 		return nil, err
@@ -138,6 +348,23 @@ func (db *DB) GetChirps(sort string) ([]Chirp, error) {
 		return nil, err
 	}
 
+	// 查询附件
+	if err = db.loadAttachments(ctx, chirps); err != nil {
+		return nil, err
+	}
+
 	return chirps, nil
 
 }
+
+// FlagChirp records the moderation rules that flagged a chirp for review
+func (db *DB) FlagChirp(ctx context.Context, chirpID int, rules []string) (err error) {
+	ctx, end := db.startOp(ctx, "FlagChirp")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"INSERT INTO chirp_flags (chirp_id, rule) SELECT $1, unnest($2::TEXT[]) ON CONFLICT DO NOTHING",
+		chirpID, pq.Array(rules),
+	)
+	return err
+}
@@ -2,7 +2,8 @@ package db
 
 import (
 	"database/sql"
-	"fmt"
+	"log/slog"
+	"time"
 
 	_ "github.com/lib/pq" // 导入 pq 包
 )
@@ -10,6 +11,12 @@ import (
 type DB struct {
 	path     string
 	DataBase *sql.DB
+	// Timeouts 是每个操作的超时时间
+	Timeouts Timeouts
+	// ObserveBcrypt 可选, 记录每次 bcrypt 操作 ("hash" 或 "compare") 的耗时
+	ObserveBcrypt func(op string, d time.Duration)
+	// ObserveCanceled 可选, 记录超时 ("timeout") 或被取消 ("canceled") 的操作
+	ObserveCanceled func(operation string, reason string)
 }
 
 // NewDB creates a new database connection
@@ -45,7 +52,8 @@ func (db *DB) ensureDB() error {
 	if err != nil {
 		return err
 	}
-	fmt.Println("Successfully connected to the database!")
+	slog.Info("connected to the database")
 
-	return nil
+	// 创建服务器需要的表
+	return db.migrate()
 }
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"server/scheduler"
+	"time"
+)
+
+var (
+	// ErrDraftNotFound is returned for drafts that don't exist or belong to another user
+	ErrDraftNotFound = newError(ErrNotFound, "draft not found")
+	// ErrDraftChanged is returned when a draft was edited, deleted or published since it was read
+	ErrDraftChanged = newError(ErrConflict, "draft was changed, reload it and try again")
+)
+
+// draft statuses
+const (
+	DraftStatusDraft     = "draft"
+	DraftStatusScheduled = "scheduled"
+)
+
+// Draft is an unpublished chirp, drafts with PublishAt are published by the scheduler
+type Draft struct {
+	ID        int        `json:"id"`
+	AuthorID  int        `json:"author_id"`
+	Body      string     `json:"body"`
+	Status    string     `json:"status"`
+	PublishAt *time.Time `json:"publish_at"`
+	// Error is why the chirp wasn't published at its scheduled time
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version changes with every edit
+	Version int `json:"-"`
+}
+
+// DraftUpdate lists the fields of a draft to change, nil fields are kept
+type DraftUpdate struct {
+	Body      *string
+	PublishAt *time.Time
+	// Unschedule turns a scheduled chirp back into a draft
+	Unschedule bool
+}
+
+const draftColumns = "id, author_id, body, publish_at, error, created_at, updated_at, version"
+
+func scanDraft(row interface{ Scan(...interface{}) error }) (Draft, error) {
+	var d Draft
+	var publishAt sql.NullTime
+	err := row.Scan(&d.ID, &d.AuthorID, &d.Body, &publishAt, &d.Error, &d.CreatedAt, &d.UpdatedAt, &d.Version)
+	if err != nil {
+		return Draft{}, err
+	}
+	d.Status = DraftStatusDraft
+	if publishAt.Valid {
+		t := publishAt.Time.UTC()
+		d.PublishAt = &t
+		d.Status = DraftStatusScheduled
+	}
+	return d, nil
+}
+
+// utcTime converts t to UTC for the TIMESTAMP columns of the drafts, nil stays nil
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// CreateDraft 保存草稿, publishAt 不为 nil 时到时间自动发布
+func (db *DB) CreateDraft(ctx context.Context, authorID int, body string, publishAt *time.Time) (_ Draft, err error) {
+	ctx, end := db.startOp(ctx, "CreateDraft")
+	defer end(&err)
+
+	row := db.DataBase.QueryRowContext(ctx,
+		"INSERT INTO chirp_drafts (author_id, body, publish_at) VALUES ($1, $2, $3) RETURNING "+draftColumns,
+		authorID, body, utcTime(publishAt),
+	)
+	return scanDraft(row)
+}
+
+// GetDrafts 返回用户的草稿和定时 chirp, status 为空时返回全部
+func (db *DB) GetDrafts(ctx context.Context, authorID int, status string) (_ []Draft, err error) {
+	ctx, end := db.startOp(ctx, "GetDrafts")
+	defer end(&err)
+
+	query := "SELECT " + draftColumns + " FROM chirp_drafts WHERE author_id = $1"
+	switch status {
+	case DraftStatusDraft:
+		query += " AND publish_at IS NULL ORDER BY id DESC"
+	case DraftStatusScheduled:
+		query += " AND publish_at IS NOT NULL ORDER BY publish_at, id"
+	default:
+		query += " ORDER BY id DESC"
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx, query, authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := []Draft{}
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, rows.Err()
+}
+
+// GetDraft 返回用户的一个草稿
+func (db *DB) GetDraft(ctx context.Context, id int, authorID int) (_ Draft, err error) {
+	ctx, end := db.startOp(ctx, "GetDraft")
+	defer end(&err)
+
+	row := db.DataBase.QueryRowContext(ctx,
+		"SELECT "+draftColumns+" FROM chirp_drafts WHERE id = $1 AND author_id = $2",
+		id, authorID,
+	)
+	d, err := scanDraft(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Draft{}, ErrDraftNotFound
+	}
+	return d, err
+}
+
+// UpdateDraft 修改 version 版本的草稿, 草稿在这之后被修改或发布时返回 ErrDraftChanged.
+// 修改后的定时 chirp 重新排队, 之前领取它的调度器不会再发布旧的版本.
+func (db *DB) UpdateDraft(ctx context.Context, id int, authorID int, version int, update DraftUpdate) (_ Draft, err error) {
+	ctx, end := db.startOp(ctx, "UpdateDraft")
+	defer end(&err)
+
+	row := db.DataBase.QueryRowContext(ctx,
+		`UPDATE chirp_drafts SET
+			body = COALESCE($4::text, body),
+			publish_at = CASE WHEN $6 THEN NULL ELSE COALESCE($5::timestamp, publish_at) END,
+			error = CASE WHEN $5::timestamp IS NULL THEN error ELSE '' END,
+			claimed_until = NULL,
+			version = version + 1,
+			updated_at = NOW()
+		WHERE id = $1 AND author_id = $2 AND version = $3
+		RETURNING `+draftColumns,
+		id, authorID, version, update.Body, utcTime(update.PublishAt), update.Unschedule,
+	)
+	d, err := scanDraft(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Draft{}, db.draftMissing(ctx, id, authorID)
+	}
+	return d, err
+}
+
+// DeleteDraft 删除草稿, 定时 chirp 删除后不会再发布
+func (db *DB) DeleteDraft(ctx context.Context, id int, authorID int) (err error) {
+	ctx, end := db.startOp(ctx, "DeleteDraft")
+	defer end(&err)
+
+	res, err := db.DataBase.ExecContext(ctx, "DELETE FROM chirp_drafts WHERE id = $1 AND author_id = $2", id, authorID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDraftNotFound
+	}
+	return nil
+}
+
+// PublishDraft 把 version 版本的草稿发布成 chirp, body 是审核后的内容.
+// 删除草稿和创建 chirp 在同一个事务里, 一个草稿最多发布一次.
+func (db *DB) PublishDraft(ctx context.Context, id int, version int, body string) (_ Chirp, err error) {
+	ctx, end := db.startOp(ctx, "PublishDraft")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var authorID int
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM chirp_drafts WHERE id = $1 AND version = $2 RETURNING author_id",
+		id, version,
+	).Scan(&authorID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrDraftChanged
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	var chirp Chirp
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO chirps (body, author_id) VALUES ($1, $2) RETURNING id, body, author_id",
+		body, authorID,
+	).Scan(&chirp.ID, &chirp.Body, &chirp.AuthID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, tx.Commit()
+}
+
+// ClaimDueChirps 领取到时间的定时 chirp, lease 期间其他调度器不会领取它们.
+// 账号被删除的用户的 chirp 不会发布.
+func (db *DB) ClaimDueChirps(ctx context.Context, now time.Time, limit int, lease time.Duration) (_ []scheduler.Item, err error) {
+	ctx, end := db.startOp(ctx, "ClaimDueChirps")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`UPDATE chirp_drafts SET claimed_until = $1::timestamp + $3 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT d.id FROM chirp_drafts d
+			JOIN users u ON u.id = d.author_id
+			WHERE d.publish_at <= $1 AND (d.claimed_until IS NULL OR d.claimed_until <= $1)
+				AND u.deleted_at IS NULL
+			ORDER BY d.publish_at LIMIT $2
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		RETURNING id, author_id, body, version, publish_at`,
+		now.UTC(), limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []scheduler.Item
+	for rows.Next() {
+		var item scheduler.Item
+		err = rows.Scan(&item.ID, &item.AuthorID, &item.Body, &item.Version, &item.PublishAt)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// FailScheduledChirp 把没有发布的定时 chirp 变回草稿并记录原因, 之后修改过的草稿不受影响
+func (db *DB) FailScheduledChirp(ctx context.Context, id int, version int, msg string) (err error) {
+	ctx, end := db.startOp(ctx, "FailScheduledChirp")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		`UPDATE chirp_drafts SET publish_at = NULL, claimed_until = NULL, error = $3,
+			version = version + 1, updated_at = NOW()
+		WHERE id = $1 AND version = $2`,
+		id, version, msg,
+	)
+	return err
+}
+
+// draftMissing tells a draft that doesn't exist from one that changed
+func (db *DB) draftMissing(ctx context.Context, id int, authorID int) error {
+	var exists bool
+	err := db.DataBase.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM chirp_drafts WHERE id = $1 AND author_id = $2)",
+		id, authorID,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrDraftNotFound
+	}
+	return ErrDraftChanged
+}
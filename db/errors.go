@@ -0,0 +1,94 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"server/validation"
+
+	"github.com/lib/pq"
+)
+
+// 错误的类别, handler 用 errors.Is 判断类别并决定状态码.
+// 具体的错误 (例如 ErrChirpNotFound) 都属于其中一个类别.
+var (
+	// ErrNotFound 表示查询没有结果, 仍然可以用 errors.Is(err, sql.ErrNoRows) 判断
+	ErrNotFound = errors.New("not found")
+	// ErrConflict 表示和已有的数据冲突, 例如违反唯一约束
+	ErrConflict = errors.New("already exists")
+	// ErrUnauthorized 表示凭据错误
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden 表示用户没有权限执行这个操作
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalid 表示请求本身不合法
+	ErrInvalid = errors.New("invalid request")
+	// ErrGone 表示数据曾经存在但已经被删除
+	ErrGone = errors.New("gone")
+	// ErrTimeout 表示数据库操作超过了它的超时时间
+	ErrTimeout = errors.New("database operation timed out")
+	// ErrCanceled 表示请求在数据库操作完成前被取消, 通常是客户端断开了连接
+	ErrCanceled = errors.New("database operation canceled")
+)
+
+// ErrInvalidCredentials 邮箱不存在或者密码错误
+var ErrInvalidCredentials = newError(ErrUnauthorized, "incorrect email or password")
+
+// ErrInvalidRefreshToken refresh token 不存在或者已经被废除
+var ErrInvalidRefreshToken = newError(ErrUnauthorized, "invalid refresh token")
+
+// kindError 是一个有自己消息的错误, errors.Is 可以匹配它的类别
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// classifiedError 给驱动返回的错误加上类别.
+// 消息只有类别, 原来的错误 (例如 "sql: no rows in result set") 不会返回给客户端,
+// 但 errors.Is 仍然可以匹配它.
+type classifiedError struct {
+	kind  error
+	cause error
+}
+
+func classify(kind error, cause error) error {
+	return &classifiedError{kind: kind, cause: cause}
+}
+
+func (e *classifiedError) Error() string { return e.kind.Error() }
+
+func (e *classifiedError) Unwrap() []error { return []error{e.kind, e.cause} }
+
+// Cause 返回原来的错误, 用于记录日志
+func (e *classifiedError) Cause() error { return e.cause }
+
+// FieldError 描述一个不合法的字段
+type FieldError = validation.FieldError
+
+// ValidationError 列出请求中所有不合法的字段
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+func (e *ValidationError) Unwrap() error { return ErrInvalid }
+
+// isUniqueViolation 判断是否违反了唯一约束
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,482 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNotConversationMember is returned when the user is not part of the conversation
+	ErrNotConversationMember = newError(ErrNotFound, "not a member of this conversation")
+	// ErrMessagesBlocked is returned when a member refuses messages from the sender
+	ErrMessagesBlocked = newError(ErrForbidden, "user does not accept messages from you")
+	// ErrUnknownMember is returned when a conversation member doesn't exist
+	ErrUnknownMember = newError(ErrInvalid, "user not found")
+	// ErrNoOtherMember is returned when the creator would be alone in the conversation
+	ErrNoOtherMember = newError(ErrInvalid, "a conversation needs another member")
+	// ErrUnknownMessage is returned for read receipts of messages that aren't part of the conversation
+	ErrUnknownMessage = newError(ErrInvalid, "message not found in this conversation")
+)
+
+type Conversation struct {
+	ID          int                  `json:"id"`
+	Members     []ConversationMember `json:"members"`
+	LastMessage *Message             `json:"last_message"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+// ConversationMember carries the read receipt of a member
+type ConversationMember struct {
+	UserID            int `json:"user_id"`
+	LastReadMessageID int `json:"last_read_message_id"`
+}
+
+type Message struct {
+	ID             int `json:"id"`
+	ConversationID int `json:"conversation_id"`
+	// SenderID is nil when the sender deleted their account
+	SenderID  *int      `json:"sender_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateConversation 创建一个会话, 一对一的会话已经存在时直接返回它
+func (db *DB) CreateConversation(ctx context.Context, creatorID int, memberIDs []int) (_ Conversation, err error) {
+	ctx, end := db.startOp(ctx, "CreateConversation")
+	defer end(&err)
+
+	// 去重并加入创建者
+	seen := map[int]bool{creatorID: true}
+	members := []int{creatorID}
+	for _, id := range memberIDs {
+		if !seen[id] {
+			seen[id] = true
+			members = append(members, id)
+		}
+	}
+	if len(members) < 2 {
+		return Conversation{}, ErrNoOtherMember
+	}
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer tx.Rollback()
+
+	// 检查所有成员都存在
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id = ANY($1)", pq.Array(members)).Scan(&count)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if count != len(members) {
+		return Conversation{}, ErrUnknownMember
+	}
+
+	// 检查是否有成员拒绝创建者的消息
+	err = checkNotBlocked(ctx, tx, members, creatorID)
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	var conversationID int
+	if len(members) == 2 {
+		// 锁定这两个成员, 同时创建的一对一会话不会重复
+		first, second := min(members[0], members[1]), max(members[0], members[1])
+		_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('conversation:' || $1::TEXT || ':' || $2::TEXT))", first, second)
+		if err != nil {
+			return Conversation{}, err
+		}
+
+		// 查找已经存在的一对一会话
+		err = tx.QueryRowContext(ctx,
+			`SELECT conversation_id FROM conversation_members
+			GROUP BY conversation_id
+			HAVING COUNT(*) = 2 AND BOOL_AND(user_id = ANY($1))
+			LIMIT 1`,
+			pq.Array(members),
+		).Scan(&conversationID)
+		if err != nil && err != sql.ErrNoRows {
+			return Conversation{}, err
+		}
+	}
+
+	if conversationID == 0 {
+		err = tx.QueryRowContext(ctx, "INSERT INTO conversations DEFAULT VALUES RETURNING id").Scan(&conversationID)
+		if err != nil {
+			return Conversation{}, err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO conversation_members (conversation_id, user_id) SELECT $1, unnest($2::INTEGER[])",
+			conversationID, pq.Array(members),
+		)
+		if err != nil {
+			return Conversation{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	return db.GetConversation(ctx, conversationID, creatorID)
+}
+
+// GetConversation 返回一个会话, 用户必须是会话成员
+func (db *DB) GetConversation(ctx context.Context, conversationID int, userID int) (_ Conversation, err error) {
+	ctx, end := db.startOp(ctx, "GetConversation")
+	defer end(&err)
+
+	conversations, err := db.queryConversations(ctx,
+		"WHERE c.id = $1 AND EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = c.id AND user_id = $2)",
+		conversationID, userID,
+	)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if len(conversations) == 0 {
+		return Conversation{}, ErrNotConversationMember
+	}
+
+	return conversations[0], nil
+}
+
+// GetConversations 返回用户的所有会话以及每个会话的最后一条消息, 最近活跃的在前
+func (db *DB) GetConversations(ctx context.Context, userID int) (_ []Conversation, err error) {
+	ctx, end := db.startOp(ctx, "GetConversations")
+	defer end(&err)
+
+	return db.queryConversations(ctx,
+		"WHERE EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = c.id AND user_id = $1)",
+		userID,
+	)
+}
+
+// queryConversations loads the conversations matching where together with their members
+func (db *DB) queryConversations(ctx context.Context, where string, args ...interface{}) ([]Conversation, error) {
+	rows, err := db.DataBase.QueryContext(ctx,
+		`SELECT c.id, c.created_at, m.id, m.sender_id, m.body, m.created_at
+		FROM conversations c
+		LEFT JOIN LATERAL (
+			SELECT id, sender_id, body, created_at FROM messages
+			WHERE conversation_id = c.id ORDER BY id DESC LIMIT 1
+		) m ON true
+		`+where+`
+		ORDER BY COALESCE(m.created_at, c.created_at) DESC`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	index := make(map[int]int)
+	var ids []int
+
+	for rows.Next() {
+		var c Conversation
+		var msgID, senderID sql.NullInt64
+		var body sql.NullString
+		var sentAt sql.NullTime
+		err = rows.Scan(&c.ID, &c.CreatedAt, &msgID, &senderID, &body, &sentAt)
+		if err != nil {
+			return nil, err
+		}
+		if msgID.Valid {
+			c.LastMessage = &Message{
+				ID:             int(msgID.Int64),
+				ConversationID: c.ID,
+				SenderID:       nullIntPtr(senderID),
+				Body:           body.String,
+				CreatedAt:      sentAt.Time,
+			}
+		}
+		index[c.ID] = len(conversations)
+		ids = append(ids, c.ID)
+		conversations = append(conversations, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return conversations, nil
+	}
+
+	// 查询会话成员以及已读回执
+	memberRows, err := db.DataBase.QueryContext(ctx,
+		"SELECT conversation_id, user_id, last_read_message_id FROM conversation_members WHERE conversation_id = ANY($1) ORDER BY user_id",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer memberRows.Close()
+
+	for memberRows.Next() {
+		var conversationID int
+		var member ConversationMember
+		err = memberRows.Scan(&conversationID, &member.UserID, &member.LastReadMessageID)
+		if err != nil {
+			return nil, err
+		}
+		c := &conversations[index[conversationID]]
+		c.Members = append(c.Members, member)
+	}
+
+	if err = memberRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
+
+// CreateMessage 发送一条消息, 返回消息以及需要通知的其他成员
+func (db *DB) CreateMessage(ctx context.Context, conversationID int, senderID int, body string) (_ Message, _ []int, err error) {
+	ctx, end := db.startOp(ctx, "CreateMessage")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	defer tx.Rollback()
+
+	members, err := conversationMembers(ctx, tx, conversationID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	var recipients []int
+	isMember := false
+	for _, id := range members {
+		if id == senderID {
+			isMember = true
+		} else {
+			recipients = append(recipients, id)
+		}
+	}
+	if !isMember {
+		return Message{}, nil, ErrNotConversationMember
+	}
+
+	err = checkNotBlocked(ctx, tx, recipients, senderID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	var message Message
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO messages (conversation_id, sender_id, body) VALUES ($1, $2, $3) RETURNING id, conversation_id, sender_id, body, created_at",
+		conversationID, senderID, body,
+	).Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.Body, &message.CreatedAt)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	// 发送者已经读过自己的消息
+	_, err = tx.ExecContext(ctx,
+		"UPDATE conversation_members SET last_read_message_id = $1 WHERE conversation_id = $2 AND user_id = $3",
+		message.ID, conversationID, senderID,
+	)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	return message, recipients, nil
+}
+
+// GetMessages 分页返回会话的消息, 从新到旧, beforeID 为 0 时从最新的消息开始
+func (db *DB) GetMessages(ctx context.Context, conversationID int, userID int, beforeID int, limit int) (_ []Message, err error) {
+	ctx, end := db.startOp(ctx, "GetMessages")
+	defer end(&err)
+
+	members, err := conversationMembers(ctx, db.DataBase, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !containsID(members, userID) {
+		return nil, ErrNotConversationMember
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`SELECT id, conversation_id, sender_id, body, created_at FROM messages
+		WHERE conversation_id = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC LIMIT $3`,
+		conversationID, beforeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var message Message
+		err = rows.Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.Body, &message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkConversationRead 更新用户在会话中的已读回执, 已读位置只会前进.
+// messageID 必须是这个会话的消息, 否则返回 ErrUnknownMessage.
+func (db *DB) MarkConversationRead(ctx context.Context, conversationID int, userID int, messageID int) (err error) {
+	ctx, end := db.startOp(ctx, "MarkConversationRead")
+	defer end(&err)
+
+	result, err := db.DataBase.ExecContext(ctx,
+		`UPDATE conversation_members SET last_read_message_id = GREATEST(last_read_message_id, $3)
+		WHERE conversation_id = $1 AND user_id = $2
+			AND EXISTS (SELECT 1 FROM messages WHERE id = $3 AND conversation_id = $1)`,
+		conversationID, userID, messageID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// 检查受影响的行数
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		// 区分不是成员和消息不属于这个会话
+		members, err := conversationMembers(ctx, db.DataBase, conversationID)
+		if err != nil {
+			return err
+		}
+		if !containsID(members, userID) {
+			return ErrNotConversationMember
+		}
+		return ErrUnknownMessage
+	}
+
+	return nil
+}
+
+// BlockUser 拒绝来自 blockedUserID 的消息
+func (db *DB) BlockUser(ctx context.Context, userID int, blockedUserID int) (err error) {
+	ctx, end := db.startOp(ctx, "BlockUser")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"INSERT INTO message_blocks (user_id, blocked_user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, blockedUserID,
+	)
+	return err
+}
+
+// UnblockUser 重新接受来自 blockedUserID 的消息
+func (db *DB) UnblockUser(ctx context.Context, userID int, blockedUserID int) (err error) {
+	ctx, end := db.startOp(ctx, "UnblockUser")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"DELETE FROM message_blocks WHERE user_id = $1 AND blocked_user_id = $2",
+		userID, blockedUserID,
+	)
+	return err
+}
+
+// GetBlockedUsers 返回用户拒绝接收消息的用户id
+func (db *DB) GetBlockedUsers(ctx context.Context, userID int) (_ []int, err error) {
+	ctx, end := db.startOp(ctx, "GetBlockedUsers")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT blocked_user_id FROM message_blocks WHERE user_id = $1 ORDER BY blocked_user_id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conversationMembers returns the user ids of all members of a conversation
+func conversationMembers(ctx context.Context, q queryer, conversationID int) ([]int, error) {
+	rows, err := q.QueryContext(ctx, "SELECT user_id FROM conversation_members WHERE conversation_id = $1", conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// checkNotBlocked returns ErrMessagesBlocked if any of the recipients blocked the sender
+func checkNotBlocked(ctx context.Context, q queryer, recipients []int, senderID int) error {
+	var blocked bool
+	err := q.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM message_blocks WHERE user_id = ANY($1) AND blocked_user_id = $2)",
+		pq.Array(recipients), senderID,
+	).Scan(&blocked)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrMessagesBlocked
+	}
+	return nil
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
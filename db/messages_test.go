@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the database of TEST_DATABASE_URL and skips the test without it.
+// The users and chirps tables must exist, the server creates the others.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := NewDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DataBase.Close() })
+	return db
+}
+
+// createTestUsers creates n users with unique emails
+func createTestUsers(t *testing.T, db *DB, n int) []int {
+	t.Helper()
+	ids := make([]int, n)
+	for i := range ids {
+		email := fmt.Sprintf("test-%d-%d@example.com", time.Now().UnixNano(), i)
+		user, err := db.CreateUser(context.Background(), email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = user.ID
+	}
+	return ids
+}
+
+// lastRead returns the read receipt of userID in the conversation
+func lastRead(t *testing.T, db *DB, conversationID int, userID int) int {
+	t.Helper()
+	conversation, err := db.GetConversation(context.Background(), conversationID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range conversation.Members {
+		if member.UserID == userID {
+			return member.LastReadMessageID
+		}
+	}
+	t.Fatalf("user %d is not a member of conversation %d", userID, conversationID)
+	return 0
+}
+
+func TestMarkConversationRead(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, 3)
+	alice, bob, carol := users[0], users[1], users[2]
+
+	conversation, err := db.CreateConversation(ctx, alice, []int{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateConversation(ctx, alice, []int{carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, err := db.CreateMessage(ctx, conversation.ID, alice, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := db.CreateMessage(ctx, conversation.ID, alice, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, _, err := db.CreateMessage(ctx, other.ID, alice, "elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob has two unread messages
+	if got := lastRead(t, db, conversation.ID, bob); got >= first.ID {
+		t.Fatalf("last read = %d, want bob to have unread messages", got)
+	}
+
+	tests := []struct {
+		name      string
+		userID    int
+		messageID int
+		wantErr   error
+		wantRead  int
+	}{
+		{name: "Read the first message", userID: bob, messageID: first.ID, wantRead: first.ID},
+		{name: "Read everything", userID: bob, messageID: second.ID, wantRead: second.ID},
+		{name: "Receipts don't move back", userID: bob, messageID: first.ID, wantRead: second.ID},
+		{name: "Message of another conversation", userID: bob, messageID: foreign.ID, wantErr: ErrUnknownMessage, wantRead: second.ID},
+		{name: "Message that doesn't exist", userID: bob, messageID: foreign.ID + 1000, wantErr: ErrUnknownMessage, wantRead: second.ID},
+		{name: "Not a member", userID: carol, messageID: second.ID, wantErr: ErrNotConversationMember},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.MarkConversationRead(ctx, conversation.ID, tt.userID, tt.messageID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantRead != 0 {
+				if got := lastRead(t, db, conversation.ID, tt.userID); got != tt.wantRead {
+					t.Errorf("last read = %d, want %d", got, tt.wantRead)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateMessageBlocked(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, 2)
+	alice, bob := users[0], users[1]
+
+	conversation, err := db.CreateConversation(ctx, alice, []int{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.BlockUser(ctx, bob, alice); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.CreateMessage(ctx, conversation.ID, alice, "hello")
+	if !errors.Is(err, ErrMessagesBlocked) {
+		t.Fatalf("error = %v, want %v", err, ErrMessagesBlocked)
+	}
+	// bob can still write to alice
+	if _, _, err = db.CreateMessage(ctx, conversation.ID, bob, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.UnblockUser(ctx, bob, alice); err != nil {
+		t.Fatal(err)
+	}
+	message, recipients, err := db.CreateMessage(ctx, conversation.ID, alice, "hello again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != bob {
+		t.Errorf("recipients = %v, want [%d]", recipients, bob)
+	}
+	// the sender has read their own message, bob hasn't
+	if got := lastRead(t, db, conversation.ID, alice); got != message.ID {
+		t.Errorf("alice last read = %d, want %d", got, message.ID)
+	}
+	if got := lastRead(t, db, conversation.ID, bob); got >= message.ID {
+		t.Errorf("bob last read = %d, want the new message to be unread", got)
+	}
+}
+
+func TestCreateConversationMembers(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, 2)
+	alice, bob := users[0], users[1]
+
+	if _, err := db.CreateConversation(ctx, alice, []int{alice}); !errors.Is(err, ErrNoOtherMember) {
+		t.Errorf("conversation with yourself: error = %v, want %v", err, ErrNoOtherMember)
+	}
+
+	// concurrent requests for the same pair end up in one conversation
+	ids := make(chan int, 2)
+	errs := make(chan error, 2)
+	for _, pair := range [][2]int{{alice, bob}, {bob, alice}} {
+		go func(creator, member int) {
+			conversation, err := db.CreateConversation(ctx, creator, []int{member})
+			ids <- conversation.ID
+			errs <- err
+		}(pair[0], pair[1])
+	}
+	first, second := <-ids, <-ids
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first != second {
+		t.Errorf("conversations = %d and %d, want the same one-to-one conversation", first, second)
+	}
+}
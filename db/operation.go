@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// DefaultTimeout 是没有单独配置的数据库操作的超时时间
+const DefaultTimeout = 5 * time.Second
+
+// Timeouts 配置每个数据库操作的超时时间, 操作名就是 DB 的方法名
+type Timeouts struct {
+	Default    time.Duration
+	Operations map[string]time.Duration
+}
+
+// For 返回操作的超时时间
+func (t Timeouts) For(operation string) time.Duration {
+	if d, ok := t.Operations[operation]; ok {
+		return d
+	}
+	if t.Default > 0 {
+		return t.Default
+	}
+	return DefaultTimeout
+}
+
+// ParseTimeouts 解析 "GetModerationQueue=10s,ClaimDueDeliveries=2s" 格式的超时配置
+func ParseTimeouts(spec string) (map[string]time.Duration, error) {
+	operations := make(map[string]time.Duration)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid timeout %q, want operation=duration", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout for %s: %q", name, value)
+		}
+		operations[strings.TrimSpace(name)] = d
+	}
+	return operations, nil
+}
+
+// startOp 开始一次数据库操作: 创建子 span (只记录操作名, 不记录参数) 并应用超时.
+// 返回的函数必须用 defer end(&err) 调用, 它会区分超时, 取消和没有结果.
+func (db *DB) startOp(ctx context.Context, operation string) (context.Context, func(*error)) {
+	timeout := db.Timeouts.For(operation)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	ctx, span := otel.Tracer("server/db").Start(ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(operation),
+		),
+	)
+
+	return ctx, func(errp *error) {
+		defer cancel()
+		defer span.End()
+
+		err := *errp
+		if err == nil {
+			return
+		}
+
+		switch {
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrConflict), errors.Is(err, ErrUnauthorized),
+			errors.Is(err, ErrForbidden), errors.Is(err, ErrInvalid), errors.Is(err, ErrGone):
+			// expected errors, the span is not marked as failed
+			return
+
+		case errors.Is(err, sql.ErrNoRows):
+			*errp = classify(ErrNotFound, err)
+			return
+
+		case isUniqueViolation(err):
+			*errp = classify(ErrConflict, err)
+			return
+
+		case errors.Is(err, ErrTimeout), errors.Is(err, ErrCanceled):
+			// already classified by a nested operation
+
+		case ctx.Err() == context.DeadlineExceeded:
+			*errp = classify(ErrTimeout, err)
+			db.observeCanceled(operation, "timeout")
+			logging.FromContext(ctx).Warn("database operation timed out", "operation", operation, "timeout", timeout)
+
+		case ctx.Err() == context.Canceled:
+			*errp = classify(ErrCanceled, err)
+			db.observeCanceled(operation, "canceled")
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func (db *DB) observeCanceled(operation string, reason string) {
+	if db.ObserveCanceled != nil {
+		db.ObserveCanceled(operation, reason)
+	}
+}
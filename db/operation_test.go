@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestStartOpClassifiesErrors(t *testing.T) {
+	db := &DB{Timeouts: Timeouts{Default: time.Millisecond}}
+
+	var canceled []string
+	db.ObserveCanceled = func(operation string, reason string) {
+		canceled = append(canceled, operation+":"+reason)
+	}
+
+	tests := []struct {
+		name     string
+		parent   func() context.Context
+		err      func(ctx context.Context) error
+		want     error
+		observed string
+	}{
+		{
+			name:   "Not found",
+			parent: context.Background,
+			err:    func(context.Context) error { return sql.ErrNoRows },
+			want:   ErrNotFound,
+		},
+		{
+			name:   "Unique violation",
+			parent: context.Background,
+			err:    func(context.Context) error { return &pq.Error{Code: "23505", Message: "duplicate key value"} },
+			want:   ErrConflict,
+		},
+		{
+			name:   "Timeout",
+			parent: context.Background,
+			err: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			want:     ErrTimeout,
+			observed: "GetChirps:timeout",
+		},
+		{
+			name: "Canceled by the client",
+			parent: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			err:      func(ctx context.Context) error { return ctx.Err() },
+			want:     ErrCanceled,
+			observed: "GetChirps:canceled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canceled = nil
+
+			ctx, end := db.startOp(tt.parent(), "GetChirps")
+			err := tt.err(ctx)
+			end(&err)
+
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+			if tt.want == ErrNotFound && !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("not found error no longer matches sql.ErrNoRows")
+			}
+			if err.Error() != tt.want.Error() {
+				t.Errorf("message = %q, the driver error should not be exposed", err.Error())
+			}
+			if tt.want != ErrTimeout && errors.Is(err, ErrTimeout) {
+				t.Errorf("error %v is reported as a timeout", err)
+			}
+			if tt.observed == "" && len(canceled) != 0 || tt.observed != "" && (len(canceled) != 1 || canceled[0] != tt.observed) {
+				t.Errorf("observed %v, want %q", canceled, tt.observed)
+			}
+		})
+	}
+}
+
+func TestParseTimeouts(t *testing.T) {
+	got, err := ParseTimeouts("GetModerationQueue=10s, ClaimDueDeliveries=500ms,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeouts := Timeouts{Default: 2 * time.Second, Operations: got}
+	if d := timeouts.For("GetModerationQueue"); d != 10*time.Second {
+		t.Errorf("GetModerationQueue timeout = %v", d)
+	}
+	if d := timeouts.For("ClaimDueDeliveries"); d != 500*time.Millisecond {
+		t.Errorf("ClaimDueDeliveries timeout = %v", d)
+	}
+	if d := timeouts.For("GetChirps"); d != 2*time.Second {
+		t.Errorf("GetChirps timeout = %v, want the default", d)
+	}
+
+	for _, spec := range []string{"GetChirps", "GetChirps=soon", "GetChirps=-1s"} {
+		if _, err := ParseTimeouts(spec); err == nil {
+			t.Errorf("ParseTimeouts(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{ErrChirpNotFound, ErrNotFound},
+		{ErrChirpDeleted, ErrGone},
+		{ErrWebhookNotFound, ErrNotFound},
+		{ErrDeliveryNotRetryable, ErrConflict},
+		{ErrSelfReport, ErrInvalid},
+		{ErrMessagesBlocked, ErrForbidden},
+		{ErrInvalidCredentials, ErrUnauthorized},
+		{&UserSuspendedError{}, ErrForbidden},
+		{&ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.kind) {
+			t.Errorf("%q is not %q", tt.err, tt.kind)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"server/webhooks"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrWebhookNotFound is returned for unknown outbound webhooks
+	ErrWebhookNotFound = newError(ErrNotFound, "webhook not found")
+	// ErrDeliveryNotRetryable is returned when retrying a delivery that isn't dead-lettered
+	ErrDeliveryNotRetryable = newError(ErrConflict, "only dead deliveries can be retried")
+)
+
+// OutboundWebhook is a URL registered by a user to receive events
+type OutboundWebhook struct {
+	ID     int      `json:"id"`
+	UserID int      `json:"user_id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is only returned when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OutboundDelivery is an event queued for a webhook and its attempts
+type OutboundDelivery struct {
+	ID             int               `json:"id"`
+	WebhookID      int               `json:"webhook_id"`
+	Event          string            `json:"event"`
+	Payload        string            `json:"payload"`
+	Status         string            `json:"status"`
+	Attempts       int               `json:"attempts"`
+	NextAttemptAt  *time.Time        `json:"next_attempt_at"`
+	LastStatusCode *int              `json:"last_status_code"`
+	LastError      string            `json:"last_error"`
+	CreatedAt      time.Time         `json:"created_at"`
+	DeliveredAt    *time.Time        `json:"delivered_at"`
+	History        []DeliveryAttempt `json:"history"`
+}
+
+// DeliveryAttempt is a single try of an outbound delivery
+type DeliveryAttempt struct {
+	Attempt     int       `json:"attempt"`
+	StatusCode  *int      `json:"status_code"`
+	Error       string    `json:"error"`
+	DurationMs  float64   `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// CreateOutboundWebhook 注册一个 webhook
+func (db *DB) CreateOutboundWebhook(ctx context.Context, userID int, url string, secret string, events []string) (_ OutboundWebhook, err error) {
+	ctx, end := db.startOp(ctx, "CreateOutboundWebhook")
+	defer end(&err)
+
+	var h OutboundWebhook
+	err = db.DataBase.QueryRowContext(ctx,
+		`INSERT INTO outbound_webhooks (user_id, url, secret, events) VALUES ($1, $2, $3, $4)
+		RETURNING id, user_id, url, events, secret, created_at`,
+		userID, url, secret, pq.Array(events),
+	).Scan(&h.ID, &h.UserID, &h.URL, pq.Array(&h.Events), &h.Secret, &h.CreatedAt)
+	if err != nil {
+		return OutboundWebhook{}, err
+	}
+	return h, nil
+}
+
+// GetOutboundWebhooks 返回用户注册的 webhook
+func (db *DB) GetOutboundWebhooks(ctx context.Context, userID int) (_ []OutboundWebhook, err error) {
+	ctx, end := db.startOp(ctx, "GetOutboundWebhooks")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, user_id, url, events, created_at FROM outbound_webhooks WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []OutboundWebhook{}
+	for rows.Next() {
+		var h OutboundWebhook
+		err = rows.Scan(&h.ID, &h.UserID, &h.URL, pq.Array(&h.Events), &h.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// GetOutboundWebhook 根据 id 返回 webhook
+func (db *DB) GetOutboundWebhook(ctx context.Context, id int) (_ OutboundWebhook, err error) {
+	ctx, end := db.startOp(ctx, "GetOutboundWebhook")
+	defer end(&err)
+
+	var h OutboundWebhook
+	err = db.DataBase.QueryRowContext(ctx,
+		"SELECT id, user_id, url, events, created_at FROM outbound_webhooks WHERE id = $1",
+		id,
+	).Scan(&h.ID, &h.UserID, &h.URL, pq.Array(&h.Events), &h.CreatedAt)
+	if err == sql.ErrNoRows {
+		return OutboundWebhook{}, ErrWebhookNotFound
+	}
+	if err != nil {
+		return OutboundWebhook{}, err
+	}
+	return h, nil
+}
+
+// DeleteOutboundWebhook 删除 webhook 和它的投递记录
+func (db *DB) DeleteOutboundWebhook(ctx context.Context, id int) (err error) {
+	ctx, end := db.startOp(ctx, "DeleteOutboundWebhook")
+	defer end(&err)
+
+	result, err := db.DataBase.ExecContext(ctx, "DELETE FROM outbound_webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnqueueWebhookEvent 为订阅了该事件的 webhook 创建投递.
+// 用户的 webhook 只接收关于自己的事件, 管理员的 webhook 接收所有事件.
+func (db *DB) EnqueueWebhookEvent(ctx context.Context, event string, userID int, payload []byte, traceParent string) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "EnqueueWebhookEvent")
+	defer end(&err)
+
+	result, err := db.DataBase.ExecContext(ctx,
+		`INSERT INTO outbound_deliveries (webhook_id, event, payload, traceparent)
+		SELECT h.id, $1, $3, $4 FROM outbound_webhooks h JOIN users u ON u.id = h.user_id
+		WHERE $1 = ANY(h.events) AND (h.user_id = $2 OR u.role = 'admin')`,
+		event, userID, payload, traceParent,
+	)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return int(rowsAffected), err
+}
+
+// ClaimDueDeliveries 取出到期的投递并在 lease 期间对其他 worker 隐藏
+func (db *DB) ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) (_ []webhooks.Delivery, err error) {
+	ctx, end := db.startOp(ctx, "ClaimDueDeliveries")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`UPDATE outbound_deliveries d SET next_attempt_at = $1::timestamp + $3 * INTERVAL '1 millisecond'
+		FROM outbound_webhooks h
+		WHERE h.id = d.webhook_id AND d.id IN (
+			SELECT id FROM outbound_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, h.url, h.secret, d.event, d.payload, d.attempts, d.traceparent`,
+		now, limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhooks.Delivery
+	for rows.Next() {
+		var d webhooks.Delivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Attempts, &d.TraceParent)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordDeliveryAttempt 保存一次投递尝试并更新投递状态
+func (db *DB) RecordDeliveryAttempt(ctx context.Context, a webhooks.Attempt) (err error) {
+	ctx, end := db.startOp(ctx, "RecordDeliveryAttempt")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var statusCode sql.NullInt64
+	if a.StatusCode != 0 {
+		statusCode = sql.NullInt64{Int64: int64(a.StatusCode), Valid: true}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbound_delivery_attempts (delivery_id, attempt, status_code, error, duration_ms, attempted_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		a.DeliveryID, a.Attempt, statusCode, a.Error, float64(a.Duration.Microseconds())/1000, a.AttemptedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	var deliveredAt sql.NullTime
+	if a.Status == webhooks.StatusDelivered {
+		deliveredAt = sql.NullTime{Time: a.AttemptedAt, Valid: true}
+	}
+	nextAttemptAt := a.NextAttemptAt
+	if a.Status != webhooks.StatusPending {
+		nextAttemptAt = a.AttemptedAt
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE outbound_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6, delivered_at = $7
+		WHERE id = $1`,
+		a.DeliveryID, a.Status, a.Attempt, nextAttemptAt, statusCode, a.Error, deliveredAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetOutboundDeliveries 返回 webhook 最近的投递和每次尝试的结果
+func (db *DB) GetOutboundDeliveries(ctx context.Context, webhookID int, limit int) (_ []OutboundDelivery, err error) {
+	ctx, end := db.startOp(ctx, "GetOutboundDeliveries")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, delivered_at
+		FROM outbound_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2`,
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []OutboundDelivery{}
+	index := make(map[int]int)
+	var ids []int
+	for rows.Next() {
+		var d OutboundDelivery
+		var payload []byte
+		var nextAttemptAt, deliveredAt sql.NullTime
+		var lastStatusCode sql.NullInt64
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &nextAttemptAt,
+			&lastStatusCode, &d.LastError, &d.CreatedAt, &deliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = string(payload)
+		if nextAttemptAt.Valid && d.Status == webhooks.StatusPending {
+			d.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		d.LastStatusCode = nullIntPtr(lastStatusCode)
+		d.History = []DeliveryAttempt{}
+
+		index[d.ID] = len(deliveries)
+		ids = append(ids, d.ID)
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	attempts, err := db.DataBase.QueryContext(ctx,
+		`SELECT delivery_id, attempt, status_code, error, duration_ms, attempted_at
+		FROM outbound_delivery_attempts WHERE delivery_id = ANY($1) ORDER BY id`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer attempts.Close()
+
+	for attempts.Next() {
+		var deliveryID int
+		var a DeliveryAttempt
+		var statusCode sql.NullInt64
+		err = attempts.Scan(&deliveryID, &a.Attempt, &statusCode, &a.Error, &a.DurationMs, &a.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.StatusCode = nullIntPtr(statusCode)
+		i := index[deliveryID]
+		deliveries[i].History = append(deliveries[i].History, a)
+	}
+	return deliveries, attempts.Err()
+}
+
+// RetryOutboundDelivery 重新排队一个进入死信状态的投递
+func (db *DB) RetryOutboundDelivery(ctx context.Context, webhookID int, deliveryID int) (err error) {
+	ctx, end := db.startOp(ctx, "RetryOutboundDelivery")
+	defer end(&err)
+
+	result, err := db.DataBase.ExecContext(ctx,
+		`UPDATE outbound_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND webhook_id = $2 AND status = 'dead'`,
+		deliveryID, webhookID,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrDeliveryNotRetryable
+	}
+	return nil
+}
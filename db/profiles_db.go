@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrProfileNotFound is returned when no user has the handle
+	ErrProfileNotFound = newError(ErrNotFound, "profile not found")
+	// ErrHandleTaken is returned when another user has the handle
+	ErrHandleTaken = newError(ErrConflict, "handle is already in use")
+	// ErrSelfFollow is returned when a user follows themselves
+	ErrSelfFollow = newError(ErrInvalid, "can't follow yourself")
+)
+
+// Author is the public part of a user embedded in chirps.
+// AvatarURL is filled in by the caller from AvatarKey.
+type Author struct {
+	ID          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	AvatarKey   string `json:"-"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// Profile is the public profile of a user, it never contains the email
+type Profile struct {
+	Author
+	Bio            string `json:"bio"`
+	ChirpCount     int    `json:"chirp_count"`
+	FollowerCount  int    `json:"follower_count"`
+	FollowingCount int    `json:"following_count"`
+}
+
+// defaultHandle is the handle of users that didn't pick one,
+// handles of this form are reserved for their user
+func defaultHandle(userID int) string {
+	return "user" + strconv.Itoa(userID)
+}
+
+func isDefaultHandle(handle string) bool {
+	digits, ok := strings.CutPrefix(strings.ToLower(handle), "user")
+	if !ok || digits == "" {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isHandleConflict reports whether err violates the unique index of the handles
+func isHandleConflict(err error) bool {
+	var pqErr *pq.Error
+	return isUniqueViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == "users_handle_key"
+}
+
+// GetProfile returns the profile of a handle, handles are case insensitive.
+// Deleted accounts have no profile.
+// The chirp count leaves out hidden chirps like the chirp listings.
+func (db *DB) GetProfile(ctx context.Context, handle string) (_ Profile, err error) {
+	ctx, end := db.startOp(ctx, "GetProfile")
+	defer end(&err)
+
+	var p Profile
+	err = db.DataBase.QueryRowContext(ctx,
+		`SELECT u.id, u.handle, u.display_name, u.avatar_key, u.bio,
+			(SELECT count(*) FROM chirps WHERE author_id = u.id AND hidden_at IS NULL AND deleted_at IS NULL AND `+visibleChirp+`),
+			(SELECT count(*) FROM follows f JOIN users fu ON fu.id = f.follower_id WHERE f.followed_id = u.id AND fu.deleted_at IS NULL),
+			(SELECT count(*) FROM follows f JOIN users fu ON fu.id = f.followed_id WHERE f.follower_id = u.id AND fu.deleted_at IS NULL)
+		FROM users u WHERE lower(u.handle) = lower($1) AND u.deleted_at IS NULL`,
+		handle,
+	).Scan(&p.ID, &p.Handle, &p.DisplayName, &p.AvatarKey, &p.Bio, &p.ChirpCount, &p.FollowerCount, &p.FollowingCount)
+	if err == sql.ErrNoRows {
+		return Profile{}, ErrProfileNotFound
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+// SetAvatar replaces the avatar of a user, an empty key removes it.
+// It returns the key of the previous avatar so the caller can remove the file.
+func (db *DB) SetAvatar(ctx context.Context, userID int, key string) (_ string, err error) {
+	ctx, end := db.startOp(ctx, "SetAvatar")
+	defer end(&err)
+
+	var oldKey string
+	err = db.DataBase.QueryRowContext(ctx,
+		`UPDATE users SET avatar_key = $2 FROM (SELECT avatar_key FROM users WHERE id = $1 FOR UPDATE) old
+		WHERE id = $1 RETURNING old.avatar_key`,
+		userID, key,
+	).Scan(&oldKey)
+	if err != nil {
+		return "", err
+	}
+	return oldKey, nil
+}
+
+// Follow makes userID follow the user with the handle, following twice is a no-op.
+// It returns the id of the followed user, created is false when userID already followed them.
+func (db *DB) Follow(ctx context.Context, userID int, handle string) (followedID int, created bool, err error) {
+	ctx, end := db.startOp(ctx, "Follow")
+	defer end(&err)
+
+	followedID, err = db.userIDByHandle(ctx, handle)
+	if err != nil {
+		return 0, false, err
+	}
+	if followedID == userID {
+		return 0, false, ErrSelfFollow
+	}
+
+	result, err := db.DataBase.ExecContext(ctx,
+		"INSERT INTO follows (follower_id, followed_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, followedID,
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	return followedID, rowsAffected == 1, nil
+}
+
+// Unfollow stops userID from following the user with the handle
+func (db *DB) Unfollow(ctx context.Context, userID int, handle string) (err error) {
+	ctx, end := db.startOp(ctx, "Unfollow")
+	defer end(&err)
+
+	followedID, err := db.userIDByHandle(ctx, handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DataBase.ExecContext(ctx,
+		"DELETE FROM follows WHERE follower_id = $1 AND followed_id = $2",
+		userID, followedID,
+	)
+	return err
+}
+
+func (db *DB) userIDByHandle(ctx context.Context, handle string) (int, error) {
+	var id int
+	err := db.DataBase.QueryRowContext(ctx, "SELECT id FROM users WHERE lower(handle) = lower($1) AND deleted_at IS NULL", handle).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrProfileNotFound
+	}
+	return id, err
+}
+
+// LoadAuthors sets the Author of the chirps with a single query
+func (db *DB) LoadAuthors(ctx context.Context, chirps []Chirp) (err error) {
+	ctx, end := db.startOp(ctx, "LoadAuthors")
+	defer end(&err)
+
+	if len(chirps) == 0 {
+		return nil
+	}
+
+	var ids []int
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.AuthID)
+	}
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, handle, display_name, avatar_key FROM users WHERE id = ANY($1)",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	authors := make(map[int]*Author)
+	for rows.Next() {
+		var a Author
+		err = rows.Scan(&a.ID, &a.Handle, &a.DisplayName, &a.AvatarKey)
+		if err != nil {
+			return err
+		}
+		authors[a.ID] = &a
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range chirps {
+		chirps[i].Author = authors[chirps[i].AuthID]
+	}
+	return nil
+}
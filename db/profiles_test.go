@@ -0,0 +1,23 @@
+package db
+
+import "testing"
+
+func TestIsDefaultHandle(t *testing.T) {
+	tests := []struct {
+		handle string
+		want   bool
+	}{
+		{handle: "user42", want: true},
+		{handle: "User42", want: true},
+		{handle: "user", want: false},
+		{handle: "user_42", want: false},
+		{handle: "username", want: false},
+		{handle: "jane42", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isDefaultHandle(tt.handle); got != tt.want {
+			t.Errorf("isDefaultHandle(%q) = %v, want %v", tt.handle, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// report statuses
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportActioned  = "actioned"
+)
+
+// moderation actions
+const (
+	ActionAutoHide      = "auto_hide"
+	ActionDismiss       = "dismiss"
+	ActionRemoveChirp   = "remove_chirp"
+	ActionSuspendAuthor = "suspend_author"
+)
+
+var (
+	// ErrChirpNotFound is returned when the chirp doesn't exist or is hidden
+	ErrChirpNotFound = newError(ErrNotFound, "chirp not found")
+	// ErrSelfReport is returned when a user reports their own chirp
+	ErrSelfReport = newError(ErrInvalid, "can't report your own chirp")
+	// ErrNothingToModerate is returned when the chirp has no open reports or flags
+	ErrNothingToModerate = newError(ErrNotFound, "chirp has no open reports")
+	// ErrSuspendSelf is returned when a moderator suspends themselves from the queue
+	ErrSuspendSelf = newError(ErrInvalid, "can't suspend yourself")
+	// ErrSuspendStaff is returned when the author of a reported chirp is a moderator or an admin
+	ErrSuspendStaff = newError(ErrForbidden, "moderators and admins can't be suspended from the moderation queue")
+)
+
+type Report struct {
+	ID         int       `json:"id"`
+	ChirpID    int       `json:"chirp_id"`
+	ReporterID int       `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Details    string    `json:"details"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	// ChirpHidden is true when this report reached the threshold and hid the chirp of AuthorID
+	ChirpHidden bool `json:"-"`
+	AuthorID    int  `json:"-"`
+}
+
+// QueueItem is a chirp waiting for a moderator with its open reports and moderation flags
+type QueueItem struct {
+	Chirp   Chirp    `json:"chirp"`
+	Hidden  bool     `json:"hidden"`
+	Reports []Report `json:"reports"`
+	Flags   []string `json:"flags"`
+}
+
+type ModerationAction struct {
+	ID           int       `json:"id"`
+	ModeratorID  *int      `json:"moderator_id"`
+	Action       string    `json:"action"`
+	ChirpID      *int      `json:"chirp_id"`
+	TargetUserID *int      `json:"target_user_id"`
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ReportChirp 举报一条 chirp, 同一用户重复举报时返回已有的举报且 created 为 false.
+// 未处理的举报数达到 threshold 时自动隐藏该 chirp.
+func (db *DB) ReportChirp(ctx context.Context, chirpID int, reporterID int, reason string, details string, threshold int) (report Report, created bool, err error) {
+	ctx, end := db.startOp(ctx, "ReportChirp")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Report{}, false, err
+	}
+	defer tx.Rollback()
+
+	// 锁定 chirp, 同时到达的举报依次计数, 不会错过隐藏的阈值
+	var authorID int
+	err = tx.QueryRowContext(ctx, "SELECT author_id FROM chirps WHERE id = $1 AND hidden_at IS NULL AND deleted_at IS NULL FOR UPDATE", chirpID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return Report{}, false, ErrChirpNotFound
+	}
+	if err != nil {
+		return Report{}, false, err
+	}
+	if authorID == reporterID {
+		return Report{}, false, ErrSelfReport
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO chirp_reports (chirp_id, reporter_id, reason, details) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (chirp_id, reporter_id) DO NOTHING
+		RETURNING id, chirp_id, reporter_id, reason, details, status, created_at`,
+		chirpID, reporterID, reason, details,
+	).Scan(&report.ID, &report.ChirpID, &report.ReporterID, &report.Reason, &report.Details, &report.Status, &report.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		// 重复举报, 返回已有的举报
+		err = tx.QueryRowContext(ctx,
+			"SELECT id, chirp_id, reporter_id, reason, details, status, created_at FROM chirp_reports WHERE chirp_id = $1 AND reporter_id = $2",
+			chirpID, reporterID,
+		).Scan(&report.ID, &report.ChirpID, &report.ReporterID, &report.Reason, &report.Details, &report.Status, &report.CreatedAt)
+		if err != nil {
+			return Report{}, false, err
+		}
+		return report, false, nil
+	}
+	if err != nil {
+		return Report{}, false, err
+	}
+
+	// 检查是否达到自动隐藏的阈值
+	var openReports int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM chirp_reports WHERE chirp_id = $1 AND status = $2", chirpID, ReportOpen).Scan(&openReports)
+	if err != nil {
+		return Report{}, false, err
+	}
+
+	if threshold > 0 && openReports >= threshold {
+		_, err = tx.ExecContext(ctx, "UPDATE chirps SET hidden_at = NOW() WHERE id = $1", chirpID)
+		if err != nil {
+			return Report{}, false, err
+		}
+		err = recordModerationAction(ctx, tx, nil, ActionAutoHide, &chirpID, &authorID, fmt.Sprintf("%d open reports", openReports))
+		if err != nil {
+			return Report{}, false, err
+		}
+		report.ChirpHidden = true
+	}
+	report.AuthorID = authorID
+
+	return report, true, tx.Commit()
+}
+
+// GetModerationQueue 返回所有有未处理举报或审核标记的 chirp, 包括已被隐藏的
+func (db *DB) GetModerationQueue(ctx context.Context) (_ []QueueItem, err error) {
+	ctx, end := db.startOp(ctx, "GetModerationQueue")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		`SELECT c.id, c.body, c.author_id, c.hidden_at IS NOT NULL FROM chirps c
+		WHERE EXISTS (SELECT 1 FROM chirp_reports r WHERE r.chirp_id = c.id AND r.status = $1)
+		OR EXISTS (SELECT 1 FROM chirp_flags f WHERE f.chirp_id = c.id AND f.resolved_at IS NULL)
+		ORDER BY c.id`,
+		ReportOpen,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []QueueItem{}
+	index := make(map[int]int)
+	var ids []int
+	for rows.Next() {
+		var item QueueItem
+		err = rows.Scan(&item.Chirp.ID, &item.Chirp.Body, &item.Chirp.AuthID, &item.Hidden)
+		if err != nil {
+			return nil, err
+		}
+		item.Reports = []Report{}
+		item.Flags = []string{}
+		index[item.Chirp.ID] = len(items)
+		ids = append(ids, item.Chirp.ID)
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return items, nil
+	}
+
+	// 未处理的举报
+	reportRows, err := db.DataBase.QueryContext(ctx,
+		`SELECT id, chirp_id, reporter_id, reason, details, status, created_at FROM chirp_reports
+		WHERE chirp_id = ANY($1) AND status = $2 ORDER BY id`,
+		pq.Array(ids), ReportOpen,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer reportRows.Close()
+
+	for reportRows.Next() {
+		var r Report
+		err = reportRows.Scan(&r.ID, &r.ChirpID, &r.ReporterID, &r.Reason, &r.Details, &r.Status, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		item := &items[index[r.ChirpID]]
+		item.Reports = append(item.Reports, r)
+	}
+	if err = reportRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 审核流水线的标记
+	flagRows, err := db.DataBase.QueryContext(ctx,
+		"SELECT chirp_id, rule FROM chirp_flags WHERE chirp_id = ANY($1) AND resolved_at IS NULL ORDER BY rule",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer flagRows.Close()
+
+	for flagRows.Next() {
+		var chirpID int
+		var rule string
+		if err = flagRows.Scan(&chirpID, &rule); err != nil {
+			return nil, err
+		}
+		item := &items[index[chirpID]]
+		item.Flags = append(item.Flags, rule)
+	}
+
+	return items, flagRows.Err()
+}
+
+// DismissChirpReports 驳回 chirp 的所有举报和标记, 并取消隐藏. unhidden 表示 chirp 之前被隐藏了
+func (db *DB) DismissChirpReports(ctx context.Context, chirpID int, moderatorID int, note string) (unhidden bool, err error) {
+	ctx, end := db.startOp(ctx, "DismissChirpReports")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	authorID, err := resolveQueueItem(ctx, tx, chirpID, ReportDismissed)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE chirps SET hidden_at = NULL WHERE id = $1 AND hidden_at IS NOT NULL", chirpID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	err = recordModerationAction(ctx, tx, &moderatorID, ActionDismiss, &chirpID, &authorID, note)
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, tx.Commit()
+}
+
+// RemoveReportedChirp 处理 chirp 的举报并软删除它, deleted_by 记录管理员, 返回作者的id.
+// chirp 和附件在保留期之后由 PurgeDeletedChirps 删除, 举报记录会保留.
+func (db *DB) RemoveReportedChirp(ctx context.Context, chirpID int, moderatorID int, note string) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "RemoveReportedChirp")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	authorID, err := resolveQueueItem(ctx, tx, chirpID, ReportActioned)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE chirps SET deleted_at = NOW(), deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL",
+		chirpID, moderatorID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordModerationAction(ctx, tx, &moderatorID, ActionRemoveChirp, &chirpID, &authorID, note)
+	if err != nil {
+		return 0, err
+	}
+
+	return authorID, tx.Commit()
+}
+
+// SuspendReportedAuthor 处理 chirp 的举报并暂停作者的账号, until 为 nil 时永久封禁, 返回作者的id.
+// 版主和管理员只能由管理员暂停, 不能通过审核队列
+func (db *DB) SuspendReportedAuthor(ctx context.Context, chirpID int, moderatorID int, note string, until *time.Time) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "SuspendReportedAuthor")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	authorID, err := resolveQueueItem(ctx, tx, chirpID, ReportActioned)
+	if err != nil {
+		return 0, err
+	}
+	if authorID == moderatorID {
+		return 0, ErrSuspendSelf
+	}
+	var staff bool
+	err = tx.QueryRowContext(ctx, "SELECT role IN ('moderator', 'admin') FROM users WHERE id = $1", authorID).Scan(&staff)
+	if err != nil {
+		return 0, err
+	}
+	if staff {
+		return 0, ErrSuspendStaff
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_suspensions (user_id, reason, ends_at, created_by) VALUES ($1, $2, $3, $4)",
+		authorID, note, until, moderatorID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordModerationAction(ctx, tx, &moderatorID, ActionSuspendAuthor, &chirpID, &authorID, note)
+	if err != nil {
+		return 0, err
+	}
+
+	return authorID, tx.Commit()
+}
+
+// GetModerationActions 返回最近的审核操作, 最新的在前
+func (db *DB) GetModerationActions(ctx context.Context, limit int) (_ []ModerationAction, err error) {
+	ctx, end := db.startOp(ctx, "GetModerationActions")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT id, moderator_id, action, chirp_id, target_user_id, note, created_at FROM moderation_actions ORDER BY id DESC LIMIT $1",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []ModerationAction{}
+	for rows.Next() {
+		var a ModerationAction
+		var moderatorID, chirpID, targetUserID sql.NullInt64
+		err = rows.Scan(&a.ID, &moderatorID, &a.Action, &chirpID, &targetUserID, &a.Note, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.ModeratorID = nullIntPtr(moderatorID)
+		a.ChirpID = nullIntPtr(chirpID)
+		a.TargetUserID = nullIntPtr(targetUserID)
+		actions = append(actions, a)
+	}
+
+	return actions, rows.Err()
+}
+
+// GetUserRole 返回用户的角色: user, moderator 或 admin
+func (db *DB) GetUserRole(ctx context.Context, userID int) (_ string, err error) {
+	ctx, end := db.startOp(ctx, "GetUserRole")
+	defer end(&err)
+
+	var role string
+	err = db.DataBase.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// resolveQueueItem closes the open reports and flags of a chirp and returns its author
+func resolveQueueItem(ctx context.Context, tx *sql.Tx, chirpID int, status string) (int, error) {
+	var authorID int
+	err := tx.QueryRowContext(ctx, "SELECT author_id FROM chirps WHERE id = $1 FOR UPDATE", chirpID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return 0, ErrChirpNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	reports, err := tx.ExecContext(ctx,
+		"UPDATE chirp_reports SET status = $1, resolved_at = NOW() WHERE chirp_id = $2 AND status = $3",
+		status, chirpID, ReportOpen,
+	)
+	if err != nil {
+		return 0, err
+	}
+	flags, err := tx.ExecContext(ctx, "UPDATE chirp_flags SET resolved_at = NOW() WHERE chirp_id = $1 AND resolved_at IS NULL", chirpID)
+	if err != nil {
+		return 0, err
+	}
+
+	reportCount, err := reports.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	flagCount, err := flags.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if reportCount == 0 && flagCount == 0 {
+		return 0, ErrNothingToModerate
+	}
+
+	return authorID, nil
+}
+
+// recordModerationAction appends an entry to the moderation log, moderatorID is nil for automatic actions
+func recordModerationAction(ctx context.Context, tx *sql.Tx, moderatorID *int, action string, chirpID *int, targetUserID *int, note string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO moderation_actions (moderator_id, action, chirp_id, target_user_id, note) VALUES ($1, $2, $3, $4, $5)",
+		moderatorID, action, chirpID, targetUserID, note,
+	)
+	return err
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
@@ -0,0 +1,316 @@
+package db
+
+import "context"
+
+// migrations are applied in order every time the server starts,
+// so every statement must be safe to run more than once.
+// The users and chirps tables are created outside of the server.
+var migrations = []string{
+	// direct messages
+	`CREATE TABLE IF NOT EXISTS conversations (
+		id SERIAL PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		last_read_message_id INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (conversation_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS conversation_members_user_id_idx ON conversation_members (user_id)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id SERIAL PRIMARY KEY,
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		sender_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id)`,
+	`CREATE TABLE IF NOT EXISTS message_blocks (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		blocked_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (user_id, blocked_user_id)
+	)`,
+
+	// chirp attachments
+	`CREATE TABLE IF NOT EXISTS chirp_attachments (
+		id SERIAL PRIMARY KEY,
+		chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+		blob_key TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chirp_attachments_chirp_id_idx ON chirp_attachments (chirp_id)`,
+
+	// chirps flagged for review by the moderation pipeline
+	`CREATE TABLE IF NOT EXISTS chirp_flags (
+		chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+		rule TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (chirp_id, rule)
+	)`,
+
+	// user reports and the moderation queue
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE chirps ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP`,
+	`ALTER TABLE chirp_flags ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMP`,
+	`CREATE TABLE IF NOT EXISTS chirp_reports (
+		id SERIAL PRIMARY KEY,
+		chirp_id INTEGER NOT NULL,
+		reporter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMP,
+		UNIQUE (chirp_id, reporter_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chirp_reports_status_idx ON chirp_reports (status, chirp_id)`,
+	`CREATE TABLE IF NOT EXISTS user_suspensions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reason TEXT NOT NULL,
+		starts_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		ends_at TIMESTAMP,
+		created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		lifted_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_suspensions_user_id_idx ON user_suspensions (user_id)`,
+	`CREATE TABLE IF NOT EXISTS moderation_actions (
+		id SERIAL PRIMARY KEY,
+		moderator_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		action TEXT NOT NULL,
+		chirp_id INTEGER,
+		target_user_id INTEGER,
+		note TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+
+	// suspensions can hide the chirps of the user while they are active
+	`ALTER TABLE user_suspensions ADD COLUMN IF NOT EXISTS hide_chirps BOOLEAN NOT NULL DEFAULT false`,
+
+	// processed inbound webhook event ids
+	`CREATE TABLE IF NOT EXISTS webhook_events (
+		source TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (source, event_id)
+	)`,
+
+	// subscription history, Chirpy Red is derived from the latest entry
+	`CREATE TABLE IF NOT EXISTS subscriptions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL,
+		event TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS subscriptions_user_id_idx ON subscriptions (user_id, id)`,
+	// users upgraded before the history existed paid for a period we don't know, they keep
+	// Chirpy Red until polka sends an event for them (LegacyExpiry)
+	`INSERT INTO subscriptions (user_id, status, event, expires_at)
+		SELECT id, 'active', 'migrated', '9999-12-31' FROM users
+		WHERE is_chirpy_red AND NOT EXISTS (SELECT 1 FROM subscriptions WHERE user_id = users.id)`,
+
+	// every inbound webhook delivery, kept for auditing and replays
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		source TEXT NOT NULL,
+		event TEXT NOT NULL DEFAULT '',
+		event_id TEXT NOT NULL DEFAULT '',
+		headers JSONB NOT NULL,
+		body BYTEA NOT NULL,
+		verified BOOLEAN NOT NULL,
+		verification_method TEXT NOT NULL DEFAULT '',
+		verification_error TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		response TEXT NOT NULL DEFAULT '',
+		duration_ms DOUBLE PRECISION NOT NULL,
+		replay_of INTEGER REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_received_at_idx ON webhook_deliveries (source, received_at)`,
+
+	// outbound webhooks registered by users and their delivery queue
+	`CREATE TABLE IF NOT EXISTS outbound_webhooks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbound_webhooks_user_id_idx ON outbound_webhooks (user_id)`,
+	`CREATE TABLE IF NOT EXISTS outbound_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES outbound_webhooks(id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_status_code INTEGER,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbound_deliveries_due_idx ON outbound_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS outbound_deliveries_webhook_id_idx ON outbound_deliveries (webhook_id, id)`,
+	`CREATE TABLE IF NOT EXISTS outbound_delivery_attempts (
+		id SERIAL PRIMARY KEY,
+		delivery_id INTEGER NOT NULL REFERENCES outbound_deliveries(id) ON DELETE CASCADE,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms DOUBLE PRECISION NOT NULL,
+		attempted_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbound_delivery_attempts_delivery_id_idx ON outbound_delivery_attempts (delivery_id)`,
+
+	// outbound deliveries continue the trace of the request that queued them
+	`ALTER TABLE outbound_deliveries ADD COLUMN IF NOT EXISTS traceparent TEXT NOT NULL DEFAULT ''`,
+
+	// emails are compared in their normalized form, filled in and indexed by migrateEmails
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_normalized TEXT`,
+
+	// email verification, accounts that existed before count as verified
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP DEFAULT NOW()`,
+	`ALTER TABLE users ALTER COLUMN email_verified_at DROP DEFAULT`,
+	`CREATE TABLE IF NOT EXISTS email_verifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		email TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_verifications_user_id_idx ON email_verifications (user_id)`,
+
+	// access tokens issued before a password change are rejected
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMP`,
+
+	// public profiles, users get the handle "user<id>" until they pick one
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS handle TEXT`,
+	`UPDATE users SET handle = 'user' || id WHERE handle IS NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_handle_key ON users (lower(handle))`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_key TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS follows (
+		follower_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		followed_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (follower_id, followed_id),
+		CHECK (follower_id <> followed_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS follows_followed_id_idx ON follows (followed_id)`,
+
+	// account deletion, deleted accounts are kept until delete_after and then purged,
+	// messages in the conversations of other users stay without their sender
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS delete_after TIMESTAMP`,
+	`CREATE INDEX IF NOT EXISTS users_delete_after_idx ON users (delete_after) WHERE delete_after IS NOT NULL`,
+	`ALTER TABLE messages ALTER COLUMN sender_id DROP NOT NULL`,
+
+	// data exports are built by a background worker
+	`CREATE TABLE IF NOT EXISTS data_exports (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		blob_key TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lease_until TIMESTAMP NOT NULL DEFAULT NOW(),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP,
+		expires_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id, id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS data_exports_user_pending_key ON data_exports (user_id) WHERE status = 'pending'`,
+
+	// deleted chirps are kept for the undo window and as evidence until they are purged
+	`ALTER TABLE chirps ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+	`ALTER TABLE chirps ADD COLUMN IF NOT EXISTS deleted_by INTEGER`,
+	`CREATE INDEX IF NOT EXISTS chirps_deleted_at_idx ON chirps (deleted_at) WHERE deleted_at IS NOT NULL`,
+
+	// append-only audit log, every entry includes the hash of the entry before it.
+	// actor_id has no foreign key, entries outlive the accounts they mention.
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		action TEXT NOT NULL,
+		actor_id INTEGER,
+		target_type TEXT NOT NULL DEFAULT '',
+		target_id TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		details JSONB NOT NULL DEFAULT '{}',
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_actor_id_idx ON audit_log (actor_id, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id, id)`,
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log`,
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+	`DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log`,
+	`CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+
+	// drafts, a draft with publish_at is a scheduled chirp.
+	// publish_at and claimed_until are saved in UTC.
+	`CREATE TABLE IF NOT EXISTS chirp_drafts (
+		id SERIAL PRIMARY KEY,
+		author_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL DEFAULT '',
+		publish_at TIMESTAMP,
+		claimed_until TIMESTAMP,
+		error TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chirp_drafts_author_id_idx ON chirp_drafts (author_id, id)`,
+	`CREATE INDEX IF NOT EXISTS chirp_drafts_publish_at_idx ON chirp_drafts (publish_at) WHERE publish_at IS NOT NULL`,
+}
+
+// migrate applies all migrations in a single transaction.
+// The advisory lock keeps several server instances from migrating at the same time.
+func (db *DB) migrate() error {
+	tx, err := db.DataBase.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('chirpy_migrations'))")
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, err = tx.Exec(migration); err != nil {
+			return err
+		}
+	}
+
+	if err = migrateEmails(context.Background(), tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
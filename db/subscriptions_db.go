@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrUserNotFound is returned for subscription events of users that don't exist
+var ErrUserNotFound = newError(ErrNotFound, "user not found")
+
+// subscription statuses
+const (
+	SubscriptionActive     = "active"
+	SubscriptionCancelled  = "cancelled"
+	SubscriptionPastDue    = "past_due"
+	SubscriptionDowngraded = "downgraded"
+)
+
+// polka subscription events
+const (
+	EventUserUpgraded          = "user.upgraded"
+	EventUserDowngraded        = "user.downgraded"
+	EventSubscriptionCancelled = "subscription.cancelled"
+	EventPaymentFailed         = "payment.failed"
+	EventSubscriptionRenewed   = "subscription.renewed"
+	// EventMigrated marks the Chirpy Red of users upgraded before the subscription history existed
+	EventMigrated = "migrated"
+)
+
+// LegacyExpiry is the expiry of migrated subscriptions. Their paid period isn't known,
+// so they keep Chirpy Red until polka sends an event for them.
+var LegacyExpiry = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+const (
+	// SubscriptionPeriod is the length of a paid period when the event doesn't carry an expiry
+	SubscriptionPeriod = 30 * 24 * time.Hour
+	// PaymentGracePeriod keeps Chirpy Red after a failed payment while polka retries
+	PaymentGracePeriod = 3 * 24 * time.Hour
+)
+
+// ErrUnknownSubscriptionEvent is returned for events that don't change a subscription
+var ErrUnknownSubscriptionEvent = newError(ErrInvalid, "unknown subscription event")
+
+// chirpyRed derives Chirpy Red from the latest subscription state of users.id
+const chirpyRed = "COALESCE((SELECT expires_at > NOW() FROM subscriptions WHERE user_id = users.id ORDER BY id DESC LIMIT 1), false)"
+
+// Subscription is one entry of the subscription history of a user, the latest entry is the current state
+type Subscription struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Status    string    `json:"status"`
+	Event     string    `json:"event"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NextSubscriptionState returns the status and expiry after an event.
+// current is nil when the user never had a subscription, expiresAt is the expiry sent by polka if any.
+func NextSubscriptionState(current *Subscription, event string, expiresAt *time.Time, now time.Time) (string, time.Time, error) {
+	// a migrated subscription has no paid period to extend or keep
+	if current != nil && current.Event == EventMigrated {
+		current = nil
+	}
+
+	// the current paid period, never in the past
+	periodEnd := now
+	if current != nil && current.ExpiresAt.After(now) {
+		periodEnd = current.ExpiresAt
+	}
+
+	switch event {
+	case EventUserUpgraded:
+		if expiresAt != nil {
+			return SubscriptionActive, *expiresAt, nil
+		}
+		return SubscriptionActive, now.Add(SubscriptionPeriod), nil
+
+	case EventSubscriptionRenewed:
+		if expiresAt != nil {
+			return SubscriptionActive, *expiresAt, nil
+		}
+		return SubscriptionActive, periodEnd.Add(SubscriptionPeriod), nil
+
+	case EventSubscriptionCancelled:
+		// no renewal, Chirpy Red lasts until the end of the paid period
+		if expiresAt != nil {
+			return SubscriptionCancelled, *expiresAt, nil
+		}
+		return SubscriptionCancelled, periodEnd, nil
+
+	case EventPaymentFailed:
+		grace := now.Add(PaymentGracePeriod)
+		if current != nil && current.ExpiresAt.After(grace) {
+			grace = current.ExpiresAt
+		}
+		return SubscriptionPastDue, grace, nil
+
+	case EventUserDowngraded:
+		return SubscriptionDowngraded, now, nil
+
+	default:
+		return "", time.Time{}, ErrUnknownSubscriptionEvent
+	}
+}
+
+// ApplySubscriptionEvent 根据 polka 事件追加一条订阅记录并返回新的状态
+func (db *DB) ApplySubscriptionEvent(ctx context.Context, userID int, event string, expiresAt *time.Time) (_ Subscription, err error) {
+	ctx, end := db.startOp(ctx, "ApplySubscriptionEvent")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Subscription{}, err
+	}
+	defer tx.Rollback()
+
+	// 锁定用户, 同一用户的事件依次处理
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, ErrUserNotFound
+	}
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	current, err := getCurrentSubscription(ctx, tx, userID)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	status, expires, err := NextSubscriptionState(current, event, expiresAt, time.Now())
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	var s Subscription
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO subscriptions (user_id, status, event, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING id, user_id, status, event, expires_at, created_at`,
+		userID, status, event, expires,
+	).Scan(&s.ID, &s.UserID, &s.Status, &s.Event, &s.ExpiresAt, &s.CreatedAt)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	return s, tx.Commit()
+}
+
+// GetCurrentSubscription 返回用户最新的订阅状态, 没有订阅时返回 nil
+func (db *DB) GetCurrentSubscription(ctx context.Context, userID int) (*Subscription, error) {
+	return getCurrentSubscription(ctx, db.DataBase, userID)
+}
+
+func getCurrentSubscription(ctx context.Context, q queryer, userID int) (*Subscription, error) {
+	var s Subscription
+	err := q.QueryRowContext(ctx,
+		"SELECT id, user_id, status, event, expires_at, created_at FROM subscriptions WHERE user_id = $1 ORDER BY id DESC LIMIT 1",
+		userID,
+	).Scan(&s.ID, &s.UserID, &s.Status, &s.Event, &s.ExpiresAt, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
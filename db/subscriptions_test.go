@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextSubscriptionState(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	paidUntil := now.Add(10 * 24 * time.Hour)
+	explicit := now.Add(365 * 24 * time.Hour)
+	active := &Subscription{Status: SubscriptionActive, ExpiresAt: paidUntil}
+	expired := &Subscription{Status: SubscriptionActive, ExpiresAt: now.Add(-time.Hour)}
+	migrated := &Subscription{Status: SubscriptionActive, Event: EventMigrated, ExpiresAt: LegacyExpiry}
+
+	tests := []struct {
+		name       string
+		current    *Subscription
+		event      string
+		expiresAt  *time.Time
+		wantStatus string
+		wantExpiry time.Time
+		wantErr    error
+	}{
+		{
+			name:       "Upgrade without subscription",
+			event:      EventUserUpgraded,
+			wantStatus: SubscriptionActive,
+			wantExpiry: now.Add(SubscriptionPeriod),
+		},
+		{
+			name:       "Upgrade with expiry from polka",
+			event:      EventUserUpgraded,
+			expiresAt:  &explicit,
+			wantStatus: SubscriptionActive,
+			wantExpiry: explicit,
+		},
+		{
+			name:       "Renew extends the paid period",
+			current:    active,
+			event:      EventSubscriptionRenewed,
+			wantStatus: SubscriptionActive,
+			wantExpiry: paidUntil.Add(SubscriptionPeriod),
+		},
+		{
+			name:       "Renew after expiry starts now",
+			current:    expired,
+			event:      EventSubscriptionRenewed,
+			wantStatus: SubscriptionActive,
+			wantExpiry: now.Add(SubscriptionPeriod),
+		},
+		{
+			name:       "Cancel keeps the paid period",
+			current:    active,
+			event:      EventSubscriptionCancelled,
+			wantStatus: SubscriptionCancelled,
+			wantExpiry: paidUntil,
+		},
+		{
+			name:       "Payment failed keeps the paid period if longer than the grace period",
+			current:    active,
+			event:      EventPaymentFailed,
+			wantStatus: SubscriptionPastDue,
+			wantExpiry: paidUntil,
+		},
+		{
+			name:       "Payment failed after expiry grants the grace period",
+			current:    expired,
+			event:      EventPaymentFailed,
+			wantStatus: SubscriptionPastDue,
+			wantExpiry: now.Add(PaymentGracePeriod),
+		},
+		{
+			name:       "Downgrade ends now",
+			current:    active,
+			event:      EventUserDowngraded,
+			wantStatus: SubscriptionDowngraded,
+			wantExpiry: now,
+		},
+		{
+			name:       "Renew a migrated subscription starts now",
+			current:    migrated,
+			event:      EventSubscriptionRenewed,
+			wantStatus: SubscriptionActive,
+			wantExpiry: now.Add(SubscriptionPeriod),
+		},
+		{
+			name:       "Cancel a migrated subscription ends now",
+			current:    migrated,
+			event:      EventSubscriptionCancelled,
+			wantStatus: SubscriptionCancelled,
+			wantExpiry: now,
+		},
+		{
+			name:       "Payment failed on a migrated subscription grants the grace period",
+			current:    migrated,
+			event:      EventPaymentFailed,
+			wantStatus: SubscriptionPastDue,
+			wantExpiry: now.Add(PaymentGracePeriod),
+		},
+		{
+			name:    "Unknown event",
+			current: active,
+			event:   "user.created",
+			wantErr: ErrUnknownSubscriptionEvent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, expiry, err := NextSubscriptionState(tt.current, tt.event, tt.expiresAt, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NextSubscriptionState() error = %v, want %v", err, tt.wantErr)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("NextSubscriptionState() status = %v, want %v", status, tt.wantStatus)
+			}
+			if !expiry.Equal(tt.wantExpiry) {
+				t.Errorf("NextSubscriptionState() expiry = %v, want %v", expiry, tt.wantExpiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// moderation actions on users
+const (
+	ActionSuspendUser    = "suspend_user"
+	ActionBanUser        = "ban_user"
+	ActionLiftSuspension = "lift_suspension"
+)
+
+// activeSuspension matches the suspensions of table alias s that are currently in effect
+const activeSuspension = "s.lifted_at IS NULL AND s.starts_at <= NOW() AND (s.ends_at IS NULL OR s.ends_at > NOW())"
+
+// visibleChirp hides the chirps of users suspended with hide_chirps and of deleted accounts,
+// the chirps table must be named chirps
+const visibleChirp = "NOT EXISTS (SELECT 1 FROM user_suspensions s WHERE s.user_id = chirps.author_id AND s.hide_chirps AND " + activeSuspension + ")" +
+	" AND NOT EXISTS (SELECT 1 FROM users du WHERE du.id = chirps.author_id AND du.deleted_at IS NOT NULL)"
+
+// ErrNotSuspended is returned when lifting the suspension of a user that isn't suspended
+var ErrNotSuspended = newError(ErrNotFound, "user is not suspended")
+
+type Suspension struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Reason     string     `json:"reason"`
+	StartsAt   time.Time  `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	HideChirps bool       `json:"hide_chirps"`
+	CreatedBy  *int       `json:"created_by"`
+	LiftedAt   *time.Time `json:"lifted_at"`
+}
+
+// UserSuspendedError is returned by the auth related methods for suspended users
+type UserSuspendedError struct {
+	Suspension Suspension
+}
+
+func (e *UserSuspendedError) Error() string {
+	if e.Suspension.EndsAt == nil {
+		return fmt.Sprintf("account banned: %s", e.Suspension.Reason)
+	}
+	return fmt.Sprintf("account suspended until %s: %s", e.Suspension.EndsAt.UTC().Format(time.RFC3339), e.Suspension.Reason)
+}
+
+func (e *UserSuspendedError) Unwrap() error { return ErrForbidden }
+
+const suspensionColumns = "id, user_id, reason, starts_at, ends_at, hide_chirps, created_by, lifted_at"
+
+func scanSuspension(row interface{ Scan(...interface{}) error }) (Suspension, error) {
+	var s Suspension
+	var endsAt, liftedAt sql.NullTime
+	var createdBy sql.NullInt64
+	err := row.Scan(&s.ID, &s.UserID, &s.Reason, &s.StartsAt, &endsAt, &s.HideChirps, &createdBy, &liftedAt)
+	if err != nil {
+		return Suspension{}, err
+	}
+	if endsAt.Valid {
+		s.EndsAt = &endsAt.Time
+	}
+	if liftedAt.Valid {
+		s.LiftedAt = &liftedAt.Time
+	}
+	s.CreatedBy = nullIntPtr(createdBy)
+	return s, nil
+}
+
+// SuspendUser 暂停用户账号直到 until, until 为 nil 时永久封禁
+func (db *DB) SuspendUser(ctx context.Context, userID int, reason string, until *time.Time, hideChirps bool, createdBy int) (_ Suspension, err error) {
+	ctx, end := db.startOp(ctx, "SuspendUser")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return Suspension{}, err
+	}
+	defer tx.Rollback()
+
+	suspension, err := scanSuspension(tx.QueryRowContext(ctx,
+		"INSERT INTO user_suspensions (user_id, reason, ends_at, hide_chirps, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING "+suspensionColumns,
+		userID, reason, until, hideChirps, createdBy,
+	))
+	if err != nil {
+		return Suspension{}, err
+	}
+
+	action := ActionSuspendUser
+	if until == nil {
+		action = ActionBanUser
+	}
+	err = recordModerationAction(ctx, tx, &createdBy, action, nil, &userID, reason)
+	if err != nil {
+		return Suspension{}, err
+	}
+
+	return suspension, tx.Commit()
+}
+
+// LiftSuspension 解除用户所有生效中的暂停和封禁
+func (db *DB) LiftSuspension(ctx context.Context, userID int, liftedBy int, note string) (err error) {
+	ctx, end := db.startOp(ctx, "LiftSuspension")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE user_suspensions s SET lifted_at = NOW() WHERE s.user_id = $1 AND "+activeSuspension, userID)
+	if err != nil {
+		return err
+	}
+
+	// 检查受影响的行数
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotSuspended
+	}
+
+	err = recordModerationAction(ctx, tx, &liftedBy, ActionLiftSuspension, nil, &userID, note)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetActiveSuspension 返回用户当前生效的暂停, 永久封禁优先, 否则返回结束时间最晚的; 没有时返回 nil
+func (db *DB) GetActiveSuspension(ctx context.Context, userID int) (_ *Suspension, err error) {
+	ctx, end := db.startOp(ctx, "GetActiveSuspension")
+	defer end(&err)
+
+	suspension, err := scanSuspension(db.DataBase.QueryRowContext(ctx,
+		"SELECT "+suspensionColumns+" FROM user_suspensions s WHERE s.user_id = $1 AND "+activeSuspension+
+			" ORDER BY s.ends_at DESC NULLS FIRST LIMIT 1",
+		userID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &suspension, nil
+}
+
+// CheckNotSuspended 用户被暂停或封禁时返回 *UserSuspendedError
+func (db *DB) CheckNotSuspended(ctx context.Context, userID int) (err error) {
+	ctx, end := db.startOp(ctx, "CheckNotSuspended")
+	defer end(&err)
+
+	suspension, err := db.GetActiveSuspension(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if suspension != nil {
+		return &UserSuspendedError{Suspension: *suspension}
+	}
+	return nil
+}
+
+// GetSuspensions 返回用户的所有暂停记录, 最新的在前
+func (db *DB) GetSuspensions(ctx context.Context, userID int) (_ []Suspension, err error) {
+	ctx, end := db.startOp(ctx, "GetSuspensions")
+	defer end(&err)
+
+	rows, err := db.DataBase.QueryContext(ctx,
+		"SELECT "+suspensionColumns+" FROM user_suspensions WHERE user_id = $1 ORDER BY id DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suspensions := []Suspension{}
+	for rows.Next() {
+		suspension, err := scanSuspension(rows)
+		if err != nil {
+			return nil, err
+		}
+		suspensions = append(suspensions, suspension)
+	}
+
+	return suspensions, rows.Err()
+}
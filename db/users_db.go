@@ -1,39 +1,91 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
+// ErrEmailTaken 邮箱已经被其他用户使用
+var ErrEmailTaken = newError(ErrConflict, "email is already in use")
+
+// ErrAccountDeleted 账号已经删除并且宽限期已过, 不能再恢复
+var ErrAccountDeleted = newError(ErrGone, "account was deleted")
+
+// NormalizeEmail 返回用于比较的邮箱: 去掉首尾空白, Unicode NFKC 规范化后做大小写折叠,
+// "Bob@X.com" 和 " bob@x.com" 是同一个邮箱
+func NormalizeEmail(email string) string {
+	return cases.Fold().String(norm.NFKC.String(strings.TrimSpace(email)))
+}
+
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	// 密码的哈希和 refresh token 永远不会出现在响应里
+	Password string `json:"-"`
 	// token 是refresh token 并不是jwt token
-	Token       string `json:"refresh_token"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Token         string `json:"-"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
+	Handle        string `json:"handle"`
+	DisplayName   string `json:"display_name"`
+	Bio           string `json:"bio"`
+	// TokensValidAfter 之前签发的 access token 无效, 修改密码时更新
+	TokensValidAfter *time.Time `json:"-"`
+}
+
+// UserUpdate 是 UpdateUserAccount 的参数, nil 的字段不修改
+type UserUpdate struct {
+	Email       *string
+	Password    *string
+	Handle      *string
+	DisplayName *string
+	Bio         *string
 }
 
-// RevokeToken 废除refresh token
-func (db *DB) RevokeToken(refreshToken string) error {
-	_, err := db.DataBase.Exec("UPDATE users SET refresh_token = NULL, refresh_token_expire_time = NULL WHERE refresh_token = $1", refreshToken)
+// userColumns 是 scanUser 读取的列
+const userColumns = "id, email, email_verified_at IS NOT NULL, tokens_valid_after, handle, display_name, bio"
+
+// scanUser 读取 userColumns
+func scanUser(row *sql.Row) (User, error) {
+	var user User
+	var tokensValidAfter sql.NullTime
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerified, &tokensValidAfter, &user.Handle, &user.DisplayName, &user.Bio)
 	if err != nil {
-		return err
+		return User{}, err
 	}
-
-	return nil
+	if tokensValidAfter.Valid {
+		user.TokensValidAfter = &tokensValidAfter.Time
+	}
+	return user, nil
 }
 
-// CheckRefreshTokenIsValid 检查refresh token是否有效
-func (db *DB) CheckRefreshTokenIsValid(refreshToken string) (int, error) {
+// ErrWrongPassword 当前密码不正确
+var ErrWrongPassword = newError(ErrForbidden, "current password is incorrect")
+
+// RevokeToken 废除refresh token, 返回该token所属用户的id, 没有找到时返回0
+func (db *DB) RevokeToken(ctx context.Context, refreshToken string) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "RevokeToken")
+	defer end(&err)
 
 	var userID int
-	err := db.DataBase.QueryRow(
-		"SELECT id FROM users WHERE refresh_token = $1",
+	err = db.DataBase.QueryRowContext(ctx,
+		"UPDATE users SET refresh_token = NULL, refresh_token_expire_time = NULL WHERE refresh_token = $1 RETURNING id",
 		refreshToken,
 	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -41,103 +93,167 @@ func (db *DB) CheckRefreshTokenIsValid(refreshToken string) (int, error) {
 	return userID, nil
 }
 
-// SaveToken 保存refresh token
-func (db *DB) SaveToken(userID int, refreshToken string, expire_time time.Time) error {
-	// 查找出id对应的用户 更新 refresh_token and refresh_token_expire_time
-	_, err := db.DataBase.Exec("UPDATE users SET refresh_token = $1, refresh_token_expire_time = $2 WHERE id = $3", refreshToken, expire_time, userID)
+// CheckRefreshTokenIsValid 检查refresh token是否有效
+func (db *DB) CheckRefreshTokenIsValid(ctx context.Context, refreshToken string) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "CheckRefreshTokenIsValid")
+	defer end(&err)
+
+	var userID int
+	err = db.DataBase.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE refresh_token = $1",
+		refreshToken,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidRefreshToken
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
-}
-
-// UpdateIsChirpyRed  更新用户是否是红包狂
-func (db *DB) UpdateIsChirpyRed(userID int) error {
-
-	result, err := db.DataBase.Exec("UPDATE users SET is_chirpy_red = $1 WHERE id = $2", true, userID)
+	// 被暂停或封禁的用户不能刷新token
+	err = db.CheckNotSuspended(ctx, userID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// 检查受影响的行数
-	rowsAffected, err := result.RowsAffected()
+	return userID, nil
+}
+
+// SaveToken 保存refresh token
+func (db *DB) SaveToken(ctx context.Context, userID int, refreshToken string, expire_time time.Time) (err error) {
+	ctx, end := db.startOp(ctx, "SaveToken")
+	defer end(&err)
+
+	// 查找出id对应的用户 更新 refresh_token and refresh_token_expire_time
+	_, err = db.DataBase.ExecContext(ctx, "UPDATE users SET refresh_token = $1, refresh_token_expire_time = $2 WHERE id = $3", refreshToken, expire_time, userID)
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("no user found with id %d", userID)
-	}
 
 	return nil
 }
 
-// func (db *DB) DeleteRefreshToken(userID int, refreshToken string) error {
-// 	_, err := db.DataBase.Exec("DELETE FROM users WHERE id = $1 AND refresh_token = $2", userID, refreshToken)
+// func (db *DB) DeleteRefreshToken(ctx context.Context, userID int, refreshToken string) error {
+// 	_, err := db.DataBase.ExecContext(ctx, "DELETE FROM users WHERE id = $1 AND refresh_token = $2", userID, refreshToken)
 // 	if err != nil {
 // 		return err
 // 	}
 // 	return nil
 // }
 
-// LoginUser 登录用户
-func (db *DB) LoginUser(email string, password string) (User, error) {
+// LoginUser 登录用户, 已删除但还没有被彻底删除的账号会被恢复
+func (db *DB) LoginUser(ctx context.Context, email string, password string) (_ User, err error) {
+	ctx, end := db.startOp(ctx, "LoginUser")
+	defer end(&err)
+
+	// 邮箱不区分大小写, 唯一索引建立之前可能有重复的邮箱, 取最早的账号
 	var user User
-	err := db.DataBase.QueryRow(
-		"SELECT id, email, password, is_chirpy_red FROM users WHERE email = $1",
-		email,
-	).Scan(&user.ID, &user.Email, &user.Password, &user.IsChirpyRed)
+	var deleted bool
+	err = db.DataBase.QueryRowContext(ctx,
+		"SELECT id, email, password, "+chirpyRed+", deleted_at IS NOT NULL FROM users WHERE email_normalized = $1 ORDER BY id LIMIT 1",
+		NormalizeEmail(email),
+	).Scan(&user.ID, &user.Email, &user.Password, &user.IsChirpyRed, &deleted)
+	if err == sql.ErrNoRows {
+		return User{}, ErrInvalidCredentials
+	}
 	if err != nil {
 		return User{}, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	err = db.comparePassword(ctx, user.Password, password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return User{}, ErrInvalidCredentials
+	}
 	if err != nil {
 		return User{}, err
 	}
 
+	// 在宽限期内登录会取消账号的删除, 宽限期过后账号等待被彻底删除, 不能再登录
+	if deleted {
+		result, err := db.DataBase.ExecContext(ctx,
+			"UPDATE users SET deleted_at = NULL, delete_after = NULL WHERE id = $1 AND delete_after > NOW()",
+			user.ID,
+		)
+		if err != nil {
+			return User{}, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return User{}, err
+		}
+		if rowsAffected == 0 {
+			return User{}, ErrAccountDeleted
+		}
+	}
+
 	return user, nil
 }
 
 // CreateUser 创建一个新用户并保存至数据库
-func (db *DB) CreateUser(email string, password string) (User, error) {
+func (db *DB) CreateUser(ctx context.Context, email string, password string) (_ User, err error) {
+	ctx, end := db.startOp(ctx, "CreateUser")
+	defer end(&err)
+
 	var user User
 
-	hashedPassword, err := GenerateFromPassword(password)
+	hashedPassword, err := db.hashPassword(ctx, password)
 
 	if err != nil {
 		return User{}, err
 	}
 
-	err = db.DataBase.QueryRow(
-		"INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id, email, password",
-		email,
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// 唯一索引保证并发时也不会重复, NOT EXISTS 在索引建立之前也能拒绝重复的邮箱
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO users (email, email_normalized, password)
+		SELECT $1, $2, $3
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE email_normalized = $2)
+		RETURNING id, email, password`,
+		strings.TrimSpace(email),
+		NormalizeEmail(email),
 		hashedPassword,
 	).Scan(&user.ID, &user.Email, &user.Password)
 
+	if err == sql.ErrNoRows || isEmailConflict(err) {
+		return User{}, ErrEmailTaken
+	}
 	if err != nil {
 		return User{}, err
 	}
-	return user, nil
-}
 
-// GetUserByID 根据 id 返回一个用户
-func (db *DB) GetUserByID(id int) (User, error) {
-	var user User
-	err := db.DataBase.QueryRow(
-		"SELECT id, email FROM users WHERE id = $1",
-		id,
-	).Scan(&user.ID, &user.Email)
+	// 新用户先使用默认的 handle, 之后可以修改
+	user.Handle = defaultHandle(user.ID)
+	_, err = tx.ExecContext(ctx, "UPDATE users SET handle = $1 WHERE id = $2", user.Handle, user.ID)
 	if err != nil {
 		return User{}, err
 	}
+
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
 	return user, nil
 }
 
+// GetUserByID 根据 id 返回一个用户
+func (db *DB) GetUserByID(ctx context.Context, id int) (_ User, err error) {
+	ctx, end := db.startOp(ctx, "GetUserByID")
+	defer end(&err)
+
+	return scanUser(db.DataBase.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
 // GetUsers 返回数据库中的所有用户
-func (db *DB) GetUsers() ([]User, error) {
+func (db *DB) GetUsers(ctx context.Context) (_ []User, err error) {
+	ctx, end := db.startOp(ctx, "GetUsers")
+	defer end(&err)
+
 	var users []User
-	rows, err := db.DataBase.Query("SELECT id, email FROM users")
+	rows, err := db.DataBase.QueryContext(ctx, "SELECT id, email FROM users")
 	if err != nil {
 		return nil, err
 	}
@@ -158,18 +274,77 @@ func (db *DB) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	var user User
-	hashedPassword, err := GenerateFromPassword(password)
-	if err != nil {
-		return User{}, err
+// UpdateUserAccount 只修改 update 中不为 nil 的字段.
+// 修改邮箱后需要重新验证 (只改大小写除外), 修改密码会废除 refresh token,
+// 之前签发的 access token 也不再有效.
+func (db *DB) UpdateUserAccount(ctx context.Context, id int, update UserUpdate) (_ User, err error) {
+	ctx, end := db.startOp(ctx, "UpdateUserAccount")
+	defer end(&err)
+
+	var sets []string
+	var conditions []string
+	args := []interface{}{id}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if update.Email != nil {
+		email, normalized := arg(strings.TrimSpace(*update.Email)), arg(NormalizeEmail(*update.Email))
+		sets = append(sets,
+			"email = "+email,
+			"email_normalized = "+normalized,
+			"email_verified_at = CASE WHEN email_normalized = "+normalized+" THEN email_verified_at END",
+		)
+		conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM users WHERE email_normalized = "+normalized+" AND id <> $1)")
+	}
+
+	if update.Password != nil {
+		hashedPassword, err := db.hashPassword(ctx, *update.Password)
+		if err != nil {
+			return User{}, err
+		}
+		// 和 jwt 的签发时间用同一个时钟, jwt 的时间精确到秒
+		sets = append(sets,
+			"password = "+arg(hashedPassword),
+			"refresh_token = NULL",
+			"refresh_token_expire_time = NULL",
+			"tokens_valid_after = "+arg(time.Now().Truncate(time.Second)),
+		)
+	}
+
+	if update.Handle != nil {
+		if isDefaultHandle(*update.Handle) && !strings.EqualFold(*update.Handle, defaultHandle(id)) {
+			return User{}, ErrHandleTaken
+		}
+		sets = append(sets, "handle = "+arg(*update.Handle))
+	}
+	if update.DisplayName != nil {
+		sets = append(sets, "display_name = "+arg(strings.TrimSpace(*update.DisplayName)))
+	}
+	if update.Bio != nil {
+		sets = append(sets, "bio = "+arg(strings.TrimSpace(*update.Bio)))
+	}
+
+	if len(sets) == 0 {
+		return db.GetUserByID(ctx, id)
+	}
+
+	user, err := scanUser(db.DataBase.QueryRowContext(ctx,
+		"UPDATE users SET "+strings.Join(sets, ", ")+
+			" WHERE "+strings.Join(append([]string{"id = $1"}, conditions...), " AND ")+
+			" RETURNING "+userColumns,
+		args...,
+	))
+	if isEmailConflict(err) {
+		return User{}, ErrEmailTaken
+	}
+	if isHandleConflict(err) {
+		return User{}, ErrHandleTaken
+	}
+	if err == sql.ErrNoRows {
+		return User{}, db.emailTakenOrNotFound(ctx, id)
 	}
-	err = db.DataBase.QueryRow(
-		"UPDATE users SET email = $1, password = $2 WHERE id = $3 RETURNING id, email",
-		email,
-		hashedPassword,
-		id,
-	).Scan(&user.ID, &user.Email)
 	if err != nil {
 		return User{}, err
 	}
@@ -177,6 +352,159 @@ func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
 	return user, nil
 }
 
+// VerifyPassword 检查用户的当前密码, 不正确时返回 ErrWrongPassword
+func (db *DB) VerifyPassword(ctx context.Context, id int, password string) (err error) {
+	ctx, end := db.startOp(ctx, "VerifyPassword")
+	defer end(&err)
+
+	var hashedPassword string
+	err = db.DataBase.QueryRowContext(ctx, "SELECT password FROM users WHERE id = $1", id).Scan(&hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	err = db.comparePassword(ctx, hashedPassword, password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+	return err
+}
+
+// emailTakenOrNotFound 区分 UPDATE 没有更新任何行的两种原因
+func (db *DB) emailTakenOrNotFound(ctx context.Context, id int) error {
+	var exists bool
+	err := db.DataBase.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrEmailTaken
+	}
+	return sql.ErrNoRows
+}
+
+// isEmailConflict 判断是否违反了邮箱的唯一约束
+func isEmailConflict(err error) bool {
+	var pqErr *pq.Error
+	return isUniqueViolation(err) && errors.As(err, &pqErr) &&
+		(pqErr.Constraint == "users_email_normalized_key" || pqErr.Constraint == "users_email_key")
+}
+
+// DuplicateEmail 是多个账号共用的邮箱
+type DuplicateEmail struct {
+	Email   string `json:"email"`
+	UserIDs []int  `json:"user_ids"`
+}
+
+// DuplicateEmails 返回规范化后相同的邮箱, 存在重复时邮箱的唯一索引不会建立
+func (db *DB) DuplicateEmails(ctx context.Context) (_ []DuplicateEmail, err error) {
+	ctx, end := db.startOp(ctx, "DuplicateEmails")
+	defer end(&err)
+
+	return duplicateEmails(ctx, db.DataBase)
+}
+
+func duplicateEmails(ctx context.Context, q queryer) ([]DuplicateEmail, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT email_normalized, array_agg(id ORDER BY id) FROM users
+		WHERE email_normalized IS NOT NULL
+		GROUP BY email_normalized HAVING count(*) > 1
+		ORDER BY email_normalized`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []DuplicateEmail{}
+	for rows.Next() {
+		var d DuplicateEmail
+		var ids pq.Int64Array
+		if err := rows.Scan(&d.Email, &ids); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			d.UserIDs = append(d.UserIDs, int(id))
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
+
+// migrateEmails 填充 users.email_normalized 并建立唯一索引.
+// 规范化在 Go 里完成, 和 NormalizeEmail 完全一致.
+// 已有的账号共用邮箱时不建立索引, 只记录重复的邮箱, 处理之后下次启动会再检查.
+func migrateEmails(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, email FROM users WHERE email_normalized IS NULL")
+	if err != nil {
+		return err
+	}
+	emails := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		emails[id] = email
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, email := range emails {
+		_, err := tx.ExecContext(ctx, "UPDATE users SET email_normalized = $1 WHERE id = $2", NormalizeEmail(email), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "ALTER TABLE users ALTER COLUMN email_normalized SET NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	duplicates, err := duplicateEmails(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		for _, d := range duplicates {
+			slog.Warn("accounts share an email, the unique email index is not created until they are merged or changed",
+				"email", d.Email, "user_ids", d.UserIDs)
+		}
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS users_email_normalized_key ON users (email_normalized)")
+	return err
+}
+
+// hashPassword 计算密码的 bcrypt hash 并记录耗时
+func (db *DB) hashPassword(ctx context.Context, password string) ([]byte, error) {
+	defer db.observeBcrypt(ctx, "hash")()
+	return GenerateFromPassword(password)
+}
+
+// comparePassword 比较密码和 bcrypt hash 并记录耗时
+func (db *DB) comparePassword(ctx context.Context, hashedPassword string, password string) error {
+	defer db.observeBcrypt(ctx, "compare")()
+	return CompareHashAndPassword(hashedPassword, password)
+}
+
+// observeBcrypt 为 bcrypt 操作创建 span, 返回的函数结束 span 并记录耗时
+func (db *DB) observeBcrypt(ctx context.Context, op string) func() {
+	start := time.Now()
+	_, span := otel.Tracer("server/db").Start(ctx, "bcrypt."+op)
+	return func() {
+		span.End()
+		if db.ObserveBcrypt != nil {
+			db.ObserveBcrypt(op, time.Since(start))
+		}
+	}
+}
+
 // GenerateFromPassword  hash password
 func GenerateFromPassword(password string) ([]byte, error) {
 
@@ -0,0 +1,26 @@
+package db
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{email: "bob@x.com", want: "bob@x.com"},
+		{email: "  Bob@X.com\t", want: "bob@x.com"},
+		{email: "STRASSE@x.com", want: "strasse@x.com"},
+		{email: "Straße@x.com", want: "strasse@x.com"},
+		// fullwidth letters are the same as their ASCII form after NFKC
+		{email: "ｂｏｂ@x.com", want: "bob@x.com"},
+		// precomposed and combining accents are the same address
+		{email: "josé@x.com", want: "josé@x.com"},
+		{email: "jose\u0301@x.com", want: "josé@x.com"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeEmail(tt.email); got != tt.want {
+			t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// ErrInvalidVerificationToken 验证 token 不存在, 已经过期, 或者邮箱在验证前又修改了
+var ErrInvalidVerificationToken = newError(ErrInvalid, "invalid or expired verification token")
+
+// EmailVerification 是发给用户的验证 token, 数据库只保存它的 hash
+type EmailVerification struct {
+	Email     string
+	Token     string
+	ExpiresAt time.Time
+}
+
+// CreateEmailVerification 为用户当前的邮箱生成验证 token, 之前的 token 都失效
+func (db *DB) CreateEmailVerification(ctx context.Context, userID int, ttl time.Duration) (_ EmailVerification, err error) {
+	ctx, end := db.startOp(ctx, "CreateEmailVerification")
+	defer end(&err)
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return EmailVerification{}, err
+	}
+	verification := EmailVerification{
+		Token:     hex.EncodeToString(b),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = $1", userID)
+	if err != nil {
+		return EmailVerification{}, err
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO email_verifications (user_id, email, token_hash, expires_at)
+		SELECT id, email, $2, $3 FROM users WHERE id = $1
+		RETURNING email`,
+		userID, hashVerificationToken(verification.Token), verification.ExpiresAt,
+	).Scan(&verification.Email)
+	if err != nil {
+		return EmailVerification{}, err
+	}
+
+	return verification, tx.Commit()
+}
+
+// VerifyEmail 用验证 token 确认用户的邮箱, 返回用户的 id
+func (db *DB) VerifyEmail(ctx context.Context, token string) (_ int, err error) {
+	ctx, end := db.startOp(ctx, "VerifyEmail")
+	defer end(&err)
+
+	tx, err := db.DataBase.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	var valid bool
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM email_verifications WHERE token_hash = $1 RETURNING user_id, email, expires_at > NOW()",
+		hashVerificationToken(token),
+	).Scan(&userID, &email, &valid)
+	if err == sql.ErrNoRows || (err == nil && !valid) {
+		return 0, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// 邮箱在验证之前又修改过时 token 不再有效
+	result, err := tx.ExecContext(ctx, "UPDATE users SET email_verified_at = NOW() WHERE id = $1 AND email = $2", userID, email)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected == 0 {
+		return 0, ErrInvalidVerificationToken
+	}
+
+	return userID, tx.Commit()
+}
+
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ClaimWebhookEvent 记录一个 webhook 事件 id, 返回 false 表示该事件已经处理过
+func (db *DB) ClaimWebhookEvent(ctx context.Context, source string, eventID string, event string) (_ bool, err error) {
+	ctx, end := db.startOp(ctx, "ClaimWebhookEvent")
+	defer end(&err)
+
+	result, err := db.DataBase.ExecContext(ctx,
+		"INSERT INTO webhook_events (source, event_id, event) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		source, eventID, event,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// ReleaseWebhookEvent 删除处理失败的事件 id, 使重试的投递可以被再次处理
+func (db *DB) ReleaseWebhookEvent(ctx context.Context, source string, eventID string) (err error) {
+	ctx, end := db.startOp(ctx, "ReleaseWebhookEvent")
+	defer end(&err)
+
+	_, err = db.DataBase.ExecContext(ctx, "DELETE FROM webhook_events WHERE source = $1 AND event_id = $2", source, eventID)
+	return err
+}
+
+// webhook delivery outcomes
+const (
+	WebhookProcessed = "processed"
+	WebhookDuplicate = "duplicate"
+	WebhookIgnored   = "ignored"
+	WebhookFailed    = "failed"
+	WebhookRejected  = "rejected"
+)
+
+// WebhookDelivery is an inbound webhook request and how it was handled
+type WebhookDelivery struct {
+	ID                 int                 `json:"id"`
+	Source             string              `json:"source"`
+	Event              string              `json:"event"`
+	EventID            string              `json:"event_id"`
+	Headers            map[string][]string `json:"headers"`
+	Body               string              `json:"body"`
+	Verified           bool                `json:"verified"`
+	VerificationMethod string              `json:"verification_method"`
+	VerificationError  string              `json:"verification_error"`
+	Outcome            string              `json:"outcome"`
+	StatusCode         int                 `json:"status_code"`
+	Response           string              `json:"response"`
+	DurationMs         float64             `json:"duration_ms"`
+	ReplayOf           *int                `json:"replay_of"`
+	ReceivedAt         time.Time           `json:"received_at"`
+}
+
+var (
+	// ErrUnverifiedReplay is returned when replaying a delivery that failed verification
+	ErrUnverifiedReplay = newError(ErrConflict, "only verified deliveries can be replayed")
+	// ErrUnsafeReplay is returned when replaying a delivery without event id that was already processed
+	ErrUnsafeReplay = newError(ErrConflict, "delivery has no event id and was already processed, replaying it would apply it twice")
+)
+
+// CheckReplay returns an error when the delivery must not be replayed. Deliveries with an
+// event id are deduplicated by their handler, those without one only if they weren't processed.
+func (d WebhookDelivery) CheckReplay() error {
+	if !d.Verified {
+		return ErrUnverifiedReplay
+	}
+	if d.EventID == "" && d.Outcome == WebhookProcessed {
+		return ErrUnsafeReplay
+	}
+	return nil
+}
+
+// ReplayKey is the event id claimed by replays of a delivery without event id,
+// at most one of them is processed
+func (d WebhookDelivery) ReplayKey() string {
+	id := d.ID
+	if d.ReplayOf != nil {
+		id = *d.ReplayOf
+	}
+	return fmt.Sprintf("replay:%d", id)
+}
+
+// WebhookDeliveryFilter narrows GetWebhookDeliveries, zero values match everything
+type WebhookDeliveryFilter struct {
+	Source  string
+	Event   string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+const webhookDeliveryColumns = `id, source, event, event_id, headers, body, verified, verification_method,
+	verification_error, outcome, status_code, response, duration_ms, replay_of, received_at`
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var headers, body []byte
+	var replayOf sql.NullInt64
+	err := row.Scan(&d.ID, &d.Source, &d.Event, &d.EventID, &headers, &body, &d.Verified, &d.VerificationMethod,
+		&d.VerificationError, &d.Outcome, &d.StatusCode, &d.Response, &d.DurationMs, &replayOf, &d.ReceivedAt)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	err = json.Unmarshal(headers, &d.Headers)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.Body = string(body)
+	d.ReplayOf = nullIntPtr(replayOf)
+	return d, nil
+}
+
+// CreateWebhookDelivery 保存一次 webhook 投递
+func (db *DB) CreateWebhookDelivery(ctx context.Context, d WebhookDelivery) (_ WebhookDelivery, err error) {
+	ctx, end := db.startOp(ctx, "CreateWebhookDelivery")
+	defer end(&err)
+
+	headers, err := json.Marshal(d.Headers)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return scanWebhookDelivery(db.DataBase.QueryRowContext(ctx,
+		`INSERT INTO webhook_deliveries (source, event, event_id, headers, body, verified, verification_method,
+			verification_error, outcome, status_code, response, duration_ms, replay_of)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+webhookDeliveryColumns,
+		d.Source, d.Event, d.EventID, headers, []byte(d.Body), d.Verified, d.VerificationMethod,
+		d.VerificationError, d.Outcome, d.StatusCode, d.Response, d.DurationMs, d.ReplayOf,
+	))
+}
+
+// GetWebhookDelivery 根据 id 返回一次 webhook 投递
+func (db *DB) GetWebhookDelivery(ctx context.Context, id int) (_ WebhookDelivery, err error) {
+	ctx, end := db.startOp(ctx, "GetWebhookDelivery")
+	defer end(&err)
+
+	return scanWebhookDelivery(db.DataBase.QueryRowContext(ctx,
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = $1",
+		id,
+	))
+}
+
+// GetWebhookDeliveries 返回符合条件的 webhook 投递, 最新的在前
+func (db *DB) GetWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter) (_ []WebhookDelivery, err error) {
+	ctx, end := db.startOp(ctx, "GetWebhookDeliveries")
+	defer end(&err)
+
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Source != "" {
+		add("source = $%d", filter.Source)
+	}
+	if filter.Event != "" {
+		add("event = $%d", filter.Event)
+	}
+	if filter.Outcome != "" {
+		add("outcome = $%d", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		add("received_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("received_at < $%d", filter.Until)
+	}
+
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := db.DataBase.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery WebhookDelivery
+		want     error
+	}{
+		{
+			name:     "Unverified",
+			delivery: WebhookDelivery{Verified: false, EventID: "evt_1", Outcome: WebhookRejected},
+			want:     ErrUnverifiedReplay,
+		},
+		{
+			name:     "Processed with event id is deduplicated",
+			delivery: WebhookDelivery{Verified: true, EventID: "evt_1", Outcome: WebhookProcessed},
+		},
+		{
+			name:     "Failed without event id",
+			delivery: WebhookDelivery{Verified: true, Outcome: WebhookFailed},
+		},
+		{
+			name:     "Processed without event id",
+			delivery: WebhookDelivery{Verified: true, Outcome: WebhookProcessed},
+			want:     ErrUnsafeReplay,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.delivery.CheckReplay(); !errors.Is(err, tt.want) {
+				t.Errorf("CheckReplay() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayKey(t *testing.T) {
+	original := WebhookDelivery{ID: 7}
+	replay := WebhookDelivery{ID: 9, ReplayOf: &original.ID}
+
+	// replays of replays are still applied at most once
+	if original.ReplayKey() != replay.ReplayKey() {
+		t.Errorf("ReplayKey() = %q and %q, want the key of the received delivery", original.ReplayKey(), replay.ReplayKey())
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/db"
+	"server/logging"
+	"server/scheduler"
+	"server/validation"
+	"strconv"
+	"time"
+)
+
+// validatePublishAt checks the time a chirp is scheduled for
+func validatePublishAt(publishAt time.Time) error {
+	if !publishAt.After(time.Now()) {
+		return validation.Errors{{Field: "publish_at", Message: "must be in the future"}}
+	}
+	return nil
+}
+
+// validateScheduledChirp checks a draft before it is scheduled, so the author learns about
+// a rejected chirp right away. The moderation rules run again when it is published.
+func (cfg *ApiConfig) validateScheduledChirp(body string) error {
+	if body == "" {
+		return validation.Errors{{Field: "body", Message: "is required to schedule a chirp"}}
+	}
+	_, _, err := cfg.checkChirp(db.Chirp{Body: body})
+	return err
+}
+
+// draftIDFromPath reads the draft id of /api/drafts/{draftID}
+func draftIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	draftID, err := strconv.Atoi(r.PathValue("draftID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid draft ID")
+		return 0, false
+	}
+	return draftID, true
+}
+
+// CreateDraftHandler saves a draft, with publish_at it is published at that time
+// POST /api/drafts {"body": "...", "publish_at": "2024-05-01T12:00:00Z"}
+func (cfg *ApiConfig) CreateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Body      string     `json:"body" validate:"max=140"`
+		PublishAt *time.Time `json:"publish_at"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	if params.PublishAt != nil {
+		err = validatePublishAt(*params.PublishAt)
+		if err == nil {
+			err = cfg.validateScheduledChirp(params.Body)
+		}
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	draft, err := cfg.db.CreateDraft(r.Context(), userID, params.Body, params.PublishAt)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 201 Created
+	respondWithJSON(w, http.StatusCreated, draft)
+}
+
+// GetDraftsHandler lists the drafts and scheduled chirps of the user
+// GET /api/drafts?status=draft|scheduled
+func (cfg *ApiConfig) GetDraftsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != db.DraftStatusDraft && status != db.DraftStatusScheduled {
+		respondWithError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	drafts, err := cfg.db.GetDrafts(r.Context(), userID, status)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, drafts)
+}
+
+// GetDraftHandler returns a draft of the user
+// GET /api/drafts/{draftID}
+func (cfg *ApiConfig) GetDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, ok := draftIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	draft, err := cfg.db.GetDraft(r.Context(), draftID, userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, draft)
+}
+
+// UpdateDraftHandler edits a draft or a scheduled chirp before it is published, fields that are left out are kept.
+// Setting publish_at schedules a draft or moves a scheduled chirp.
+// PATCH /api/drafts/{draftID} {"body": "...", "publish_at": "2024-05-01T12:00:00Z"}
+func (cfg *ApiConfig) UpdateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, ok := draftIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var params struct {
+		Body      *string    `json:"body" validate:"max=140"`
+		PublishAt *time.Time `json:"publish_at"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	draft, err := cfg.db.GetDraft(r.Context(), draftID, userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// the chirp stays scheduled or becomes scheduled, check it like a new one
+	if params.PublishAt != nil {
+		err = validatePublishAt(*params.PublishAt)
+	}
+	if err == nil && (params.PublishAt != nil || draft.PublishAt != nil) {
+		body := draft.Body
+		if params.Body != nil {
+			body = *params.Body
+		}
+		err = cfg.validateScheduledChirp(body)
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// fails with a conflict when the chirp was published or edited in the meantime
+	draft, err = cfg.db.UpdateDraft(r.Context(), draftID, userID, draft.Version, db.DraftUpdate{
+		Body:      params.Body,
+		PublishAt: params.PublishAt,
+	})
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, draft)
+}
+
+// UnscheduleDraftHandler cancels the publication of a scheduled chirp and keeps it as a draft
+// DELETE /api/drafts/{draftID}/schedule
+func (cfg *ApiConfig) UnscheduleDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, ok := draftIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	draft, err := cfg.db.GetDraft(r.Context(), draftID, userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	if draft.PublishAt == nil {
+		respondWithError(w, http.StatusConflict, "draft is not scheduled")
+		return
+	}
+
+	draft, err = cfg.db.UpdateDraft(r.Context(), draftID, userID, draft.Version, db.DraftUpdate{Unschedule: true})
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, draft)
+}
+
+// DeleteDraftHandler deletes a draft, a scheduled chirp is canceled
+// DELETE /api/drafts/{draftID}
+func (cfg *ApiConfig) DeleteDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, ok := draftIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	err := cfg.db.DeleteDraft(r.Context(), draftID, userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// PublishDraftHandler publishes a draft or a scheduled chirp right away
+// POST /api/drafts/{draftID}/publish
+func (cfg *ApiConfig) PublishDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, ok := draftIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	draft, err := cfg.db.GetDraft(r.Context(), draftID, userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	if draft.Body == "" {
+		respondWithErr(w, r, validation.Errors{{Field: "body", Message: "is required"}})
+		return
+	}
+
+	validatedChirp, moderationResult, err := cfg.validateChirp(db.Chirp{Body: draft.Body})
+	if err != nil {
+		// 422 Unprocessable Entity
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// fails with a conflict when the scheduler published it or it was edited in the meantime
+	chirp, err := cfg.db.PublishDraft(r.Context(), draft.ID, draft.Version, validatedChirp.Body)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	cfg.announceChirp(r.Context(), chirp, moderationResult)
+
+	// 200 OK
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// publishScheduledChirp is the scheduler.PublishFunc of the chirp scheduler, a scheduled chirp is
+// validated and moderated like an immediate post. Chirps the rules reject and chirps of suspended
+// authors go back to the drafts.
+func (cfg *ApiConfig) publishScheduledChirp(ctx context.Context, item scheduler.Item) error {
+	err := cfg.db.CheckNotSuspended(ctx, item.AuthorID)
+	if errors.Is(err, db.ErrForbidden) {
+		return fmt.Errorf("%w: %v", scheduler.ErrRejected, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	validatedChirp, moderationResult, err := cfg.validateChirp(db.Chirp{Body: item.Body})
+	if err != nil {
+		return fmt.Errorf("%w: %v", scheduler.ErrRejected, err)
+	}
+
+	chirp, err := cfg.db.PublishDraft(ctx, item.ID, item.Version, validatedChirp.Body)
+	if errors.Is(err, db.ErrDraftChanged) {
+		// edited, canceled or published by another instance since it was claimed
+		logging.FromContext(ctx).Info("skip changed scheduled chirp", "draft_id", item.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cfg.announceChirp(ctx, chirp, moderationResult)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/db"
+	"server/jwt"
+	"server/logging"
+	"server/validation"
+	"strings"
+)
+
+// errorResponse is the body of every error response
+//
+//	{"error": "chirp not found", "code": "not_found", "request_id": "..."}
+//
+// validation errors also list the invalid fields
+type errorResponse struct {
+	Error     string          `json:"error"`
+	Code      string          `json:"code"`
+	RequestID string          `json:"request_id,omitempty"`
+	Fields    []db.FieldError `json:"fields,omitempty"`
+}
+
+// errorCodes are the machine readable codes of the error responses
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorCode returns the code of a status, e.g. "not_found" for 404
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// respondWithError 函数接收一个 http.ResponseWriter 对象、状态码和消息作为参数，
+// 设置响应头的 Content-Type 为 application/json; charset=utf-8，
+// 设置状态码并返回错误信息的 JSON 格式。
+func respondWithError(w http.ResponseWriter, code int, msg string) {
+	writeError(w, code, errorResponse{Error: msg})
+}
+
+// respondWithErr answers with the status that matches the kind of err.
+// Only the message of expected errors is returned, unexpected errors are logged and answered with 500.
+func respondWithErr(w http.ResponseWriter, r *http.Request, err error) {
+	status, msg := errorStatus(err)
+
+	body := errorResponse{Error: msg}
+	var dbInvalid *db.ValidationError
+	var invalid validation.Errors
+	switch {
+	case errors.As(err, &dbInvalid):
+		body.Fields = dbInvalid.Fields
+	case errors.As(err, &invalid):
+		body.Fields = invalid
+	}
+
+	if status == http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error("request failed", "err", err)
+	}
+
+	writeError(w, status, body)
+}
+
+// errorStatus maps the errors of the db and jwt packages to a status code and a message
+func errorStatus(err error) (int, string) {
+	var dbInvalid *db.ValidationError
+	var invalid validation.Errors
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &dbInvalid), errors.As(err, &invalid):
+		return http.StatusUnprocessableEntity, "invalid request"
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit)
+	case errors.Is(err, errMalformedBody):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, db.ErrGone):
+		return http.StatusGone, err.Error()
+	case errors.Is(err, db.ErrUnauthorized), errors.Is(err, jwt.ErrInvalidToken):
+		return http.StatusUnauthorized, err.Error()
+	case errors.Is(err, db.ErrForbidden):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, db.ErrInvalid):
+		return http.StatusBadRequest, err.Error()
+	case dbUnavailable(err):
+		return http.StatusServiceUnavailable, "database unavailable, try again later"
+	default:
+		return http.StatusInternalServerError, "internal server error"
+	}
+}
+
+// dbUnavailable reports whether a db operation timed out or was canceled
+func dbUnavailable(err error) bool {
+	return errors.Is(err, db.ErrTimeout) || errors.Is(err, db.ErrCanceled)
+}
+
+// writeError writes the error envelope, the request id comes from the header set by logRequests
+func writeError(w http.ResponseWriter, status int, body errorResponse) {
+	body.Code = errorCode(status)
+	body.RequestID = w.Header().Get(logging.RequestIDHeader)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
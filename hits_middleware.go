@@ -1 +1,39 @@
 package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// middlewareMetricsInc counts the requests served by the file server
+func (cfg *ApiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.metrics.HitFileserver()
+
+		next.ServeHTTP(w, r) // 继续处理请求
+	})
+}
+
+// instrument records the count, latency and in-flight requests of every route of mux
+func (cfg *ApiConfig) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+
+		done := cfg.metrics.RequestStarted(routeLabel(pattern), r.Method)
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		done(rec.Status())
+	})
+}
+
+// routeLabel turns a mux pattern such as "GET /api/chirps/{chirpID}" into its path,
+// requests that match no route share one label to keep the number of series bounded
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	return pattern
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"server/logging"
+	"server/media"
+	"server/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	assetsDir = "assets"
+
+	// blobs have random keys and never change
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	// assets keep their name when they change, clients revalidate with the ETag
+	assetCacheControl = "public, max-age=86400"
+)
+
+// imageSource describes where the original image of a request comes from
+type imageSource struct {
+	// id identifies the content of the original, it changes when the content changes
+	id        string
+	immutable bool
+	modTime   time.Time
+	read      func() ([]byte, error)
+}
+
+// imageHandler serves uploaded images and assets, resized to the variant picked by ?w=.
+// It is the only way to read local blobs, they aren't under the /app/ file server.
+// GET /api/images/chirps/3f2a.jpg?w=150
+// GET /api/images/assets/logo.png?w=600
+func (cfg *ApiConfig) imageHandler(w http.ResponseWriter, r *http.Request) {
+	source, err := cfg.openImageSource(r.Context(), r.PathValue("path"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "image not found")
+		return
+	}
+
+	requested := 0
+	if width := r.URL.Query().Get("w"); width != "" {
+		requested, err = strconv.Atoi(width)
+		if err != nil || requested < 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid width")
+			return
+		}
+	}
+	variant := media.VariantWidth(requested)
+
+	variantID := imageVariantID(source.id, variant)
+	sum := sha256.Sum256([]byte(variantID))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	if source.immutable {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", assetCacheControl)
+	}
+	w.Header().Set("ETag", etag)
+
+	// answer revalidations before touching the image
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var data []byte
+	if variant == 0 {
+		data, err = source.read()
+	} else {
+		data, err = cfg.variants.Get(variantID, func() ([]byte, error) {
+			original, err := source.read()
+			if err != nil {
+				return nil, err
+			}
+			resized, _, ok, err := media.Resize(original, variant)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// the original is already narrow enough
+				return original, nil
+			}
+			return resized, nil
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "image not found")
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		respondWithError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	http.ServeContent(w, r, "", source.modTime, bytes.NewReader(data))
+}
+
+// openImageSource resolves paths under assets/ to the assets directory
+// and everything else to the blob store
+func (cfg *ApiConfig) openImageSource(ctx context.Context, p string) (imageSource, error) {
+	if p == "" || path.Clean(p) != p || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+		return imageSource{}, errors.New("invalid image path")
+	}
+
+	if rel, ok := strings.CutPrefix(p, assetsDir+"/"); ok {
+		name := filepath.Join(assetsDir, filepath.FromSlash(rel))
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			return imageSource{}, errors.New("image not found")
+		}
+		return imageSource{
+			id:      fmt.Sprintf("asset:%s:%d:%d", p, info.Size(), info.ModTime().UnixNano()),
+			modTime: info.ModTime(),
+			read: func() ([]byte, error) {
+				return os.ReadFile(name)
+			},
+		}, nil
+	}
+
+	// only attachments of live chirps and avatars of live accounts are served, the cached
+	// variants of a deleted blob could outlive it
+	exists, err := cfg.db.BlobVisible(ctx, p)
+	if err != nil {
+		return imageSource{}, err
+	}
+	if !exists {
+		return imageSource{}, errors.New("image not found")
+	}
+
+	return imageSource{
+		id:        blobImageID(p),
+		immutable: true,
+		read: func() ([]byte, error) {
+			blob, err := cfg.blobs.Get(ctx, p)
+			if err != nil {
+				return nil, err
+			}
+			defer blob.Close()
+			return io.ReadAll(io.LimitReader(blob, maxAttachmentBytes))
+		},
+	}, nil
+}
+
+// imageVariantURLs returns the srcset friendly urls of the variants of a blob
+func imageVariantURLs(key string) map[string]string {
+	return map[string]string{
+		"thumbnail": fmt.Sprintf("/api/images/%s?w=%d", key, media.ThumbnailWidth),
+		"medium":    fmt.Sprintf("/api/images/%s?w=%d", key, media.MediumWidth),
+		"original":  "/api/images/" + key,
+	}
+}
+
+// blobImageID is the imageSource id of a blob
+func blobImageID(key string) string {
+	return "blob:" + key
+}
+
+// imageVariantID identifies a variant of an image in the variant cache
+func imageVariantID(sourceID string, width int) string {
+	return fmt.Sprintf("%s|w=%d", sourceID, width)
+}
+
+// variantEvictingStore removes the cached variants of a blob together with the blob,
+// every path that deletes blobs goes through it
+type variantEvictingStore struct {
+	storage.BlobStore
+	variants *media.VariantCache
+}
+
+func (s variantEvictingStore) Delete(ctx context.Context, key string) error {
+	var ids []string
+	for _, width := range media.VariantWidths() {
+		ids = append(ids, imageVariantID(blobImageID(key), width))
+	}
+	if err := s.variants.Delete(ids...); err != nil {
+		logging.FromContext(ctx).Error("delete image variants", "key", key, "err", err)
+	}
+	return s.BlobStore.Delete(ctx, key)
+}
@@ -1,14 +1,38 @@
 package jwt
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed with the secret
+var ErrInvalidToken = errors.New("invalid token")
+
+// startSpan traces a token operation, the token itself is never recorded
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer("server/jwt").Start(ctx, name)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
 // expire time is 1 hour
 
 
-func CreateJwtToken(userId string, jwtSecret string, expireTimeInSec int64) (string, error) {
+func CreateJwtToken(ctx context.Context, userId string, jwtSecret string, expireTimeInSec int64) (tokenString string, err error) {
+	_, span := startSpan(ctx, "jwt.Create")
+	defer func() { endSpan(span, err) }()
 
 	// expireTime
 	expire := time.Now().Add(time.Duration(expireTimeInSec) * time.Second)
@@ -25,7 +49,7 @@ func CreateJwtToken(userId string, jwtSecret string, expireTimeInSec int64) (str
 
 	// sign token with secret key
 
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	tokenString, err = token.SignedString([]byte(jwtSecret))
 
 	if err != nil {
 		return "", err
@@ -34,25 +58,39 @@ func CreateJwtToken(userId string, jwtSecret string, expireTimeInSec int64) (str
 	return tokenString, nil
 }
 
-func VerifyJwtToken(tokenString string, jwtSecret string) (string, error) {
+func VerifyJwtToken(ctx context.Context, tokenString string, jwtSecret string) (string, error) {
+
+	claims, err := ParseJwtToken(ctx, tokenString, jwtSecret)
+
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Subject, nil
+}
+
+// ParseJwtToken verifies the token and returns all of its claims
+func ParseJwtToken(ctx context.Context, tokenString string, jwtSecret string) (_ *jwt.RegisteredClaims, err error) {
+	_, span := startSpan(ctx, "jwt.Parse")
+	defer func() { endSpan(span, err) }()
 
 	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(jwtSecret), nil
 	})
 
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 
 	if !token.Valid {
-		return "", err
+		return nil, ErrInvalidToken
 	}
 
 	claims, ok := token.Claims.(*jwt.RegisteredClaims)
 
 	if !ok {
-		return "", err
+		return nil, fmt.Errorf("%w: unexpected claims", ErrInvalidToken)
 	}
 
-	return claims.Subject, nil
+	return claims, nil
 }
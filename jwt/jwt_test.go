@@ -1,5 +1,14 @@
 package jwt
 
+import (
+	"context"
+	"errors"
+	"server/tracing"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
 // func TestCreateJwtToken(t *testing.T) {
 // 	type args struct {
 // 		userId          string
@@ -37,3 +46,73 @@ package jwt
 // 		})
 // 	}
 // }
+
+func TestJwtTokenSpans(t *testing.T) {
+	spans, restore := tracing.InMemory()
+	defer restore()
+
+	token, err := CreateJwtToken(context.Background(), "42", "secret", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := VerifyJwtToken(context.Background(), token, "secret")
+	if err != nil || subject != "42" {
+		t.Fatalf("VerifyJwtToken() = %q, %v", subject, err)
+	}
+	if _, err := VerifyJwtToken(context.Background(), token, "other secret"); err == nil {
+		t.Fatal("expected an error for a token signed with another secret")
+	}
+
+	got := spans.GetSpans()
+	want := []struct {
+		name   string
+		status codes.Code
+	}{
+		{"jwt.Create", codes.Unset},
+		{"jwt.Parse", codes.Unset},
+		{"jwt.Parse", codes.Error},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d spans, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Name != w.name || got[i].Status.Code != w.status {
+			t.Errorf("span %d = %s (%v), want %s (%v)", i, got[i].Name, got[i].Status.Code, w.name, w.status)
+		}
+		for _, attr := range got[i].Attributes {
+			if attr.Value.AsString() == token {
+				t.Errorf("span %s records the token", got[i].Name)
+			}
+		}
+	}
+}
+
+func TestVerifyJwtTokenInvalid(t *testing.T) {
+	expired, err := CreateJwtToken(context.Background(), "42", "secret", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := CreateJwtToken(context.Background(), "42", "secret", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+	}{
+		{name: "Malformed", token: "not-a-token", secret: "secret"},
+		{name: "Expired", token: expired, secret: "secret"},
+		{name: "Wrong secret", token: valid, secret: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyJwtToken(context.Background(), tt.token, tt.secret)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("VerifyJwtToken() error = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "Empty header", header: "", keep: false},
+		{name: "Client id", header: "req-123_abc.4:5", keep: true},
+		{name: "Line break", header: "abc\ninjected", keep: false},
+		{name: "Too long", header: strings.Repeat("a", 129), keep: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RequestIDFrom(tt.header)
+			if tt.keep && got != tt.header {
+				t.Errorf("RequestIDFrom(%q) = %q, want the client id", tt.header, got)
+			}
+			if !tt.keep && (got == tt.header || len(got) != 32) {
+				t.Errorf("RequestIDFrom(%q) = %q, want a generated id", tt.header, got)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithLogger(context.Background(), logger.With("request_id", "abc"))
+	FromContext(ctx).Info("hidden")
+	FromContext(ctx).Warn("shown")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q", buf.String())
+	}
+	if line["msg"] != "shown" || line["request_id"] != "abc" {
+		t.Errorf("unexpected log line %v", line)
+	}
+
+	if _, err := New(&buf, "xml", ""); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := New(&buf, "text", "loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"server/logging"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestInfoKey contextKey = "requestInfo"
+
+// requestInfo is filled in while the request is handled and ends up in the access log
+type requestInfo struct {
+	userID int
+}
+
+// logRequests gives every request an id and a request scoped logger,
+// then writes one access log line when the request is done
+func (cfg *ApiConfig) logRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// keep the id of the caller so logs can be followed across services
+		requestID := logging.RequestIDFrom(r.Header.Get(logging.RequestIDHeader))
+		w.Header().Set(logging.RequestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		info := &requestInfo{}
+
+		ctx := logging.WithRequestID(r.Context(), requestID)
+		ctx = logging.WithLogger(ctx, logger)
+		ctx = context.WithValue(ctx, requestInfoKey, info)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		_, pattern := mux.Handler(r)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", routeLabel(pattern)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.Status()),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if info.userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userID))
+		}
+
+		level := slog.LevelInfo
+		if rec.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// withRequestUser records the authenticated user for the access log and the request logger
+func withRequestUser(ctx context.Context, userID int) context.Context {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.userID = userID
+	}
+	return logging.WithLogger(ctx, logging.FromContext(ctx).With("user_id", userID))
+}
@@ -1,15 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"server/accounts"
+	"server/audit"
 	"server/db"
-	"server/jwt"
+	"server/logging"
+	"server/mailer"
+	"server/media"
+	"server/metrics"
+	"server/moderation"
+	"server/pubsub"
+	"server/retention"
+	"server/scheduler"
+	"server/signature"
+	"server/storage"
+	"server/tracing"
+	"server/webhooks"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -17,7 +38,21 @@ import (
 func main() {
 	// Load environment variables from.env file
 	godotenv.Load()
-	fmt.Println("Starting server...")
+
+	// LOG_FORMAT is json or text, LOG_LEVEL is debug, info, warn or error
+	logger, err := logging.New(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		panic(err)
+	}
+	slog.SetDefault(logger)
+	slog.Info("starting server")
+
+	// TRACE_EXPORTER is otlp, stdout or none
+	shutdownTracing, err := tracing.Setup(context.Background(), os.Getenv("TRACE_EXPORTER"), "chirpy")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	mux := http.NewServeMux()
 	server := http.Server{
@@ -27,11 +62,18 @@ func main() {
 
 	connStr := "postgresql://localhost:5432/chirps?sslmode=disable"
 
+	// DB_TIMEOUT is the default query timeout, DB_TIMEOUTS overrides it per operation
+	dbTimeouts, err := loadDBTimeouts()
+	if err != nil {
+		panic(err)
+	}
+
 	db, err := db.NewDB(connStr)
 
 	if err != nil {
 		panic(err)
 	}
+	db.Timeouts = dbTimeouts
 
 	defer db.DataBase.Close()
 
@@ -49,40 +91,232 @@ func main() {
 		panic(err)
 	}
 
+	blobs, err := newBlobStore()
+	if err != nil {
+		panic(err)
+	}
+
+	variants, err := newVariantCache()
+	if err != nil {
+		panic(err)
+	}
+	// deleting a blob also removes its resized variants
+	blobs = variantEvictingStore{BlobStore: blobs, variants: variants}
+
+	// 内容审核规则, 文件修改后自动重新加载
+	moderationRulesFile, err := moderationRulesPath()
+	if err != nil {
+		panic(err)
+	}
+	moderationRules, err := moderation.LoadRules(moderationRulesFile)
+	if err != nil {
+		panic(err)
+	}
+	moderationPipeline := moderation.NewPipeline(moderationRules)
+	go moderation.WatchRules(context.Background(), moderationPipeline, moderationRulesFile, 5*time.Second)
+
+	// 举报数达到阈值时自动隐藏 chirp
+	reportHideThreshold := 3
+	if threshold := os.Getenv("REPORT_HIDE_THRESHOLD"); threshold != "" {
+		reportHideThreshold, err = strconv.Atoi(threshold)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// polka webhooks are signed with POLKA_WEBHOOK_SECRET
+	polkaSignatureTolerance := 5 * time.Minute
+	if tolerance := os.Getenv("POLKA_SIGNATURE_TOLERANCE_SECONDS"); tolerance != "" {
+		seconds, err := strconv.Atoi(tolerance)
+		if err != nil {
+			panic(err)
+		}
+		polkaSignatureTolerance = time.Duration(seconds) * time.Second
+	}
+
+	// prometheus metrics, bcrypt timings are reported by the db layer
+	appMetrics := metrics.New()
+	appMetrics.RegisterDB(db.DataBase, "chirpy")
+	db.ObserveBcrypt = appMetrics.ObserveBcrypt
+	db.ObserveCanceled = appMetrics.DBCanceled
+
+	// outbound webhooks are sent by a background worker
+	dispatcher := webhooks.NewDispatcher(db, nil)
+	go dispatcher.Run(context.Background(), 5*time.Second)
+
+	// deleted accounts can be restored by logging in during the grace period
+	accountDeletionGrace := 30 * 24 * time.Hour
+	if days := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			panic(err)
+		}
+		accountDeletionGrace = time.Duration(n) * 24 * time.Hour
+	}
+
+	// authors can restore their deleted chirps for CHIRP_UNDO_MINUTES,
+	// deleted chirps are purged after CHIRP_RETENTION_DAYS
+	chirpUndoWindow := 5 * time.Minute
+	if minutes := os.Getenv("CHIRP_UNDO_MINUTES"); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil {
+			panic(err)
+		}
+		chirpUndoWindow = time.Duration(n) * time.Minute
+	}
+	chirpRetention := 30 * 24 * time.Hour
+	if days := os.Getenv("CHIRP_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			panic(err)
+		}
+		chirpRetention = time.Duration(n) * 24 * time.Hour
+	}
+	chirpPurger := retention.NewPurger(db, blobs, chirpRetention)
+	go chirpPurger.Run(context.Background(), time.Hour)
+
+	// data exports are built and deleted accounts are purged by a background worker
+	exports, err := newExportStore()
+	if err != nil {
+		panic(err)
+	}
+	accountsWorker := accounts.NewWorker(db, blobs, exports)
+	go accountsWorker.Run(context.Background(), time.Minute)
+
+	// the number of proxies that append to X-Forwarded-For, TRUST_PROXY_HEADERS=true means one
+	trustedProxyHops := 0
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		trustedProxyHops = 1
+	}
+	if hops := os.Getenv("TRUSTED_PROXY_HOPS"); hops != "" {
+		trustedProxyHops, err = strconv.Atoi(hops)
+		if err != nil || trustedProxyHops < 0 {
+			panic(fmt.Errorf("invalid TRUSTED_PROXY_HOPS %q", hops))
+		}
+	}
+
 	apiConfig := ApiConfig{
-		fileserverHits:          0,
-		mu:                      sync.Mutex{},
+		metrics:                 appMetrics,
 		db:                      *db,
 		JwtSecret:               os.Getenv("JWT_SECRET"),
 		JwtExpireSec:            jwtExpireSec,
 		UserFreshTokenExpireSec: userFreshTokenExpireSec,
+		hub:                     pubsub.NewBroker(256, 64),
+		blobs:                   blobs,
+		exports:                 exports,
+		variants:                variants,
+		moderation:              moderationPipeline,
+		ReportHideThreshold:     reportHideThreshold,
+		PolkaApiKey:             os.Getenv("POLKA_API_KEY"),
+		PolkaWebhookSecret:      os.Getenv("POLKA_WEBHOOK_SECRET"),
+		PolkaSignatureTolerance: polkaSignatureTolerance,
+		PolkaRequireSignature:   os.Getenv("POLKA_REQUIRE_SIGNATURE") == "true",
+		mailer:                  newMailer(),
+		AccountDeletionGrace:    accountDeletionGrace,
+		ChirpUndoWindow:         chirpUndoWindow,
+		TrustedProxyHops:        trustedProxyHops,
 	}
 
-	mux.Handle("/app/*", http.StripPrefix("/app", apiConfig.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
+	// scheduled chirps are published by a background scheduler, every instance runs one
+	chirpScheduler := scheduler.NewScheduler(db, apiConfig.publishScheduledChirp)
+	go chirpScheduler.Run(context.Background(), 10*time.Second)
+
+	mux.Handle("/app/*", http.StripPrefix("/app", apiConfig.middlewareMetricsInc(http.FileServer(noListingFS{http.Dir(".")}))))
 	mux.HandleFunc("GET /api/healthz", healthzHandler)
 	mux.HandleFunc("GET /api/metrics", apiConfig.metricsHandler)
+	mux.Handle("GET /metrics", appMetrics.Handler())
 	mux.HandleFunc("GET /admin/metrics", apiConfig.handleAdminMetrics)
 	mux.HandleFunc("/api/reset", apiConfig.resetMetrics)
 
 	mux.Handle("POST /api/chirps", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.CreateChirpHandler)))
 	mux.HandleFunc("GET /api/chirps", apiConfig.getChirpsHandler)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", apiConfig.getChirpByIDHandler)
+	// GET /api/chirps/stream
+	mux.HandleFunc("GET /api/chirps/stream", apiConfig.streamChirpsHandler)
 
 	mux.HandleFunc("POST /api/users", apiConfig.CreateUserHandler)
 	//  LOGIN POST /api/login
 	mux.HandleFunc("POST /api/login", apiConfig.LoginUserHandler)
 	// PUT /api/users
-	mux.HandleFunc("PUT /api/users", apiConfig.UpdateUserHandler)
+	mux.Handle("PUT /api/users", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UpdateUserHandler)))
+	// PATCH /api/users
+	mux.Handle("PATCH /api/users", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UpdateUserHandler)))
+	// POST /api/users/verify-email
+	mux.HandleFunc("POST /api/users/verify-email", apiConfig.VerifyEmailHandler)
+	mux.Handle("POST /api/users/verify-email/resend", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.ResendEmailVerificationHandler)))
+	// GET /api/users/me/export
+	mux.Handle("GET /api/users/me/export", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.ExportDataHandler)))
+	// DELETE /api/users/me
+	mux.Handle("DELETE /api/users/me", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.DeleteAccountHandler)))
+	// PUT /api/users/avatar
+	mux.Handle("PUT /api/users/avatar", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UpdateAvatarHandler)))
+	mux.Handle("DELETE /api/users/avatar", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.DeleteAvatarHandler)))
+	// GET /api/users/{handle}
+	mux.HandleFunc("GET /api/users/{handle}", apiConfig.GetProfileHandler)
+	// POST /api/users/{handle}/follow
+	mux.Handle("POST /api/users/{handle}/follow", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.FollowHandler)))
+	mux.Handle("DELETE /api/users/{handle}/follow", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UnfollowHandler)))
 	// POST /api/refresh
 	mux.HandleFunc("POST /api/refresh", apiConfig.RefreshTokenHandler)
 	// POST /api/revoke
 	mux.HandleFunc("POST /api/revoke", apiConfig.RevokeTokenHandler)
 	// DELETE /api/chirps/{chirpID}
 	mux.Handle("DELETE /api/chirps/{chirpID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.deleteChirpByIDHandler)))
+	// drafts and scheduled chirps
+	mux.Handle("POST /api/drafts", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.CreateDraftHandler)))
+	mux.Handle("GET /api/drafts", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetDraftsHandler)))
+	mux.Handle("GET /api/drafts/{draftID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetDraftHandler)))
+	mux.Handle("PATCH /api/drafts/{draftID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UpdateDraftHandler)))
+	mux.Handle("DELETE /api/drafts/{draftID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.DeleteDraftHandler)))
+	mux.Handle("DELETE /api/drafts/{draftID}/schedule", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UnscheduleDraftHandler)))
+	mux.Handle("POST /api/drafts/{draftID}/publish", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.PublishDraftHandler)))
+	// POST /api/chirps/{chirpID}/restore
+	mux.Handle("POST /api/chirps/{chirpID}/restore", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.undoDeleteChirpHandler)))
+	mux.Handle("POST /api/admin/chirps/{chirpID}/restore", apiConfig.requireRole(apiConfig.auditAdmin("chirp_restore", http.HandlerFunc(apiConfig.restoreChirpHandler)), roleAdmin))
+	// direct messages
+	mux.Handle("POST /api/conversations", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.CreateConversationHandler)))
+	mux.Handle("GET /api/conversations", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetConversationsHandler)))
+	mux.Handle("POST /api/conversations/{conversationID}/messages", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.CreateMessageHandler)))
+	mux.Handle("GET /api/conversations/{conversationID}/messages", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetMessagesHandler)))
+	mux.Handle("POST /api/conversations/{conversationID}/read", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.MarkConversationReadHandler)))
+	mux.Handle("GET /api/blocks", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetBlockedUsersHandler)))
+	mux.Handle("POST /api/blocks", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.BlockUserHandler)))
+	mux.Handle("DELETE /api/blocks/{userID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.UnblockUserHandler)))
+	// GET /api/images/{path...}?w=150
+	mux.HandleFunc("GET /api/images/{path...}", apiConfig.imageHandler)
+	// suspensions and bans
+	mux.Handle("POST /api/admin/users/{userID}/suspension", apiConfig.requireRole(apiConfig.auditAdmin("user_suspend", http.HandlerFunc(apiConfig.SuspendUserHandler)), roleAdmin))
+	mux.Handle("DELETE /api/admin/users/{userID}/suspension", apiConfig.requireRole(apiConfig.auditAdmin("user_suspension_lift", http.HandlerFunc(apiConfig.LiftSuspensionHandler)), roleAdmin))
+	mux.Handle("GET /api/admin/users/{userID}/suspensions", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetSuspensionsHandler), roleAdmin))
+	mux.Handle("GET /api/admin/users/duplicate-emails", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetDuplicateEmailsHandler), roleAdmin))
+	// reports and moderation queue
+	mux.Handle("POST /api/chirps/{chirpID}/report", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.ReportChirpHandler)))
+	mux.Handle("GET /api/moderation/queue", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetModerationQueueHandler), roleModerator, roleAdmin))
+	mux.Handle("POST /api/moderation/chirps/{chirpID}", apiConfig.requireRole(apiConfig.auditAdmin("chirp_moderate", http.HandlerFunc(apiConfig.ModerateChirpHandler)), roleModerator, roleAdmin))
+	mux.Handle("GET /api/moderation/actions", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetModerationActionsHandler), roleModerator, roleAdmin))
+	// GET /api/ws
+	mux.HandleFunc("GET /api/ws", apiConfig.wsHandler)
 	// POST /API/POLKA/WEBHOOKS
-	mux.Handle("POST /api/polka/webhooks", apiConfig.authenticationPolkaWebhookMiddleware(http.HandlerFunc(apiConfig.PolkaWebhookHandler)))
-
-	fmt.Println("Server running on port 8080")
+	mux.Handle("POST /api/polka/webhooks", apiConfig.webhookLogMiddleware("polka", apiConfig.authenticationPolkaWebhookMiddleware(http.HandlerFunc(apiConfig.PolkaWebhookHandler))))
+	// outbound webhooks
+	mux.Handle("POST /api/webhooks", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.CreateOutboundWebhookHandler)))
+	mux.Handle("GET /api/webhooks", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetOutboundWebhooksHandler)))
+	mux.Handle("DELETE /api/webhooks/{webhookID}", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.DeleteOutboundWebhookHandler)))
+	mux.Handle("GET /api/webhooks/{webhookID}/deliveries", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.GetOutboundDeliveriesHandler)))
+	mux.Handle("POST /api/webhooks/{webhookID}/deliveries/{deliveryID}/retry", apiConfig.authenticationMiddleware(http.HandlerFunc(apiConfig.RetryOutboundDeliveryHandler)))
+	// inbound webhook log
+	mux.Handle("GET /api/admin/webhooks/deliveries", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetWebhookDeliveriesHandler), roleAdmin))
+	mux.Handle("GET /api/admin/webhooks/deliveries/{deliveryID}", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetWebhookDeliveryHandler), roleAdmin))
+	mux.Handle("POST /api/admin/webhooks/deliveries/{deliveryID}/replay", apiConfig.requireRole(apiConfig.auditAdmin("webhook_replay", http.HandlerFunc(apiConfig.ReplayWebhookDeliveryHandler)), roleAdmin))
+	// audit log
+	mux.Handle("GET /api/admin/audit", apiConfig.requireRole(http.HandlerFunc(apiConfig.GetAuditLogHandler), roleAdmin))
+	mux.Handle("GET /api/admin/audit/export", apiConfig.requireRole(apiConfig.auditAdmin("audit_export", http.HandlerFunc(apiConfig.ExportAuditLogHandler)), roleAdmin))
+	mux.Handle("GET /api/admin/audit/verify", apiConfig.requireRole(http.HandlerFunc(apiConfig.VerifyAuditLogHandler), roleAdmin))
+
+	slog.Info("server running", "addr", server.Addr)
+
+	// trace, log and record metrics for every request
+	server.Handler = apiConfig.traceRequests(mux, apiConfig.logRequests(mux, apiConfig.instrument(mux)))
 
 	err = server.ListenAndServe()
 
@@ -91,14 +325,167 @@ func main() {
 	}
 }
 
-// respondWithError 函数接收一个 http.ResponseWriter 对象、状态码和消息作为参数，
-// 设置响应头的 Content-Type 为 application/json; charset=utf-8，
-// 设置状态码并返回错误信息的 JSON 格式。
-func respondWithError(w http.ResponseWriter, code int, msg string) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-	w.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, msg)))
+// newMailer sends emails through SMTP_ADDR, without it they are only logged
+func newMailer() mailer.Mailer {
+	if os.Getenv("SMTP_ADDR") == "" {
+		return mailer.LogMailer{}
+	}
+	return &mailer.SMTPMailer{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// newBlobStore 根据环境变量 BLOB_STORE 创建附件存储, 默认保存在本地 UPLOADS_DIR 目录,
+// 它必须在 /app/ 文件服务器之外, 由 imageHandler 检查 chirp 没有被删除或隐藏后提供访问
+func newBlobStore() (storage.BlobStore, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "local":
+		dir := os.Getenv("UPLOADS_DIR")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("set UPLOADS_DIR: %w", err)
+			}
+			dir = filepath.Join(home, ".local", "share", "chirpy", "uploads")
+		}
+		if err := checkOutsideFileServer("UPLOADS_DIR", dir); err != nil {
+			return nil, err
+		}
+		return storage.NewLocalStore(dir, "/api/images")
+	case "s3":
+		return &storage.S3Store{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			Region:          os.Getenv("S3_REGION"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicURL:       os.Getenv("S3_PUBLIC_URL"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", os.Getenv("BLOB_STORE"))
+	}
+}
 
+// moderationRulesPath returns MODERATION_RULES_FILE, by default moderation_rules.txt in the user
+// config directory. The file must be outside the directory served under /app/ so the denylist
+// stays private, the default rules are used until it exists.
+func moderationRulesPath() (string, error) {
+	file := os.Getenv("MODERATION_RULES_FILE")
+	if file == "" {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("set MODERATION_RULES_FILE: %w", err)
+		}
+		file = filepath.Join(config, "chirpy", "moderation_rules.txt")
+	}
+	if err := checkOutsideFileServer("MODERATION_RULES_FILE", file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// newVariantCache keeps the resized images in IMAGE_CACHE_DIR, which must be outside the directory
+// served under /app/ because the variants of hidden chirps stay in the cache
+func newVariantCache() (*media.VariantCache, error) {
+	dir := os.Getenv("IMAGE_CACHE_DIR")
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("set IMAGE_CACHE_DIR: %w", err)
+		}
+		dir = filepath.Join(cache, "chirpy", "images")
+	}
+	if err := checkOutsideFileServer("IMAGE_CACHE_DIR", dir); err != nil {
+		return nil, err
+	}
+	return media.NewVariantCache(dir)
+}
+
+// newExportStore creates the private store of the data export archives.
+// Locally they are kept in EXPORTS_DIR, which must be outside the directory served under /app/,
+// on S3 in S3_EXPORTS_BUCKET, which is required and must be a bucket that isn't public.
+func newExportStore() (storage.BlobStore, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "local":
+		dir := os.Getenv("EXPORTS_DIR")
+		if dir == "" {
+			cache, err := os.UserCacheDir()
+			if err != nil {
+				return nil, fmt.Errorf("set EXPORTS_DIR: %w", err)
+			}
+			dir = filepath.Join(cache, "chirpy", "exports")
+		}
+		if err := checkOutsideFileServer("EXPORTS_DIR", dir); err != nil {
+			return nil, err
+		}
+		return storage.NewLocalStore(dir, "")
+	case "s3":
+		if os.Getenv("S3_EXPORTS_BUCKET") == "" {
+			return nil, errors.New("S3_EXPORTS_BUCKET is required, data exports must not be public")
+		}
+		return &storage.S3Store{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Bucket:          os.Getenv("S3_EXPORTS_BUCKET"),
+			Region:          os.Getenv("S3_REGION"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", os.Getenv("BLOB_STORE"))
+	}
+}
+
+// checkOutsideFileServer returns an error when dir, set by the variable name, would be served
+// by the /app/ file server
+func checkOutsideFileServer(name string, dir string) error {
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s %q is inside the directory served under /app/", name, dir)
+	}
+	return nil
+}
+
+// noListingFS hides the directories without an index.html from the /app/ file server,
+// so their content can't be listed, and dot files such as .env
+type noListingFS struct {
+	http.FileSystem
+}
+
+func (fsys noListingFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := fsys.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
 }
 
 // respondWithJSON 函数接收一个 http.ResponseWriter 对象、状态码以及一个任意类型的数据作为参数，
@@ -115,41 +502,60 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error
 	return nil
 }
 
-// middlewareMetricsInc increments the fileserverHits counter for each request
-func (cfg *ApiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.mu.Lock()
-		cfg.fileserverHits += 1
-		cfg.mu.Unlock()
-
-		fmt.Println("Middleware Metrics Inc")
-		fmt.Println("Fileserver Hits:", cfg.fileserverHits)
-
-		next.ServeHTTP(w, r) // 继续处理请求
-	})
-}
+// maxWebhookBodyBytes limits the size of inbound webhook payloads
+const maxWebhookBodyBytes = 1 << 20
 
-// authenticationPolkaWebhookMiddleware function to check if the polka webhook is authenticated
+// authenticationPolkaWebhookMiddleware function to check if the polka webhook is authenticated.
+// Deliveries are signed with HMAC-SHA256 over the timestamp and the raw body.
+// During the migration the static "Authorization: ApiKey <key>" header is still accepted
+// for unsigned deliveries unless POLKA_REQUIRE_SIGNATURE is set.
 func (cfg *ApiConfig) authenticationPolkaWebhookMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// get token from header
-		key, err := GetPolkaApiKeyFromHeader(r)
+		// read the raw body, the signature covers the exact bytes
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, err.Error())
+			respondWithError(w, http.StatusRequestEntityTooLarge, "body too large")
 			return
 		}
-
-		// validate key with polka api key
-		apiKey := os.Getenv("POLKA_API_KEY")
-		
-		if key != apiKey {
-			respondWithError(w, http.StatusUnauthorized, "Invalid polka api key")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sig := r.Header.Get(polkaSignatureHeader)
+
+		switch {
+		case sig != "" && cfg.PolkaWebhookSecret != "":
+			err = signature.Verify(cfg.PolkaWebhookSecret, sig, r.Header.Get(polkaTimestampHeader), body, time.Now(), cfg.PolkaSignatureTolerance)
+			if err != nil {
+				rejectWebhook(w, r, "signature", err.Error())
+				return
+			}
+			annotateWebhook(r, func(d *db.WebhookDelivery) {
+				d.Verified = true
+				d.VerificationMethod = "signature"
+			})
+
+		case cfg.PolkaRequireSignature:
+			rejectWebhook(w, r, "signature", "missing signature")
 			return
-		}
 
-		// Otherwise, continue with the request
-		fmt.Println("polka webhook authenticated")
+		default:
+			// get token from header
+			key, err := GetPolkaApiKeyFromHeader(r)
+			if err != nil {
+				rejectWebhook(w, r, "api_key", err.Error())
+				return
+			}
+
+			// validate key with polka api key in constant time
+			if cfg.PolkaApiKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(cfg.PolkaApiKey)) != 1 {
+				rejectWebhook(w, r, "api_key", "Invalid polka api key")
+				return
+			}
+			annotateWebhook(r, func(d *db.WebhookDelivery) {
+				d.Verified = true
+				d.VerificationMethod = "api_key"
+			})
+		}
 
 		next.ServeHTTP(w, r)
 
@@ -157,6 +563,15 @@ func (cfg *ApiConfig) authenticationPolkaWebhookMiddleware(next http.Handler) ht
 
 }
 
+// rejectWebhook answers 401 and records why the delivery failed verification
+func rejectWebhook(w http.ResponseWriter, r *http.Request, method string, msg string) {
+	annotateWebhook(r, func(d *db.WebhookDelivery) {
+		d.VerificationMethod = method
+		d.VerificationError = msg
+	})
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
+
 type contextKey string
 
 const userIDKey contextKey = "userID"
@@ -168,37 +583,19 @@ func (cfg *ApiConfig) authenticationMiddleware(next http.Handler) http.Handler {
 		// get token from header
 		token, err := GetTokenFromHeader(r)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, err.Error())
+			respondWithErr(w, r, err)
 			return
 		}
 
-		// validate token
-
-		userIDStr, err := jwt.VerifyJwtToken(token, cfg.JwtSecret)
+		// validate token, the user must exist and not be suspended
+		userID, _, err := cfg.authenticateToken(r.Context(), token)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, err.Error())
+			respondWithErr(w, r, err)
 			return
 		}
 
-		// convert the user id from string to int
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, err.Error())
-			return
-		}
-		// check if the user exists in the database
-
-		_, err = cfg.db.GetUserByID(userID)
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, "User not found")
-			return
-		}
-
-		// Otherwise, continue with the request
-		fmt.Println("user authenticated, user id:", userID)
-
 		// save user id in the request context
-		ctx := r.Context()
+		ctx := withRequestUser(r.Context(), userID)
 		ctx = context.WithValue(ctx, userIDKey, userID)
 		r = r.WithContext(ctx)
 
@@ -206,9 +603,64 @@ func (cfg *ApiConfig) authenticationMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// user roles
+const (
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// requireRole wraps authenticationMiddleware and only lets users with one of the roles through,
+// the other users are recorded in the audit log
+func (cfg *ApiConfig) requireRole(next http.Handler, roles ...string) http.Handler {
+	return cfg.authenticationMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(userIDKey).(int)
+
+		role, err := cfg.db.GetUserRole(r.Context(), userID)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		cfg.audit(r, audit.Entry{
+			Action:  actionRoleDenied,
+			ActorID: &userID,
+			Outcome: audit.OutcomeDenied,
+			Details: map[string]string{"method": r.Method, "path": r.URL.Path, "role": role},
+		})
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+	}))
+}
+
 // healthzHandler returns a simple "OK" response for health checks
 func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
+
+// loadDBTimeouts reads DB_TIMEOUT (e.g. "5s") and DB_TIMEOUTS (e.g. "GetModerationQueue=10s,ClaimDueDeliveries=2s")
+func loadDBTimeouts() (db.Timeouts, error) {
+	timeouts := db.Timeouts{Default: db.DefaultTimeout}
+	if timeout := os.Getenv("DB_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return db.Timeouts{}, fmt.Errorf("invalid DB_TIMEOUT %q", timeout)
+		}
+		timeouts.Default = d
+	}
+
+	operations, err := db.ParseTimeouts(os.Getenv("DB_TIMEOUTS"))
+	if err != nil {
+		return db.Timeouts{}, fmt.Errorf("invalid DB_TIMEOUTS: %w", err)
+	}
+	timeouts.Operations = operations
+
+	return timeouts, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNoListingFS(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html":       {Data: []byte("<h1>Chirpy</h1>")},
+		"assets/logo.png":  {Data: []byte("png")},
+		".env":             {Data: []byte("JWT_SECRET=secret")},
+		"docs/index.html":  {Data: []byte("<h1>Docs</h1>")},
+		"docs/.hidden.txt": {Data: []byte("hidden")},
+	}
+	handler := http.StripPrefix("/app", http.FileServer(noListingFS{http.FS(files)}))
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{name: "Index", url: "/app/", want: http.StatusOK},
+		{name: "File", url: "/app/assets/logo.png", want: http.StatusOK},
+		{name: "Directory without index", url: "/app/assets/", want: http.StatusNotFound},
+		{name: "Directory with index", url: "/app/docs/", want: http.StatusOK},
+		{name: "Dot file", url: "/app/.env", want: http.StatusNotFound},
+		{name: "Dot file in a directory", url: "/app/docs/.hidden.txt", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.url, w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// VariantCache keeps generated image variants on disk.
+// Concurrent requests for the same missing variant build it only once.
+type VariantCache struct {
+	dir string
+
+	mu       sync.Mutex
+	inflight map[string]*variantCall
+}
+
+type variantCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// NewVariantCache creates the cache directory if it doesn't exist
+func NewVariantCache(dir string) (*VariantCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &VariantCache{
+		dir:      dir,
+		inflight: make(map[string]*variantCall),
+	}, nil
+}
+
+func (c *VariantCache) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get returns the variant cached under id, calling build to create it on a miss
+func (c *VariantCache) Get(id string, build func() ([]byte, error)) ([]byte, error) {
+	p := c.path(id)
+
+	data, err := os.ReadFile(p)
+	if err == nil {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.inflight[p]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.data, call.err
+	}
+	call := &variantCall{}
+	call.wg.Add(1)
+	c.inflight[p] = call
+	c.mu.Unlock()
+
+	call.data, call.err = build()
+	if call.err == nil {
+		// a failed write only costs a rebuild on the next request
+		writeFileAtomic(p, call.data)
+	}
+	call.wg.Done()
+
+	c.mu.Lock()
+	delete(c.inflight, p)
+	c.mu.Unlock()
+
+	return call.data, call.err
+}
+
+// Delete removes the variants cached under ids, missing variants are ignored
+func (c *VariantCache) Delete(ids ...string) error {
+	var errs []error
+	for _, id := range ids {
+		err := os.Remove(c.path(id))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeFileAtomic(p string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".variant-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,38 @@
+package media
+
+import (
+	"testing"
+)
+
+func TestVariantCacheDelete(t *testing.T) {
+	cache, err := NewVariantCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builds := 0
+	build := func() ([]byte, error) {
+		builds++
+		return []byte("variant"), nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get("blob:a.png|w=150", build); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if builds != 1 {
+		t.Fatalf("builds = %d, want the second Get to hit the cache", builds)
+	}
+
+	// missing variants are ignored
+	if err := cache.Delete("blob:a.png|w=150", "blob:a.png|w=600"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get("blob:a.png|w=150", build); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 2 {
+		t.Errorf("builds = %d, want the deleted variant to be built again", builds)
+	}
+}
@@ -0,0 +1,92 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// Variant widths, anything wider is served as the original
+const (
+	ThumbnailWidth = 150
+	MediumWidth    = 600
+)
+
+// variantWidths must be sorted in ascending order
+var variantWidths = []int{ThumbnailWidth, MediumWidth}
+
+// VariantWidths returns the widths of the resized variants
+func VariantWidths() []int {
+	return append([]int(nil), variantWidths...)
+}
+
+// VariantWidth snaps a requested width to the smallest variant that is at least
+// as wide, it returns 0 when the original should be served
+func VariantWidth(requested int) int {
+	if requested <= 0 {
+		return 0
+	}
+	for _, width := range variantWidths {
+		if requested <= width {
+			return width
+		}
+	}
+	return 0
+}
+
+// Decode decodes an image after checking its size against maxPixels
+func Decode(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrInvalidImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, "", ErrImageTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrInvalidImage
+	}
+	return img, format, nil
+}
+
+// Resize scales the image down to width keeping its aspect ratio.
+// JPEG stays JPEG, everything else is encoded as PNG (only the first frame of a GIF is kept).
+// ok is false when the image is already narrow enough and the original should be used.
+func Resize(data []byte, width int) (out []byte, contentType string, ok bool, err error) {
+	src, format, err := Decode(data)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	bounds := src.Bounds()
+	if width >= bounds.Dx() {
+		return nil, "", false, nil
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	return buf.Bytes(), contentType, true, nil
+}
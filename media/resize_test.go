@@ -0,0 +1,56 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestVariantWidth(t *testing.T) {
+	tests := []struct {
+		requested int
+		want      int
+	}{
+		{requested: 0, want: 0},
+		{requested: 1, want: ThumbnailWidth},
+		{requested: ThumbnailWidth, want: ThumbnailWidth},
+		{requested: ThumbnailWidth + 1, want: MediumWidth},
+		{requested: MediumWidth + 1, want: 0},
+	}
+	for _, tt := range tests {
+		if got := VariantWidth(tt.requested); got != tt.want {
+			t.Errorf("VariantWidth(%d) = %v, want %v", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, contentType, ok, err := Resize(buf.Bytes(), ThumbnailWidth)
+	if err != nil || !ok {
+		t.Fatalf("Resize() ok = %v, error = %v", ok, err)
+	}
+	if contentType != "image/png" {
+		t.Errorf("Resize() content type = %v, want image/png", contentType)
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 150 || config.Height != 100 {
+		t.Errorf("Resize() = %dx%d, want 150x100", config.Width, config.Height)
+	}
+
+	// never upscale
+	_, _, ok, err = Resize(buf.Bytes(), MediumWidth)
+	if err != nil || ok {
+		t.Errorf("Resize() wider than the original ok = %v, error = %v", ok, err)
+	}
+}
@@ -0,0 +1,199 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	_ "image/jpeg" // 注册 jpeg 解码器
+	_ "image/png"  // 注册 png 解码器
+	"net/http"
+)
+
+// maxPixels protects against decompression bombs
+const maxPixels = 40_000_000
+
+var (
+	// ErrUnsupportedType is returned for content that isn't a supported image
+	ErrUnsupportedType = errors.New("unsupported image type")
+	// ErrInvalidImage is returned for images that can't be decoded
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrImageTooLarge is returned for images with too many pixels
+	ErrImageTooLarge = errors.New("image is too large")
+)
+
+// Image is a sanitized upload
+type Image struct {
+	Data        []byte
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+}
+
+// Sanitize detects the image type from its content, never from the file name,
+// and strips metadata such as EXIF, XMP and comments.
+// JPEG and PNG are stripped without re-encoding so the image quality is unchanged.
+func Sanitize(data []byte) (Image, error) {
+	contentType := http.DetectContentType(data)
+
+	var err error
+	img := Image{ContentType: contentType}
+
+	switch contentType {
+	case "image/jpeg":
+		img.Ext = ".jpg"
+		img.Data, err = stripJPEG(data)
+	case "image/png":
+		img.Ext = ".png"
+		img.Data, err = stripPNG(data)
+	case "image/gif":
+		img.Ext = ".gif"
+		img.Data, err = stripGIF(data)
+	default:
+		return Image{}, ErrUnsupportedType
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil || "image/"+format != contentType {
+		return Image{}, ErrInvalidImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return Image{}, ErrImageTooLarge
+	}
+	img.Width = config.Width
+	img.Height = config.Height
+
+	return img, nil
+}
+
+// stripJPEG copies every segment up to the start of scan except
+// APP1 (EXIF, XMP), APP13 (IPTC) and comments
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrInvalidImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, ErrInvalidImage
+		}
+		// skip fill bytes
+		for i+1 < len(data) && data[i+1] == 0xFF {
+			i++
+		}
+		if i+1 >= len(data) {
+			return nil, ErrInvalidImage
+		}
+		marker := data[i+1]
+
+		// markers without a payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, 0xFF, marker)
+			i += 2
+			continue
+		}
+
+		// start of scan, the rest is entropy coded image data
+		if marker == 0xDA {
+			out = append(out, data[i:]...)
+			return out, nil
+		}
+
+		if i+4 > len(data) {
+			return nil, ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrInvalidImage
+		}
+
+		switch marker {
+		case 0xE1, 0xED, 0xFE:
+			// metadata, drop it
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	return nil, ErrInvalidImage
+}
+
+// pngMetadataChunks are dropped from png files
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG copies every chunk except the textual and EXIF metadata ones
+func stripPNG(data []byte) ([]byte, error) {
+	const signatureLen = 8
+	if len(data) < signatureLen {
+		return nil, ErrInvalidImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:signatureLen]...)
+
+	i := signatureLen
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		chunkType := string(data[i+4 : i+8])
+		// length, type, data, crc
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrInvalidImage
+		}
+
+		if !pngMetadataChunks[chunkType] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+
+		if chunkType == "IEND" {
+			return out, nil
+		}
+	}
+
+	return nil, ErrInvalidImage
+}
+
+// stripGIF re-encodes the frames, which drops comment and application extensions
+// but keeps the palette, the delays and the loop count
+func stripGIF(data []byte) ([]byte, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, g)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
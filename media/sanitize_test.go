@@ -0,0 +1,93 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestSanitizeStripsJPEGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 3)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert an APP1 EXIF segment and a comment right after SOI
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x0C}, []byte("Exif\x00\x00GPS!")...)
+	comment := append([]byte{0xFF, 0xFE, 0x00, 0x07}, []byte("hello")...)
+	data := append([]byte{0xFF, 0xD8}, exif...)
+	data = append(data, comment...)
+	data = append(data, buf.Bytes()[2:]...)
+
+	img, err := Sanitize(data)
+	if err != nil {
+		t.Fatalf("Sanitize() error = %v", err)
+	}
+	if img.ContentType != "image/jpeg" || img.Width != 4 || img.Height != 3 {
+		t.Errorf("Sanitize() = %v %dx%d, want image/jpeg 4x3", img.ContentType, img.Width, img.Height)
+	}
+	if bytes.Contains(img.Data, []byte("Exif")) || bytes.Contains(img.Data, []byte("hello")) {
+		t.Errorf("Sanitize() kept the metadata")
+	}
+	if !bytes.Equal(img.Data, buf.Bytes()) {
+		t.Errorf("Sanitize() changed the image data")
+	}
+}
+
+func TestSanitizeStripsPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	// insert a tEXt chunk after IHDR (signature 8 + IHDR chunk 25 bytes)
+	text := []byte("Author\x00me")
+	chunk := []byte{0, 0, 0, byte(len(text))}
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	data := append([]byte{}, original[:33]...)
+	data = append(data, chunk...)
+	data = append(data, original[33:]...)
+
+	img, err := Sanitize(data)
+	if err != nil {
+		t.Fatalf("Sanitize() error = %v", err)
+	}
+	if !bytes.Equal(img.Data, original) {
+		t.Errorf("Sanitize() kept the tEXt chunk")
+	}
+}
+
+func TestSanitizeSniffsContent(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{
+			name: "Text disguised as an image",
+			data: []byte("<html>not an image</html>"),
+			want: ErrUnsupportedType,
+		},
+		{
+			name: "Truncated jpeg",
+			data: []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00},
+			want: ErrInvalidImage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Sanitize(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Sanitize() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"server/db"
+	"server/pubsub"
+	"server/validation"
+	"strconv"
+)
+
+const (
+	messageCreatedEvent = "message.created"
+
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+// CreateConversationHandler starts a one-to-one or group conversation
+// POST /api/conversations {"member_ids": [2, 3]}
+func (cfg *ApiConfig) CreateConversationHandler(w http.ResponseWriter, r *http.Request) {
+	// a conversation has at most 10 members, creator included
+	var params struct {
+		MemberIDs []int `json:"member_ids" validate:"required,max=9"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	conversation, err := cfg.db.CreateConversation(r.Context(), userID, params.MemberIDs)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, conversation)
+}
+
+// GetConversationsHandler lists the conversations of the user with their last message
+// GET /api/conversations
+func (cfg *ApiConfig) GetConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	conversations, err := cfg.db.GetConversations(r.Context(), userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	if conversations == nil {
+		conversations = []db.Conversation{}
+	}
+
+	respondWithJSON(w, http.StatusOK, conversations)
+}
+
+// CreateMessageHandler sends a message to a conversation
+// POST /api/conversations/{conversationID}/messages {"body": "hi"}
+func (cfg *ApiConfig) CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid conversation ID")
+		return
+	}
+
+	var params struct {
+		Body string `json:"body" validate:"required,max=1000"`
+	}
+	err = decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	message, recipients, err := cfg.db.CreateMessage(r.Context(), conversationID, userID, params.Body)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// notify the other members
+	for _, recipient := range recipients {
+		cfg.hub.Publish(pubsub.Event{
+			Type:      messageCreatedEvent,
+			Recipient: recipient,
+			Data:      message,
+		})
+	}
+
+	respondWithJSON(w, http.StatusCreated, message)
+}
+
+// GetMessagesHandler pages through the history of a conversation, newest first
+// GET /api/conversations/{conversationID}/messages?before=100&limit=50
+func (cfg *ApiConfig) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid conversation ID")
+		return
+	}
+
+	beforeID := 0
+	if before := r.URL.Query().Get("before"); before != "" {
+		beforeID, err = strconv.Atoi(before)
+		if err != nil || beforeID < 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid before")
+			return
+		}
+	}
+
+	limit := defaultMessagePageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if limit > maxMessagePageSize {
+			limit = maxMessagePageSize
+		}
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	messages, err := cfg.db.GetMessages(r.Context(), conversationID, userID, beforeID, limit)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, messages)
+}
+
+// MarkConversationReadHandler records a read receipt up to the given message
+// POST /api/conversations/{conversationID}/read {"message_id": 10}
+func (cfg *ApiConfig) MarkConversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(r.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid conversation ID")
+		return
+	}
+
+	var params struct {
+		MessageID int `json:"message_id" validate:"required,min=1"`
+	}
+	err = decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	err = cfg.db.MarkConversationRead(r.Context(), conversationID, userID, params.MessageID)
+	if errors.Is(err, db.ErrUnknownMessage) {
+		// 422 Unprocessable Entity
+		err = validation.Errors{{Field: "message_id", Message: "is not a message of this conversation"}}
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// GetBlockedUsersHandler lists the users whose messages are refused
+// GET /api/blocks
+func (cfg *ApiConfig) GetBlockedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	ids, err := cfg.db.GetBlockedUsers(r.Context(), userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string][]int{"user_ids": ids})
+}
+
+// BlockUserHandler refuses messages from a user
+// POST /api/blocks {"user_id": 2}
+func (cfg *ApiConfig) BlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		UserID int `json:"user_id" validate:"required,min=1"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	if params.UserID == userID {
+		respondWithError(w, http.StatusBadRequest, "can't block yourself")
+		return
+	}
+
+	_, err = cfg.db.GetUserByID(r.Context(), params.UserID)
+	if errors.Is(err, db.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	err = cfg.db.BlockUser(r.Context(), userID, params.UserID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UnblockUserHandler accepts messages from a user again
+// DELETE /api/blocks/{userID}
+func (cfg *ApiConfig) UnblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	blockedUserID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid user ID")
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	err = cfg.db.UnblockUser(r.Context(), userID, blockedUserID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
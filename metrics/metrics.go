@@ -0,0 +1,168 @@
+// Package metrics exposes the server metrics in the Prometheus exposition format.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chirpy"
+
+// Metrics holds the collectors of the server in their own registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+	bcrypt   *prometheus.HistogramVec
+
+	chirpsCreated prometheus.Counter
+	logins        *prometheus.CounterVec
+	webhookEvents *prometheus.CounterVec
+	dbCanceled    *prometheus.CounterVec
+
+	// fileserver hits, reset only moves the baseline so the exported counter never goes down
+	hits     atomic.Uint64
+	hitsBase atomic.Uint64
+}
+
+// New creates and registers every collector, including the Go runtime and process collectors
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route pattern, method and status.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route pattern, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests being served by route pattern and method.",
+		}, []string{"route", "method"}),
+		bcrypt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "bcrypt_duration_seconds",
+			Help:      "Time spent hashing and comparing passwords.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+		}, []string{"op"}),
+		chirpsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "chirps_created_total",
+			Help:      "Chirps created.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts by result.",
+		}, []string{"result"}),
+		webhookEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_events_total",
+			Help:      "Inbound webhook deliveries by source, event and outcome.",
+		}, []string{"source", "event", "outcome"}),
+		dbCanceled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "db_operations_canceled_total",
+			Help:      "Database operations cut short by a timeout or a canceled request.",
+		}, []string{"operation", "reason"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.inFlight,
+		m.bcrypt,
+		m.chirpsCreated,
+		m.logins,
+		m.webhookEvents,
+		m.dbCanceled,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fileserver_hits_total",
+			Help:      "Requests served by the file server.",
+		}, func() float64 { return float64(m.hits.Load()) }),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exports the connection pool stats of db
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RequestStarted marks a request as in flight and returns the function that records it when done
+func (m *Metrics) RequestStarted(route string, method string) func(status int) {
+	start := time.Now()
+	inFlight := m.inFlight.WithLabelValues(route, method)
+	inFlight.Inc()
+
+	return func(status int) {
+		inFlight.Dec()
+		code := strconv.Itoa(status)
+		m.requests.WithLabelValues(route, method, code).Inc()
+		m.duration.WithLabelValues(route, method, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveBcrypt records the duration of a bcrypt operation ("hash" or "compare")
+func (m *Metrics) ObserveBcrypt(op string, d time.Duration) {
+	m.bcrypt.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// ChirpCreated counts a new chirp
+func (m *Metrics) ChirpCreated() {
+	m.chirpsCreated.Inc()
+}
+
+// Login counts a login attempt, result is "success", "failure" or "suspended"
+func (m *Metrics) Login(result string) {
+	m.logins.WithLabelValues(result).Inc()
+}
+
+// WebhookEvent counts an inbound webhook delivery
+func (m *Metrics) WebhookEvent(source string, event string, outcome string) {
+	m.webhookEvents.WithLabelValues(source, event, outcome).Inc()
+}
+
+// DBCanceled counts a database operation that ended with reason "timeout" or "canceled"
+func (m *Metrics) DBCanceled(operation string, reason string) {
+	m.dbCanceled.WithLabelValues(operation, reason).Inc()
+}
+
+// HitFileserver counts a file server request
+func (m *Metrics) HitFileserver() {
+	m.hits.Add(1)
+}
+
+// Hits returns the file server requests since the last reset
+func (m *Metrics) Hits() int {
+	return int(m.hits.Load() - m.hitsBase.Load())
+}
+
+// ResetHits starts counting Hits from zero again
+func (m *Metrics) ResetHits() {
+	m.hitsBase.Store(m.hits.Load())
+}
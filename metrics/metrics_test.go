@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerExposesRequests(t *testing.T) {
+	m := New()
+
+	done := m.RequestStarted("/api/chirps/{chirpID}", http.MethodGet)
+	done(http.StatusNotFound)
+	m.HitFileserver()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		`chirpy_http_requests_total{method="GET",route="/api/chirps/{chirpID}",status="404"} 1`,
+		`chirpy_http_request_duration_seconds_count{method="GET",route="/api/chirps/{chirpID}",status="404"} 1`,
+		`chirpy_http_requests_in_flight{method="GET",route="/api/chirps/{chirpID}"} 0`,
+		`chirpy_fileserver_hits_total 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestResetHitsKeepsCounterMonotonic(t *testing.T) {
+	m := New()
+
+	m.HitFileserver()
+	m.HitFileserver()
+	m.ResetHits()
+	m.HitFileserver()
+
+	if got := m.Hits(); got != 1 {
+		t.Errorf("Hits() = %d, want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "chirpy_fileserver_hits_total 3") {
+		t.Errorf("exported counter went down after a reset")
+	}
+}
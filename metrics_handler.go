@@ -2,20 +2,23 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // metricsHandler returns the number of times Chirpy has been visited
 func (a *ApiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Hits: " + strconv.Itoa(a.fileserverHits)))
+	w.Write([]byte("Hits: " + strconv.Itoa(a.metrics.Hits())))
 }
 
-// resetMetrics resets the fileserverHits counter to 0
+// resetMetrics resets the hits counter to 0, /metrics keeps the total
 func (a *ApiConfig) resetMetrics(w http.ResponseWriter, r *http.Request) {
-	a.fileserverHits = 0
+	a.metrics.ResetHits()
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Metrics reset\n"))
@@ -26,15 +29,32 @@ func (cfg *ApiConfig) handleAdminMetrics(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	//return a html template
-	visitCount := cfg.fileserverHits
+	visitCount := cfg.metrics.Hits()
+
+	// matches per moderation rule
+	counts := cfg.moderation.Counts()
+	rules := make([]string, 0, len(counts))
+	for rule := range counts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	var ruleRows strings.Builder
+	for _, rule := range rules {
+		fmt.Fprintf(&ruleRows, "\t\t\t<tr><td>%s</td><td>%d</td></tr>\n", html.EscapeString(rule), counts[rule])
+	}
+
 	htmlContent := fmt.Sprintf(`
 	<html>
 	<body>
 		<h1>Welcome, Chirpy Admin</h1>
 		<p>Chirpy has been visited %d times!</p>
+		<h2>Moderation rule matches</h2>
+		<table>
+%s		</table>
 	</body>
 	</html>
-`, visitCount)
+`, visitCount, ruleRows.String())
 	_, err := w.Write([]byte(htmlContent))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,173 @@
+package moderation
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Action is what happens to a chirp when a rule matches, ordered by severity
+type Action int
+
+const (
+	Allow Action = iota
+	Flag
+	Mask
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Mask:
+		return "mask"
+	case Reject:
+		return "reject"
+	default:
+		return "allow"
+	}
+}
+
+// maskReplacement replaces masked words
+const maskReplacement = "****"
+
+// Match is a rule that fired on the byte range [Start, End) of the original text
+type Match struct {
+	Rule   string
+	Action Action
+	Start  int
+	End    int
+}
+
+// Filter is a single moderation check
+type Filter interface {
+	Match(text string) []Match
+}
+
+// Result is the outcome of running the pipeline on a text
+type Result struct {
+	// Body is the text with the masked ranges replaced
+	Body string
+	// Action is the most severe action of all matches
+	Action  Action
+	Matches []Match
+}
+
+// Rules returns the names of the rules that fired with the given action
+func (r Result) Rules(action Action) []string {
+	var rules []string
+	for _, m := range r.Matches {
+		if m.Action == action {
+			rules = append(rules, m.Rule)
+		}
+	}
+	return rules
+}
+
+// Pipeline runs the filters built from the current rule set followed by any extra filters.
+// The rule set can be swapped at any time, for example when the rules file changes.
+type Pipeline struct {
+	rules  atomic.Pointer[RuleSet]
+	extra  []Filter
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// NewPipeline creates a pipeline with the given rule set and extra filters
+func NewPipeline(rules *RuleSet, extra ...Filter) *Pipeline {
+	p := &Pipeline{
+		extra:  extra,
+		counts: make(map[string]int64),
+	}
+	p.rules.Store(rules)
+	return p
+}
+
+// SetRules replaces the rule set used by the next runs
+func (p *Pipeline) SetRules(rules *RuleSet) {
+	p.rules.Store(rules)
+}
+
+// Run checks the text like Check and counts the rules that matched
+func (p *Pipeline) Run(text string) Result {
+	result := p.Check(text)
+
+	p.mu.Lock()
+	for _, m := range result.Matches {
+		p.counts[m.Rule]++
+	}
+	p.mu.Unlock()
+
+	return result
+}
+
+// Check checks the text against every filter and masks the matched ranges.
+// Nothing is masked when the text is rejected. The matches aren't counted, it is meant
+// for texts that are only saved for later such as scheduled chirps.
+func (p *Pipeline) Check(text string) Result {
+	filters := append(p.rules.Load().filters(), p.extra...)
+
+	result := Result{Body: text, Action: Allow}
+	for _, f := range filters {
+		result.Matches = append(result.Matches, f.Match(text)...)
+	}
+
+	for _, m := range result.Matches {
+		if m.Action > result.Action {
+			result.Action = m.Action
+		}
+	}
+
+	if result.Action != Reject {
+		result.Body = mask(text, result.Matches)
+	}
+	return result
+}
+
+// Counts returns how many times each rule matched since the server started
+func (p *Pipeline) Counts() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[string]int64, len(p.counts))
+	for rule, n := range p.counts {
+		counts[rule] = n
+	}
+	return counts
+}
+
+// mask replaces the ranges of the mask matches, overlapping ranges are merged
+func mask(text string, matches []Match) string {
+	var ranges []Match
+	for _, m := range matches {
+		if m.Action == Mask {
+			ranges = append(ranges, m)
+		}
+	}
+	if len(ranges) == 0 {
+		return text
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	var b strings.Builder
+	pos := 0
+	for _, m := range ranges {
+		if m.Start < pos {
+			// overlaps with the previous range
+			if m.End > pos {
+				pos = m.End
+			}
+			continue
+		}
+		b.WriteString(text[pos:m.Start])
+		b.WriteString(maskReplacement)
+		pos = m.End
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
@@ -0,0 +1,152 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# kind action value
+word   mask   kerfuffle
+word   mask   sharbert
+word   reject fornax
+word   flag   spoiler
+domain reject spam.example
+domain flag   4chan.example
+`
+
+func TestPipelineRun(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPipeline(rules)
+
+	tests := []struct {
+		name       string
+		text       string
+		wantBody   string
+		wantAction Action
+		wantRule   string
+	}{
+		{
+			name:       "Clean",
+			text:       "I had something interesting for breakfast",
+			wantBody:   "I had something interesting for breakfast",
+			wantAction: Allow,
+		},
+		{
+			name:       "Mask ignores case and keeps punctuation",
+			text:       "This is a Kerfuffle, opinion!",
+			wantBody:   "This is a ****, opinion!",
+			wantAction: Mask,
+			wantRule:   "word:kerfuffle",
+		},
+		{
+			name:       "Mask leetspeak",
+			text:       "what a k3rfuffl3",
+			wantBody:   "what a ****",
+			wantAction: Mask,
+			wantRule:   "word:kerfuffle",
+		},
+		{
+			name:       "Mask homoglyphs",
+			text:       "ѕhаrbеrt again",
+			wantBody:   "**** again",
+			wantAction: Mask,
+			wantRule:   "word:sharbert",
+		},
+		{
+			name:       "Word inside another word",
+			text:       "sharbertson",
+			wantBody:   "sharbertson",
+			wantAction: Allow,
+		},
+		{
+			name:       "Reject",
+			text:       "fornax and kerfuffle",
+			wantBody:   "fornax and kerfuffle",
+			wantAction: Reject,
+			wantRule:   "word:fornax",
+		},
+		{
+			name:       "Flag",
+			text:       "spoiler alert",
+			wantBody:   "spoiler alert",
+			wantAction: Flag,
+			wantRule:   "word:spoiler",
+		},
+		{
+			name:       "Denied subdomain",
+			text:       "visit https://www.Spam.example/win now",
+			wantBody:   "visit https://www.Spam.example/win now",
+			wantAction: Reject,
+			wantRule:   "domain:spam.example",
+		},
+		{
+			name:       "Denied domain with a digit",
+			text:       "see 4chan.example/b",
+			wantBody:   "see 4chan.example/b",
+			wantAction: Flag,
+			wantRule:   "domain:4chan.example",
+		},
+		{
+			name:       "Domains are not folded like words",
+			text:       "see achan.example/b",
+			wantBody:   "see achan.example/b",
+			wantAction: Allow,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Run(tt.text)
+			if got.Body != tt.wantBody {
+				t.Errorf("Run().Body = %q, want %q", got.Body, tt.wantBody)
+			}
+			if got.Action != tt.wantAction {
+				t.Errorf("Run().Action = %v, want %v", got.Action, tt.wantAction)
+			}
+			if tt.wantRule != "" {
+				rules := got.Rules(tt.wantAction)
+				if len(rules) == 0 || rules[0] != tt.wantRule {
+					t.Errorf("Run().Rules(%v) = %v, want %v", tt.wantAction, rules, tt.wantRule)
+				}
+			}
+		})
+	}
+
+	if got := p.Counts()["word:kerfuffle"]; got != 3 {
+		t.Errorf("Counts()[word:kerfuffle] = %v, want 3", got)
+	}
+
+	// checking a text doesn't count its matches
+	if got := p.Check("kerfuffle"); got.Action != Mask {
+		t.Errorf("Check().Action = %v, want %v", got.Action, Mask)
+	}
+	if got := p.Counts()["word:kerfuffle"]; got != 3 {
+		t.Errorf("Counts()[word:kerfuffle] = %v after Check, want 3", got)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules() of a missing file error = %v", err)
+	}
+	if got := NewPipeline(rules).Run("kerfuffle").Body; got != "****" {
+		t.Errorf("default rules Run() = %q, want %q", got, "****")
+	}
+
+	err = os.WriteFile(path, []byte("word explode kerfuffle\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadRules(path)
+	if err == nil {
+		t.Errorf("LoadRules() with an unknown action error = nil")
+	}
+}
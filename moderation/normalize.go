@@ -0,0 +1,103 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+)
+
+// leetspeak substitutions, only applied inside words
+var leet = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+}
+
+// homoglyphs maps look-alike letters from other scripts and accented letters to ASCII
+var homoglyphs = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Latin with diacritics
+	'à': 'a', 'á': 'a', 'â': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c', 'è': 'e', 'é': 'e',
+	'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ñ': 'n', 'ò': 'o',
+	'ó': 'o', 'ô': 'o', 'ö': 'o', 'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y',
+	// fullwidth and other look-alikes
+	'ı': 'i', 'ł': 'l', 'ø': 'o',
+}
+
+// isWordRune reports whether r can be part of a word, leetspeak symbols included
+func isWordRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return true
+	}
+	_, ok := leet[r]
+	return ok
+}
+
+// normalizeRune folds case, homoglyphs and leetspeak, combining marks are dropped
+func normalizeRune(r rune) (rune, bool) {
+	if unicode.Is(unicode.Mn, r) {
+		return 0, false
+	}
+	// fullwidth forms
+	if r >= 'Ａ' && r <= 'Ｚ' {
+		r = r - 'Ａ' + 'a'
+	}
+	if r >= 'ａ' && r <= 'ｚ' {
+		r = r - 'ａ' + 'a'
+	}
+	r = unicode.ToLower(r)
+	if v, ok := homoglyphs[r]; ok {
+		return v, true
+	}
+	if v, ok := leet[r]; ok {
+		return v, true
+	}
+	return r, true
+}
+
+// Normalize folds a word to the form the word lists are compared against
+func Normalize(word string) string {
+	var b strings.Builder
+	for _, r := range word {
+		if n, ok := normalizeRune(r); ok {
+			b.WriteRune(n)
+		}
+	}
+	return b.String()
+}
+
+// word is a word of the original text and its byte range
+type word struct {
+	text  string
+	start int
+	end   int
+}
+
+// splitWords splits the text into words, combining marks stay with their word
+func splitWords(text string) []word {
+	var words []word
+	start := -1
+	for i, r := range text {
+		inWord := isWordRune(r) || (start >= 0 && unicode.Is(unicode.Mn, r))
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			words = append(words, word{text: text[start:i], start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{text: text[start:], start: start, end: len(text)})
+	}
+	return words
+}
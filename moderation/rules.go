@@ -0,0 +1,196 @@
+package moderation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RuleSet is a parsed rules file. word rules match a whole word, ignoring case, leetspeak
+// and look-alike letters, domain rules match links to the domain and its subdomains.
+//
+//	# kind    action  value
+//	word      mask    kerfuffle
+//	word      reject  sharbert
+//	domain    reject  spam.example
+type RuleSet struct {
+	words   map[string]Action
+	domains map[string]Action
+}
+
+// DefaultRules are used when no rules file exists
+func DefaultRules() *RuleSet {
+	return &RuleSet{
+		words: map[string]Action{
+			"kerfuffle": Mask,
+			"sharbert":  Mask,
+			"fornax":    Mask,
+		},
+		domains: map[string]Action{},
+	}
+}
+
+// ParseRules reads a rule set, blank lines and lines starting with # are ignored
+func ParseRules(r io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{
+		words:   make(map[string]Action),
+		domains: make(map[string]Action),
+	}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want \"kind action value\"", line)
+		}
+
+		action, err := parseAction(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch fields[0] {
+		case "word":
+			rs.words[Normalize(fields[2])] = action
+		case "domain":
+			rs.domains[strings.ToLower(strings.TrimPrefix(fields[2], "."))] = action
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule kind %q", line, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// LoadRules reads the rules file, DefaultRules are returned if it doesn't exist
+func LoadRules(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return DefaultRules(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseRules(f)
+}
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "flag":
+		return Flag, nil
+	case "mask":
+		return Mask, nil
+	case "reject":
+		return Reject, nil
+	default:
+		return Allow, fmt.Errorf("unknown action %q", s)
+	}
+}
+
+func (rs *RuleSet) filters() []Filter {
+	return []Filter{wordFilter(rs.words), domainFilter(rs.domains)}
+}
+
+// wordFilter matches normalized words against the word list
+type wordFilter map[string]Action
+
+func (f wordFilter) Match(text string) []Match {
+	if len(f) == 0 {
+		return nil
+	}
+
+	var matches []Match
+	for _, w := range splitWords(text) {
+		normalized := Normalize(w.text)
+		if action, ok := f[normalized]; ok {
+			matches = append(matches, Match{
+				Rule:   "word:" + normalized,
+				Action: action,
+				Start:  w.start,
+				End:    w.end,
+			})
+		}
+	}
+	return matches
+}
+
+// linkRe finds links and bare domain names such as https://spam.example/x or spam.example
+var linkRe = regexp.MustCompile(`(?i)(?:https?://)?((?:[\p{L}\p{N}-]+\.)+[\p{L}]{2,})(?:[:/?#][^\s]*)?`)
+
+// domainFilter matches linked domains and their subdomains against the denylist
+type domainFilter map[string]Action
+
+func (f domainFilter) Match(text string) []Match {
+	if len(f) == 0 {
+		return nil
+	}
+
+	var matches []Match
+	for _, loc := range linkRe.FindAllStringSubmatchIndex(text, -1) {
+		// domains aren't leetspeak, folding digits would turn 4chan.org into achan.org
+		host := strings.ToLower(text[loc[2]:loc[3]])
+		for domain, action := range f {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matches = append(matches, Match{
+					Rule:   "domain:" + domain,
+					Action: action,
+					Start:  loc[0],
+					End:    loc[1],
+				})
+			}
+		}
+	}
+	return matches
+}
+
+// WatchRules reloads the rules file into the pipeline whenever its modification time changes,
+// until ctx is cancelled. A file that fails to parse keeps the previous rules.
+func WatchRules(ctx context.Context, p *Pipeline, path string, interval time.Duration) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		rules, err := LoadRules(path)
+		if err != nil {
+			slog.Error("reload moderation rules", "path", path, "err", err)
+			continue
+		}
+		p.SetRules(rules)
+		slog.Info("reloaded moderation rules", "path", path)
+	}
+}
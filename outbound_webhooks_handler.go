@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"server/db"
+	"server/logging"
+	"server/validation"
+	"server/webhooks"
+	"strconv"
+	"time"
+)
+
+const (
+	maxWebhooksPerUser   = 10
+	webhookDeliveryLimit = 50
+)
+
+// outboundEvents are the events that can be delivered to outbound webhooks
+var outboundEvents = map[string]bool{
+	chirpCreatedEvent:      true,
+	chirpDeletedEvent:      true,
+	db.EventUserUpgraded:   true,
+	db.EventUserDowngraded: true,
+}
+
+// CreateOutboundWebhookHandler registers a URL that receives signed events, the URL must resolve to public addresses.
+// The secret is generated when it isn't given and is only returned in this response.
+// POST /api/webhooks {"url": "https://example.com/hook", "secret": "...", "events": ["chirp.created"]}
+func (cfg *ApiConfig) CreateOutboundWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		URL    string   `json:"url" validate:"required,url"`
+		Secret string   `json:"secret" validate:"omitempty,min=16"`
+		Events []string `json:"events" validate:"required"`
+	}
+	err := decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	for _, event := range params.Events {
+		if !outboundEvents[event] {
+			respondWithErr(w, r, validation.Errors{{Field: "events", Message: "unknown event " + event}})
+			return
+		}
+	}
+
+	// the receiver must be public, internal services of the server can't be reached through webhooks
+	err = webhooks.CheckURL(r.Context(), params.URL)
+	if err != nil {
+		respondWithErr(w, r, validation.Errors{{Field: "url", Message: err.Error()}})
+		return
+	}
+
+	if params.Secret == "" {
+		params.Secret, err = newWebhookSecret()
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	hooks, err := cfg.db.GetOutboundWebhooks(r.Context(), userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	if len(hooks) >= maxWebhooksPerUser {
+		respondWithError(w, http.StatusBadRequest, "too many webhooks")
+		return
+	}
+
+	hook, err := cfg.db.CreateOutboundWebhook(r.Context(), userID, params.URL, params.Secret, params.Events)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, hook)
+}
+
+// GetOutboundWebhooksHandler lists the webhooks of the user
+// GET /api/webhooks
+func (cfg *ApiConfig) GetOutboundWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	hooks, err := cfg.db.GetOutboundWebhooks(r.Context(), userID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, hooks)
+}
+
+// DeleteOutboundWebhookHandler removes a webhook and its pending deliveries
+// DELETE /api/webhooks/{webhookID}
+func (cfg *ApiConfig) DeleteOutboundWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := cfg.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DeleteOutboundWebhook(r.Context(), hook.ID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// GetOutboundDeliveriesHandler lists the latest deliveries of a webhook with every attempt
+// GET /api/webhooks/{webhookID}/deliveries
+func (cfg *ApiConfig) GetOutboundDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := cfg.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := cfg.db.GetOutboundDeliveries(r.Context(), hook.ID, webhookDeliveryLimit)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// RetryOutboundDeliveryHandler queues a dead-lettered delivery again
+// POST /api/webhooks/{webhookID}/deliveries/{deliveryID}/retry
+func (cfg *ApiConfig) RetryOutboundDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := cfg.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := strconv.Atoi(r.PathValue("deliveryID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid delivery ID")
+		return
+	}
+
+	err = cfg.db.RetryOutboundDelivery(r.Context(), hook.ID, deliveryID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// ownedWebhook loads the webhook of the path, only its owner and admins can access it
+func (cfg *ApiConfig) ownedWebhook(w http.ResponseWriter, r *http.Request) (db.OutboundWebhook, bool) {
+	webhookID, err := strconv.Atoi(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid webhook ID")
+		return db.OutboundWebhook{}, false
+	}
+
+	hook, err := cfg.db.GetOutboundWebhook(r.Context(), webhookID)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return db.OutboundWebhook{}, false
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	if hook.UserID != userID {
+		role, err := cfg.db.GetUserRole(r.Context(), userID)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return db.OutboundWebhook{}, false
+		}
+		if role != roleAdmin {
+			// don't reveal webhooks of other users
+			respondWithErr(w, r, db.ErrWebhookNotFound)
+			return db.OutboundWebhook{}, false
+		}
+	}
+
+	return hook, true
+}
+
+// emitWebhook queues an event for the webhooks of userID and of the admins.
+// Failures are logged, they never fail the request that caused the event.
+func (cfg *ApiConfig) emitWebhook(ctx context.Context, event string, userID int, data interface{}) {
+	payload, err := webhooks.NewPayload(event, data, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).Error("encode webhook payload", "event", event, "err", err)
+		return
+	}
+
+	_, err = cfg.db.EnqueueWebhookEvent(ctx, event, userID, payload, webhooks.TraceParent(ctx))
+	if err != nil {
+		logging.FromContext(ctx).Error("enqueue webhook", "event", event, "err", err)
+	}
+}
+
+// newWebhookSecret returns a random secret for signing deliveries
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"server/db"
+	"server/media"
+	"server/pubsub"
+	"server/storage"
+	"strings"
+)
+
+const maxAvatarBytes = 5 << 20
+
+// errUnknownExpand is returned for ?expand values other than author
+var errUnknownExpand = fmt.Errorf("%w: expand must be author", db.ErrInvalid)
+
+// GetProfileHandler returns the public profile of a user
+// GET /api/users/{handle}
+func (cfg *ApiConfig) GetProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, err := cfg.db.GetProfile(r.Context(), r.PathValue("handle"))
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	cfg.withAvatarURL(&profile.Author)
+
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+// FollowHandler follows the user of the handle
+// POST /api/users/{handle}/follow
+func (cfg *ApiConfig) FollowHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	followedID, created, err := cfg.db.Follow(r.Context(), userID, r.PathValue("handle"))
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// notify the followed user
+	if created {
+		cfg.hub.Publish(pubsub.Event{
+			Type:      followCreatedEvent,
+			Recipient: followedID,
+			Data:      newFollower{FollowerID: userID},
+		})
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UnfollowHandler stops following the user of the handle
+// DELETE /api/users/{handle}/follow
+func (cfg *ApiConfig) UnfollowHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	err := cfg.db.Unfollow(r.Context(), userID, r.PathValue("handle"))
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UpdateAvatarHandler replaces the avatar of the user with the image of the "avatar" field
+// PUT /api/users/avatar (multipart/form-data)
+func (cfg *ApiConfig) UpdateAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	img, err := readAvatarUpload(w, r)
+	if err != nil {
+		// 400 Bad Request
+		respondWithErr(w, r, err)
+		return
+	}
+
+	key, err := storage.NewKey("avatars", img.Ext)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	err = cfg.blobs.Put(r.Context(), key, bytes.NewReader(img.Data), img.ContentType)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	oldKey, err := cfg.db.SetAvatar(r.Context(), userID, key)
+	if err != nil {
+		cfg.deleteBlobs(r.Context(), []string{key})
+		respondWithErr(w, r, err)
+		return
+	}
+	if oldKey != "" {
+		cfg.deleteBlobs(r.Context(), []string{oldKey})
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"avatar_url": cfg.blobs.URL(key)})
+}
+
+// DeleteAvatarHandler removes the avatar of the user
+// DELETE /api/users/avatar
+func (cfg *ApiConfig) DeleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	oldKey, err := cfg.db.SetAvatar(r.Context(), userID, "")
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+	if oldKey != "" {
+		cfg.deleteBlobs(r.Context(), []string{oldKey})
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// readAvatarUpload parses a multipart/form-data request with one image in the "avatar" field
+func readAvatarUpload(w http.ResponseWriter, r *http.Request) (media.Image, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarBytes+1<<20)
+
+	f, _, err := r.FormFile("avatar")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return media.Image{}, err
+	}
+	if err != nil {
+		return media.Image{}, fmt.Errorf("%w: the avatar field must contain an image", db.ErrInvalid)
+	}
+	defer f.Close()
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, maxAvatarBytes+1))
+	if err != nil {
+		return media.Image{}, err
+	}
+	if len(data) > maxAvatarBytes {
+		return media.Image{}, fmt.Errorf("%w: the avatar is too large", db.ErrInvalid)
+	}
+
+	// the type is sniffed from the content, the file name is ignored
+	img, err := media.Sanitize(data)
+	if err != nil {
+		return media.Image{}, invalidImage("", err)
+	}
+	return img, nil
+}
+
+// withAvatarURL fills in the avatar url of an author
+func (cfg *ApiConfig) withAvatarURL(a *db.Author) {
+	if a.AvatarKey != "" {
+		a.AvatarURL = cfg.blobs.URL(a.AvatarKey)
+	}
+}
+
+// expandChirps prepares chirps for a response: attachment urls are filled in
+// and ?expand=author embeds the author of every chirp
+func (cfg *ApiConfig) expandChirps(r *http.Request, chirps []db.Chirp) ([]db.Chirp, error) {
+	cfg.withAttachmentURLs(chirps)
+
+	expand := r.URL.Query().Get("expand")
+	if expand == "" {
+		return chirps, nil
+	}
+
+	for _, field := range strings.Split(expand, ",") {
+		switch field {
+		case "author":
+			err := cfg.db.LoadAuthors(r.Context(), chirps)
+			if err != nil {
+				return nil, err
+			}
+			for i := range chirps {
+				if chirps[i].Author != nil {
+					cfg.withAvatarURL(chirps[i].Author)
+				}
+			}
+		default:
+			return nil, errUnknownExpand
+		}
+	}
+	return chirps, nil
+}
@@ -0,0 +1,133 @@
+package pubsub
+
+import "sync"
+
+// Event is a single message published through the Broker
+type Event struct {
+	ID       uint64
+	Type     string
+	AuthorID int
+	// Recipient is set for events addressed to a single user, such as notifications
+	Recipient int
+	Data      interface{}
+}
+
+// Broker is an in-process publish/subscribe hub.
+// It keeps a bounded backlog of recent events so that subscribers can resume
+// from the last event id they have seen.
+type Broker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	backlog     []Event
+	backlogSize int
+	bufferSize  int
+	subs        map[*Subscription]struct{}
+}
+
+// Subscription receives the events accepted by its filter on C.
+// C is closed when the subscription is closed, or when the subscriber is too
+// slow to keep up and gets dropped by the broker.
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	filter  func(Event) bool
+	broker  *Broker
+	dropped bool
+}
+
+// NewBroker creates a broker that remembers the last backlogSize events
+// and buffers up to bufferSize pending events per subscriber
+func NewBroker(backlogSize int, bufferSize int) *Broker {
+	return &Broker{
+		backlogSize: backlogSize,
+		bufferSize:  bufferSize,
+		subs:        make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the next id to the event and delivers it to every matching subscriber.
+// Subscribers whose buffer is full are dropped instead of blocking the publisher.
+func (b *Broker) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	event.ID = b.nextID
+
+	b.backlog = append(b.backlog, event)
+	if len(b.backlog) > b.backlogSize {
+		b.backlog = b.backlog[len(b.backlog)-b.backlogSize:]
+	}
+
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			// slow consumer, drop it so it can reconnect and resume
+			sub.dropped = true
+			b.remove(sub)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a new subscriber.
+// Events newer than lastID that are still in the backlog are returned so the
+// caller can replay them before reading from the subscription.
+func (b *Broker) Subscribe(filter func(Event) bool, lastID uint64) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, b.bufferSize)
+	sub := &Subscription{
+		C:      ch,
+		ch:     ch,
+		filter: filter,
+		broker: b,
+	}
+	b.subs[sub] = struct{}{}
+
+	var replay []Event
+	if lastID > 0 {
+		for _, event := range b.backlog {
+			if event.ID <= lastID {
+				continue
+			}
+			if filter != nil && !filter(event) {
+				continue
+			}
+			replay = append(replay, event)
+		}
+	}
+
+	return sub, replay
+}
+
+// Close unregisters the subscription, it is safe to call more than once
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	s.broker.remove(s)
+}
+
+// Dropped reports whether the broker dropped the subscription because it fell behind
+func (s *Subscription) Dropped() bool {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	return s.dropped
+}
+
+// remove must be called with b.mu held
+func (b *Broker) remove(sub *Subscription) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.ch)
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import "testing"
+
+func TestSubscribeReplaysBacklog(t *testing.T) {
+	b := NewBroker(3, 8)
+
+	for i := 1; i <= 5; i++ {
+		b.Publish(Event{Type: "chirp.created", AuthorID: i % 2})
+	}
+
+	tests := []struct {
+		name   string
+		lastID uint64
+		filter func(Event) bool
+		want   []uint64
+	}{
+		{
+			name:   "No last id",
+			lastID: 0,
+			want:   nil,
+		},
+		{
+			name:   "Resume inside backlog",
+			lastID: 3,
+			want:   []uint64{4, 5},
+		},
+		{
+			name:   "Resume before backlog",
+			lastID: 1,
+			want:   []uint64{3, 4, 5},
+		},
+		{
+			name:   "Filtered",
+			lastID: 1,
+			filter: func(e Event) bool { return e.AuthorID == 1 },
+			want:   []uint64{3, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, replay := b.Subscribe(tt.filter, tt.lastID)
+			defer sub.Close()
+
+			if len(replay) != len(tt.want) {
+				t.Fatalf("Subscribe() replayed %d events, want %d", len(replay), len(tt.want))
+			}
+			for i, event := range replay {
+				if event.ID != tt.want[i] {
+					t.Errorf("Subscribe() replay[%d] = %v, want %v", i, event.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := NewBroker(10, 1)
+
+	slow, _ := b.Subscribe(nil, 0)
+	fast, _ := b.Subscribe(nil, 0)
+	defer fast.Close()
+
+	b.Publish(Event{Type: "chirp.created"})
+	<-fast.C
+	b.Publish(Event{Type: "chirp.created"})
+
+	if !slow.Dropped() {
+		t.Fatalf("Dropped() = false, want true")
+	}
+	if fast.Dropped() {
+		t.Fatalf("fast subscriber was dropped")
+	}
+
+	// the buffered event is still delivered before the channel is closed
+	if _, ok := <-slow.C; !ok {
+		t.Fatalf("buffered event was lost")
+	}
+	if _, ok := <-slow.C; ok {
+		t.Fatalf("channel of dropped subscriber is still open")
+	}
+
+	slow.Close()
+}
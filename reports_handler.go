@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"server/db"
+	"server/logging"
+	"server/pubsub"
+	"strconv"
+	"time"
+)
+
+// ReportChirpHandler reports an abusive chirp, reporting the same chirp twice is a no-op
+// POST /api/chirps/{chirpID}/report {"reason": "spam", "details": "..."}
+func (cfg *ApiConfig) ReportChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid chirp ID")
+		return
+	}
+
+	var params struct {
+		Reason  string `json:"reason" validate:"required,oneof=spam harassment hate violence nudity misinformation other"`
+		Details string `json:"details" validate:"max=500"`
+	}
+	err = decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	report, created, err := cfg.db.ReportChirp(r.Context(), chirpID, userID, params.Reason, params.Details, cfg.ReportHideThreshold)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	if report.ChirpHidden {
+		// hidden chirps disappear from the streams like deleted ones
+		cfg.announceChirpDeleted(r.Context(), chirpID, report.AuthorID)
+	}
+
+	if !created {
+		// already reported by this user
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// GetModerationQueueHandler lists the chirps with open reports or moderation flags
+// GET /api/moderation/queue
+func (cfg *ApiConfig) GetModerationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := cfg.db.GetModerationQueue(r.Context())
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, items)
+}
+
+// ModerateChirpHandler resolves the open reports of a chirp
+// POST /api/moderation/chirps/{chirpID} {"action": "dismiss" | "remove_chirp" | "suspend_author", "note": "...", "suspend_hours": 72}
+// suspend_author without suspend_hours bans the author permanently
+func (cfg *ApiConfig) ModerateChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "invalid chirp ID")
+		return
+	}
+
+	var params struct {
+		Action       string `json:"action" validate:"required,oneof=dismiss remove_chirp suspend_author"`
+		Note         string `json:"note" validate:"max=500"`
+		SuspendHours int    `json:"suspend_hours" validate:"min=0"`
+	}
+	err = decodeRequest(w, r, &params)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	moderatorID := r.Context().Value(userIDKey).(int)
+
+	switch params.Action {
+	case db.ActionDismiss:
+		var unhidden bool
+		unhidden, err = cfg.db.DismissChirpReports(r.Context(), chirpID, moderatorID, params.Note)
+		if err == nil && unhidden {
+			cfg.announceUnhiddenChirp(r.Context(), chirpID)
+		}
+
+	case db.ActionRemoveChirp:
+		var authorID int
+		authorID, err = cfg.db.RemoveReportedChirp(r.Context(), chirpID, moderatorID, params.Note)
+		if err == nil {
+			cfg.announceChirpDeleted(r.Context(), chirpID, authorID)
+		}
+
+	case db.ActionSuspendAuthor:
+		var until *time.Time
+		if params.SuspendHours > 0 {
+			t := time.Now().Add(time.Duration(params.SuspendHours) * time.Hour)
+			until = &t
+		}
+		var authorID int
+		authorID, err = cfg.db.SuspendReportedAuthor(r.Context(), chirpID, moderatorID, params.Note, until)
+		if err == nil {
+			// close the live connections of the author
+			cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: authorID})
+		}
+
+	default:
+		respondWithError(w, http.StatusBadRequest, "invalid action")
+		return
+	}
+
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// announceUnhiddenChirp shows a chirp that was hidden by the reports to the stream subscribers and
+// the webhooks again, unless it was deleted meanwhile or its author is suspended
+func (cfg *ApiConfig) announceUnhiddenChirp(ctx context.Context, chirpID int) {
+	chirp, err := cfg.db.GetChirpByID(ctx, chirpID)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, db.ErrChirpDeleted) {
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("announce unhidden chirp", "chirp_id", chirpID, "err", err)
+		return
+	}
+	cfg.withAttachmentURLs([]db.Chirp{chirp})
+	cfg.publishChirp(ctx, chirp)
+}
+
+// GetModerationActionsHandler lists the most recent moderation actions
+// GET /api/moderation/actions?limit=50
+func (cfg *ApiConfig) GetModerationActionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > 500 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	actions, err := cfg.db.GetModerationActions(r.Context(), limit)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, actions)
+}
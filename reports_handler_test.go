@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"server/db"
+	"server/pubsub"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConfig connects to the database of TEST_DATABASE_URL and skips the test without it.
+// The users and chirps tables must exist, the server creates the others.
+func newTestConfig(t *testing.T) *ApiConfig {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	database, err := db.NewDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.DataBase.Close() })
+
+	return &ApiConfig{
+		db:                  *database,
+		hub:                 pubsub.NewBroker(16, 16),
+		ReportHideThreshold: 2,
+	}
+}
+
+// createTestUser creates a user with a unique email and the given role
+func createTestUser(t *testing.T, cfg *ApiConfig, role string) int {
+	t.Helper()
+	ctx := context.Background()
+	email := fmt.Sprintf("test-%d@example.com", time.Now().UnixNano())
+	user, err := cfg.db.CreateUser(ctx, email, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.DataBase.ExecContext(ctx, "UPDATE users SET role = $2 WHERE id = $1", user.ID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// serveAs calls handler with userID signed in and the chirpID path value
+func serveAs(handler http.HandlerFunc, userID int, chirpID int, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetPathValue("chirpID", fmt.Sprint(chirpID))
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// expectChirpDeleted checks that the stream subscribers and the webhook of the author learned about the chirp
+func expectChirpDeleted(t *testing.T, cfg *ApiConfig, sub *pubsub.Subscription, webhookID int, chirpID int, authorID int) {
+	t.Helper()
+	select {
+	case e := <-sub.C:
+		want := deletedChirp{ID: chirpID, AuthID: authorID}
+		if e.Type != chirpDeletedEvent || e.AuthorID != authorID || e.Data != want {
+			t.Errorf("event = %+v, want %s of chirp %d", e, chirpDeletedEvent, chirpID)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no %s event was published", chirpDeletedEvent)
+	}
+
+	var deliveries int
+	err := cfg.db.DataBase.QueryRow(
+		"SELECT COUNT(*) FROM outbound_deliveries WHERE webhook_id = $1 AND event = $2",
+		webhookID, chirpDeletedEvent,
+	).Scan(&deliveries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 1 {
+		t.Errorf("webhook deliveries = %d, want 1", deliveries)
+	}
+}
+
+func TestModeratorRemovalAnnouncesDeletion(t *testing.T) {
+	cfg := newTestConfig(t)
+	ctx := context.Background()
+	author := createTestUser(t, cfg, "user")
+	reporter := createTestUser(t, cfg, "user")
+	moderator := createTestUser(t, cfg, roleModerator)
+
+	hook, err := cfg.db.CreateOutboundWebhook(ctx, author, "https://example.com/hook", "whsec_test", []string{chirpDeletedEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.db.CreateChirp(ctx, "reported chirp", author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serveAs(cfg.ReportChirpHandler, reporter, chirp.ID, `{"reason": "spam"}`); w.Code != http.StatusCreated {
+		t.Fatalf("report status = %d, body %s", w.Code, w.Body)
+	}
+
+	sub, _ := cfg.hub.Subscribe(nil, 0)
+	defer sub.Close()
+
+	w := serveAs(cfg.ModerateChirpHandler, moderator, chirp.ID, `{"action": "remove_chirp"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("moderate status = %d, body %s", w.Code, w.Body)
+	}
+	expectChirpDeleted(t, cfg, sub, hook.ID, chirp.ID, author)
+}
+
+func TestAutoHideAnnouncesDeletion(t *testing.T) {
+	cfg := newTestConfig(t)
+	ctx := context.Background()
+	author := createTestUser(t, cfg, "user")
+
+	hook, err := cfg.db.CreateOutboundWebhook(ctx, author, "https://example.com/hook", "whsec_test", []string{chirpDeletedEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.db.CreateChirp(ctx, "reported chirp", author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, _ := cfg.hub.Subscribe(nil, 0)
+	defer sub.Close()
+
+	// the first report stays below the threshold of 2
+	for i := 0; i < cfg.ReportHideThreshold; i++ {
+		reporter := createTestUser(t, cfg, "user")
+		if w := serveAs(cfg.ReportChirpHandler, reporter, chirp.ID, `{"reason": "spam"}`); w.Code != http.StatusCreated {
+			t.Fatalf("report status = %d, body %s", w.Code, w.Body)
+		}
+		if i == 0 && len(sub.C) != 0 {
+			t.Fatalf("the chirp was announced as deleted before it was hidden")
+		}
+	}
+	expectChirpDeleted(t, cfg, sub, hook.ID, chirp.ID, author)
+}
+
+func TestDismissAnnouncesUnhiddenChirp(t *testing.T) {
+	cfg := newTestConfig(t)
+	ctx := context.Background()
+	author := createTestUser(t, cfg, "user")
+	moderator := createTestUser(t, cfg, roleModerator)
+
+	chirp, err := cfg.db.CreateChirp(ctx, "reported chirp", author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cfg.ReportHideThreshold; i++ {
+		reporter := createTestUser(t, cfg, "user")
+		if w := serveAs(cfg.ReportChirpHandler, reporter, chirp.ID, `{"reason": "spam"}`); w.Code != http.StatusCreated {
+			t.Fatalf("report status = %d, body %s", w.Code, w.Body)
+		}
+	}
+
+	sub, _ := cfg.hub.Subscribe(nil, 0)
+	defer sub.Close()
+
+	w := serveAs(cfg.ModerateChirpHandler, moderator, chirp.ID, `{"action": "dismiss"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("moderate status = %d, body %s", w.Code, w.Body)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Type != chirpCreatedEvent || e.AuthorID != author {
+			t.Errorf("event = %+v, want %s of chirp %d", e, chirpCreatedEvent, chirp.ID)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no %s event was published", chirpCreatedEvent)
+	}
+}
+
+func TestSuspendReportedAuthorRefusesStaff(t *testing.T) {
+	cfg := newTestConfig(t)
+	ctx := context.Background()
+	moderator := createTestUser(t, cfg, roleModerator)
+	admin := createTestUser(t, cfg, roleAdmin)
+	reporter := createTestUser(t, cfg, "user")
+
+	tests := []struct {
+		name   string
+		author int
+		want   int
+	}{
+		{name: "Own chirp", author: moderator, want: http.StatusBadRequest},
+		{name: "Chirp of an admin", author: admin, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirp, err := cfg.db.CreateChirp(ctx, "reported chirp", tt.author)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := serveAs(cfg.ReportChirpHandler, reporter, chirp.ID, `{"reason": "spam"}`); w.Code != http.StatusCreated {
+				t.Fatalf("report status = %d, body %s", w.Code, w.Body)
+			}
+
+			w := serveAs(cfg.ModerateChirpHandler, moderator, chirp.ID, `{"action": "suspend_author"}`)
+			if w.Code != tt.want {
+				t.Errorf("moderate status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
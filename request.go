@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"server/validation"
+	"strings"
+)
+
+// maxRequestBodyBytes limits the size of JSON request bodies
+const maxRequestBodyBytes = 64 << 10
+
+// errMalformedBody is returned for request bodies that aren't a single JSON object
+var errMalformedBody = errors.New("malformed JSON body")
+
+// decodeRequest decodes the JSON body into dst and checks the validate tags of its fields.
+// Unknown fields, fields of the wrong type and rule violations are all reported
+// as validation.Errors, so the client sees every invalid field at once.
+func decodeRequest(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after the JSON object", errMalformedBody)
+	}
+
+	return validation.Struct(dst)
+}
+
+// decodeError turns the errors of encoding/json into field errors where it can
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &tooLarge):
+		return err
+	case errors.As(err, &typeErr):
+		return validation.Errors{{Field: typeErr.Field, Message: "must be a " + jsonType(typeErr.Type.Kind())}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return validation.Errors{{Field: field, Message: "unknown field"}}
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: empty body", errMalformedBody)
+	default:
+		return errMalformedBody
+	}
+}
+
+// jsonType names a Go kind the way a client writing JSON would
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return kind.String()
+}
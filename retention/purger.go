@@ -0,0 +1,84 @@
+// Package retention hard deletes soft deleted chirps once their retention period is over.
+package retention
+
+import (
+	"context"
+	"log/slog"
+	"server/storage"
+	"time"
+)
+
+// Store keeps the soft deleted chirps
+type Store interface {
+	// PurgeDeletedChirps hard deletes up to limit chirps deleted before the cutoff.
+	// It returns the number of purged chirps and the blob keys of their attachments.
+	PurgeDeletedChirps(ctx context.Context, before time.Time, limit int) (int, []string, error)
+}
+
+// Purger removes the chirps that were deleted more than Retention ago
+type Purger struct {
+	store Store
+	blobs storage.BlobStore
+
+	Retention time.Duration
+	BatchSize int
+
+	now func() time.Time
+}
+
+// NewPurger creates a purger that keeps deleted chirps for the retention period
+func NewPurger(store Store, blobs storage.BlobStore, retention time.Duration) *Purger {
+	return &Purger{
+		store:     store,
+		blobs:     blobs,
+		Retention: retention,
+		BatchSize: 100,
+		now:       time.Now,
+	}
+}
+
+// Run purges expired chirps every interval until ctx is done
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.Purge(ctx); err != nil {
+			slog.Error("purge deleted chirps", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes every chirp past the retention period in batches and returns how many were removed
+func (p *Purger) Purge(ctx context.Context) (int, error) {
+	before := p.now().Add(-p.Retention)
+
+	total := 0
+	for {
+		n, keys, err := p.store.PurgeDeletedChirps(ctx, before, p.BatchSize)
+		p.deleteBlobs(ctx, keys)
+		total += n
+		// keep going while there is a backlog
+		if err != nil || n < p.BatchSize {
+			if total > 0 {
+				slog.Info("purged deleted chirps", "count", total)
+			}
+			return total, err
+		}
+	}
+}
+
+// deleteBlobs removes the attachment files, failures are only logged
+func (p *Purger) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := p.blobs.Delete(ctx, key); err != nil {
+			slog.Error("delete blob", "key", key, "err", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"server/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store of deleted chirps
+type memStore struct {
+	// deletedAt maps chirp ids to their deletion time
+	deletedAt map[int]time.Time
+	keys      map[int]string
+}
+
+func (s *memStore) PurgeDeletedChirps(ctx context.Context, before time.Time, limit int) (int, []string, error) {
+	var keys []string
+	n := 0
+	for id, at := range s.deletedAt {
+		if n == limit {
+			break
+		}
+		if at.After(before) {
+			continue
+		}
+		delete(s.deletedAt, id)
+		if key, ok := s.keys[id]; ok {
+			keys = append(keys, key)
+		}
+		n++
+	}
+	return n, keys, nil
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	blobs, err := storage.NewLocalStore(t.TempDir(), "/app/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"chirps/old.png", "chirps/new.png"} {
+		if err := blobs.Put(ctx, key, strings.NewReader("png"), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &memStore{
+		deletedAt: map[int]time.Time{
+			1: now.Add(-31 * 24 * time.Hour),
+			2: now.Add(-30*24*time.Hour - time.Second),
+			3: now.Add(-29 * 24 * time.Hour),
+		},
+		keys: map[int]string{1: "chirps/old.png", 3: "chirps/new.png"},
+	}
+
+	p := NewPurger(store, blobs, 30*24*time.Hour)
+	p.BatchSize = 1
+	p.now = func() time.Time { return now }
+
+	n, err := p.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Purge() = %d, want 2", n)
+	}
+	if _, ok := store.deletedAt[3]; !ok || len(store.deletedAt) != 1 {
+		t.Errorf("remaining chirps = %v, want only 3", store.deletedAt)
+	}
+
+	if _, err := blobs.Get(ctx, "chirps/old.png"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(old) = %v, want ErrNotFound", err)
+	}
+	r, err := blobs.Get(ctx, "chirps/new.png")
+	if err != nil {
+		t.Errorf("Get(new) = %v, want the file of the chirp within the retention period", err)
+	} else {
+		r.Close()
+	}
+}
@@ -0,0 +1,120 @@
+// Package scheduler publishes scheduled chirps once they are due.
+// Several instances can run a scheduler against the same store, every chirp is claimed
+// by one of them for the lease duration and the store publishes it at most once.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrRejected is wrapped by Publish when the chirp can't be published, e.g. a moderation rule
+// rejected it. Rejected chirps go back to the drafts of the author, other errors are retried.
+var ErrRejected = errors.New("rejected")
+
+// Item is a scheduled chirp that is due
+type Item struct {
+	ID       int
+	AuthorID int
+	Body     string
+	// Version changes with every edit, a chirp is only published or failed in the version that was claimed
+	Version   int
+	PublishAt time.Time
+}
+
+// Store keeps the scheduled chirps
+type Store interface {
+	// ClaimDueChirps returns up to limit scheduled chirps that are due and
+	// hides them from other schedulers for the lease duration
+	ClaimDueChirps(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Item, error)
+	// FailScheduledChirp turns the version of the chirp back into a draft and records why it wasn't published
+	FailScheduledChirp(ctx context.Context, id int, version int, msg string) error
+}
+
+// PublishFunc validates and publishes a claimed chirp, it must publish it at most once.
+// An item that was edited or canceled since it was claimed is skipped without an error.
+type PublishFunc func(ctx context.Context, item Item) error
+
+// Scheduler publishes the due chirps of a store
+type Scheduler struct {
+	store   Store
+	publish PublishFunc
+
+	BatchSize int
+	// Lease is how long a claimed chirp is hidden from the other schedulers,
+	// a chirp that failed with an error that isn't ErrRejected is retried after it
+	Lease time.Duration
+
+	now func() time.Time
+}
+
+// NewScheduler creates a scheduler that publishes the due chirps of store with publish
+func NewScheduler(store Store, publish PublishFunc) *Scheduler {
+	return &Scheduler{
+		store:     store,
+		publish:   publish,
+		BatchSize: 50,
+		Lease:     time.Minute,
+		now:       time.Now,
+	}
+}
+
+// Run publishes due chirps every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.PublishDue(ctx); err != nil {
+			slog.Error("publish scheduled chirps", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PublishDue publishes every due chirp in batches and returns how many were attempted
+func (s *Scheduler) PublishDue(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		items, err := s.store.ClaimDueChirps(ctx, s.now(), s.BatchSize, s.Lease)
+		if err != nil {
+			return total, err
+		}
+
+		for _, item := range items {
+			s.publishItem(ctx, item)
+		}
+		total += len(items)
+
+		// keep going while there is a backlog
+		if len(items) < s.BatchSize {
+			return total, nil
+		}
+	}
+}
+
+// publishItem publishes one chirp, failures are logged
+func (s *Scheduler) publishItem(ctx context.Context, item Item) {
+	err := s.publish(ctx, item)
+	if err == nil {
+		return
+	}
+
+	if !errors.Is(err, ErrRejected) {
+		// the chirp is claimed again when its lease is over
+		slog.Warn("publish scheduled chirp", "draft_id", item.ID, "err", err)
+		return
+	}
+
+	slog.Info("scheduled chirp rejected", "draft_id", item.ID, "author_id", item.AuthorID, "reason", err)
+	if err = s.store.FailScheduledChirp(ctx, item.ID, item.Version, err.Error()); err != nil {
+		slog.Error("fail scheduled chirp", "draft_id", item.ID, "err", err)
+	}
+}
@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store of scheduled chirps shared by several schedulers
+type memStore struct {
+	mu           sync.Mutex
+	scheduled    map[int]Item
+	claimedUntil map[int]time.Time
+	published    []int
+	// failed maps the ids of the chirps that went back to the drafts to the reason
+	failed map[int]string
+}
+
+func newMemStore(items ...Item) *memStore {
+	s := &memStore{
+		scheduled:    make(map[int]Item),
+		claimedUntil: make(map[int]time.Time),
+		failed:       make(map[int]string),
+	}
+	for _, item := range items {
+		s.scheduled[item.ID] = item
+	}
+	return s
+}
+
+func (s *memStore) ClaimDueChirps(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []Item
+	for id, item := range s.scheduled {
+		if len(items) == limit {
+			break
+		}
+		if item.PublishAt.After(now) || s.claimedUntil[id].After(now) {
+			continue
+		}
+		s.claimedUntil[id] = now.Add(lease)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *memStore) FailScheduledChirp(ctx context.Context, id int, version int, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok := s.scheduled[id]; ok && item.Version == version {
+		delete(s.scheduled, id)
+		s.failed[id] = msg
+	}
+	return nil
+}
+
+// publish removes the claimed version of the chirp and publishes it, like the database does in one transaction
+func (s *memStore) publish(ctx context.Context, item Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.scheduled[item.ID]; !ok || current.Version != item.Version {
+		return nil
+	}
+	delete(s.scheduled, item.ID)
+	s.published = append(s.published, item.ID)
+	return nil
+}
+
+func TestPublishDue(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	store := newMemStore(
+		Item{ID: 1, Body: "due", Version: 1, PublishAt: now.Add(-time.Minute)},
+		Item{ID: 2, Body: "later", Version: 1, PublishAt: now.Add(time.Hour)},
+		Item{ID: 3, Body: "rejected", Version: 1, PublishAt: now},
+		Item{ID: 4, Body: "flaky", Version: 1, PublishAt: now.Add(-time.Second)},
+	)
+
+	flaky := true
+	publish := func(ctx context.Context, item Item) error {
+		switch item.Body {
+		case "rejected":
+			return fmt.Errorf("%w: body: rejected by rule banned_words", ErrRejected)
+		case "flaky":
+			if flaky {
+				return errors.New("connection reset")
+			}
+		}
+		return store.publish(ctx, item)
+	}
+
+	// two instances share the store
+	schedulers := []*Scheduler{NewScheduler(store, publish), NewScheduler(store, publish)}
+	for _, s := range schedulers {
+		s.BatchSize = 1
+		s.now = func() time.Time { return now }
+	}
+
+	for _, s := range schedulers {
+		if _, err := s.PublishDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(store.published) != "[1]" {
+		t.Errorf("published = %v, want [1]", store.published)
+	}
+	if _, ok := store.failed[3]; !ok {
+		t.Errorf("failed = %v, want the rejected chirp 3", store.failed)
+	}
+
+	// the flaky chirp is retried by any instance once the lease is over
+	flaky = false
+	now = now.Add(schedulers[0].Lease)
+	for _, s := range schedulers {
+		if _, err := s.PublishDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(store.published) != "[1 4]" {
+		t.Errorf("published = %v, want [1 4]", store.published)
+	}
+	if _, ok := store.scheduled[2]; !ok {
+		t.Errorf("chirp 2 was published before it was due")
+	}
+}
+
+func TestPublishEditedChirp(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newMemStore(Item{ID: 1, Body: "first", Version: 1, PublishAt: now})
+
+	s := NewScheduler(store, func(ctx context.Context, item Item) error {
+		// the author edits the chirp after it was claimed
+		store.mu.Lock()
+		store.scheduled[1] = Item{ID: 1, Body: "second", Version: 2, PublishAt: now.Add(time.Hour)}
+		store.mu.Unlock()
+		return store.publish(ctx, item)
+	})
+	s.now = func() time.Time { return now }
+
+	if _, err := s.PublishDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.published) != 0 {
+		t.Errorf("published = %v, want the edited chirp to wait for its new time", store.published)
+	}
+	if store.scheduled[1].Body != "second" {
+		t.Errorf("scheduled chirp = %+v, want the edit", store.scheduled[1])
+	}
+}
@@ -0,0 +1,60 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefix of the signature header value
+const prefix = "sha256="
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidTimestamp = errors.New("invalid signature timestamp")
+	ErrExpired          = errors.New("signature timestamp outside the tolerance window")
+	ErrMismatch         = errors.New("signature mismatch")
+)
+
+// Sign returns the signature header value for a payload sent at timestamp (unix seconds).
+// The HMAC-SHA256 covers "<timestamp>.<body>" so a captured signature can't be reused
+// with another timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header value and its timestamp header value against the body.
+// Timestamps further than tolerance from now are refused.
+func Verify(secret string, header string, timestampHeader string, body []byte, now time.Time, tolerance time.Duration) error {
+	if header == "" {
+		return ErrMissingSignature
+	}
+
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	if !strings.HasPrefix(header, prefix) {
+		return ErrMismatch
+	}
+
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(header), []byte(expected)) {
+		return ErrMismatch
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package signature
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"event":"user.upgraded","data":{"user_id":3}}`)
+	ts := now.Unix()
+	valid := Sign("secret", ts, body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		header    string
+		timestamp string
+		body      []byte
+		want      error
+	}{
+		{
+			name:      "Valid",
+			secret:    "secret",
+			header:    valid,
+			timestamp: strconv.FormatInt(ts, 10),
+			body:      body,
+			want:      nil,
+		},
+		{
+			name:      "Missing signature",
+			secret:    "secret",
+			timestamp: strconv.FormatInt(ts, 10),
+			body:      body,
+			want:      ErrMissingSignature,
+		},
+		{
+			name:      "Wrong secret",
+			secret:    "other",
+			header:    valid,
+			timestamp: strconv.FormatInt(ts, 10),
+			body:      body,
+			want:      ErrMismatch,
+		},
+		{
+			name:      "Tampered body",
+			secret:    "secret",
+			header:    valid,
+			timestamp: strconv.FormatInt(ts, 10),
+			body:      []byte(`{"event":"user.upgraded","data":{"user_id":4}}`),
+			want:      ErrMismatch,
+		},
+		{
+			name:      "Replayed with a new timestamp",
+			secret:    "secret",
+			header:    valid,
+			timestamp: strconv.FormatInt(ts+1, 10),
+			body:      body,
+			want:      ErrMismatch,
+		},
+		{
+			name:      "Too old",
+			secret:    "secret",
+			header:    Sign("secret", ts-600, body),
+			timestamp: strconv.FormatInt(ts-600, 10),
+			body:      body,
+			want:      ErrExpired,
+		},
+		{
+			name:      "Invalid timestamp",
+			secret:    "secret",
+			header:    valid,
+			timestamp: "yesterday",
+			body:      body,
+			want:      ErrInvalidTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.timestamp, tt.body, now, 5*time.Minute)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
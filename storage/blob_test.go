@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "/app/uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	if got := store.URL("chirps/a.png"); got != "/app/uploads/chirps/a.png" {
+		t.Errorf("URL() = %v, want %v", got, "/app/uploads/chirps/a.png")
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+
+	// minimal fake of the S3 object api
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	store := &S3Store{
+		Endpoint:        server.URL,
+		Bucket:          "chirpy",
+		Region:          "us-east-1",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Client:          server.Client(),
+	}
+	testBlobStore(t, store)
+
+	if got, want := store.URL("chirps/a.png"), server.URL+"/chirpy/chirps/a.png"; got != want {
+		t.Errorf("URL() = %v, want %v", got, want)
+	}
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	err := store.Put(ctx, "chirps/a.png", strings.NewReader("image"), "image/png")
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	r, err := store.Get(ctx, "chirps/a.png")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "image" {
+		t.Errorf("Get() = %q, want %q", data, "image")
+	}
+
+	err = store.Delete(ctx, "chirps/a.png")
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	_, err = store.Get(ctx, "chirps/a.png")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, ErrNotFound)
+	}
+
+	err = store.Put(ctx, "../escape.png", strings.NewReader("image"), "image/png")
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put() with parent key error = %v, want %v", err, ErrInvalidKey)
+	}
+}
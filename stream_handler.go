@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/pubsub"
+	"strconv"
+	"time"
+)
+
+const (
+	chirpCreatedEvent = "chirp.created"
+	chirpDeletedEvent = "chirp.deleted"
+
+	// sseHeartbeatInterval keeps idle connections open through proxies
+	sseHeartbeatInterval = 15 * time.Second
+)
+
+// deletedChirp is the payload of a chirp.deleted event
+type deletedChirp struct {
+	ID     int `json:"id"`
+	AuthID int `json:"author_id"`
+}
+
+// streamChirpsHandler pushes created and deleted chirps as Server-Sent Events
+// GET /api/chirps/stream?author_id=1
+func (cfg *ApiConfig) streamChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	// same author_id filter as GET /api/chirps
+	authorID := 0
+	if userID := r.URL.Query().Get("author_id"); userID != "" {
+		userIDInt, err := strconv.Atoi(userID)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "invalid author ID")
+			return
+		}
+		authorID = userIDInt
+	}
+
+	// only public chirp events, never events addressed to a single user
+	filter := func(e pubsub.Event) bool {
+		if e.Type != chirpCreatedEvent && e.Type != chirpDeletedEvent {
+			return false
+		}
+		return authorID == 0 || e.AuthorID == authorID
+	}
+
+	// resume from the last event the client has seen
+	var lastID uint64
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	sub, replay := cfg.hub.Subscribe(filter, lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		if err := writeSSE(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.C:
+			if !ok {
+				// dropped for being too slow, the client reconnects with Last-Event-ID
+				return
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE writes a single event in the text/event-stream format
+func writeSSE(w http.ResponseWriter, event pubsub.Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
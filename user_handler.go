@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"server/audit"
 	"server/db"
 	"server/jwt"
+	"server/logging"
+	"server/mailer"
+	"server/pubsub"
+	"server/validation"
 	"strconv"
 	"time"
 )
 
 type Event struct {
+	// ID identifies a delivery, retries of the same event keep the same id
+	ID    string `json:"id"`
 	Event string `json:"event"`
 	Data  Data   `json:"data"`
 }
 
 type Data struct {
 	UserID int `json:"user_id"`
+	// ExpiresAt is the end of the paid period, when polka sends it
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
 // PolkaWebhookHandler
@@ -25,48 +36,109 @@ func (cfg *ApiConfig) PolkaWebhookHandler(w http.ResponseWriter, r *http.Request
 	var event Event
 	err := json.NewDecoder(r.Body).Decode(&event)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+		// 400 Bad Request
+		respondWithErr(w, r, errMalformedBody)
 		return
 	}
 
+	// only the timestamp and the body are signed, an id taken from the headers could be
+	// changed to replay a delivery. Signed deliveries without an id in the body are
+	// deduplicated by their signature.
+	if event.ID == "" {
+		event.ID = signedDeliveryID(r)
+	}
+
+	annotateWebhook(r, func(d *db.WebhookDelivery) {
+		d.Event = event.Event
+		d.EventID = event.ID
+	})
+
+	// process every event id at most once, retried deliveries are acknowledged
+	if event.ID != "" {
+		claimed, err := cfg.db.ClaimWebhookEvent(r.Context(), "polka", event.ID, event.Event)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+		if !claimed {
+			annotateWebhook(r, func(d *db.WebhookDelivery) { d.Outcome = db.WebhookDuplicate })
+			respondWithJSON(w, http.StatusNoContent, nil)
+			return
+		}
+	}
+
 	// handle event
 	switch event.Event {
-	// case "user_created":
-	// do something when user created
-	case "user.upgraded":
-
-		// update is_chirpy_red to true in  database
-		err = cfg.db.UpdateIsChirpyRed(event.Data.UserID)
+	case db.EventUserUpgraded, db.EventUserDowngraded, db.EventSubscriptionCancelled,
+		db.EventPaymentFailed, db.EventSubscriptionRenewed:
+
+		// append the new state to the subscription history
+		subscription, err := cfg.db.ApplySubscriptionEvent(r.Context(), event.Data.UserID, event.Event, event.Data.ExpiresAt)
+		cfg.audit(r, audit.Entry{
+			Action:     actionPolkaPrefix + event.Event,
+			TargetType: "user",
+			TargetID:   targetID(event.Data.UserID),
+			Outcome:    auditOutcome(err),
+			Details:    map[string]string{"event_id": event.ID},
+		})
 		if err != nil {
-			respondWithError(w, http.StatusNotFound, err.Error())
+			cfg.releaseWebhookEvent(r.Context(), event.ID)
+			respondWithErr(w, r, err)
 			return
 		}
 
+		if outboundEvents[event.Event] {
+			cfg.emitWebhook(r.Context(), event.Event, subscription.UserID, subscription)
+		}
+
 	default:
-		// do something when event not found
-		respondWithError(w, http.StatusNotFound, "event not found")
-		return
+		// acknowledge unknown events so polka stops retrying
+		logging.FromContext(r.Context()).Info("ignoring unknown polka event", "event", event.Event)
+		annotateWebhook(r, func(d *db.WebhookDelivery) { d.Outcome = db.WebhookIgnored })
 	}
 
 	// return 204
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
+// releaseWebhookEvent forgets a claimed polka event that failed so a retry is processed
+func (cfg *ApiConfig) releaseWebhookEvent(ctx context.Context, eventID string) {
+	if eventID == "" {
+		return
+	}
+	err := cfg.db.ReleaseWebhookEvent(ctx, "polka", eventID)
+	if err != nil {
+		logging.FromContext(ctx).Error("release webhook event", "event_id", eventID, "err", err)
+	}
+}
+
 // RevokeTokenHandler
 func (cfg *ApiConfig) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// 从请求头中获取refresh token
 	refreshToken, err := GetTokenFromHeader(r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// revoke refresh token in database
-	err = cfg.db.RevokeToken(refreshToken)
+	userID, err := cfg.db.RevokeToken(r.Context(), refreshToken)
+	cfg.audit(r, audit.Entry{
+		Action:     actionTokenRevoke,
+		ActorID:    userActor(userID),
+		TargetType: "user",
+		TargetID:   targetID(userID),
+		Outcome:    auditOutcome(err),
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
+
+	// close the live connections of this user
+	if userID != 0 {
+		cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: userID})
+	}
 	// return 204
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -76,24 +148,27 @@ func (cfg *ApiConfig) RefreshTokenHandler(w http.ResponseWriter, r *http.Request
 	// 从请求头中获取refresh token
 	refreshToken, err := GetTokenFromHeader(r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// check refresh token in database
-	userID, err := cfg.db.CheckRefreshTokenIsValid(refreshToken)
+	userID, err := cfg.db.CheckRefreshTokenIsValid(r.Context(), refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		cfg.audit(r, audit.Entry{Action: actionTokenRefresh, Outcome: auditOutcome(err)})
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// generate JWT token
-	token, err := jwt.CreateJwtToken(strconv.Itoa(userID), cfg.JwtSecret, cfg.JwtExpireSec)
+	token, err := jwt.CreateJwtToken(r.Context(), strconv.Itoa(userID), cfg.JwtSecret, cfg.JwtExpireSec)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
+	cfg.audit(r, audit.Entry{Action: actionTokenRefresh, ActorID: &userID, Outcome: audit.OutcomeSuccess})
+
 	// return JWT token
 	resJson := make(map[string]string)
 	resJson["token"] = token
@@ -104,21 +179,26 @@ func (cfg *ApiConfig) RefreshTokenHandler(w http.ResponseWriter, r *http.Request
 func (cfg *ApiConfig) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// get user data from request body
-	var user db.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	var params struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required,password"`
+	}
+	err := decodeRequest(w, r, &params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// create user in database
-	user, err = cfg.db.CreateUser(user.Email, user.Password)
+	user, err := cfg.db.CreateUser(r.Context(), params.Email, params.Password)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
+	cfg.sendEmailVerification(r.Context(), user.ID)
+
 	respondWithJSON(w, http.StatusCreated, user)
 
 }
@@ -126,96 +206,242 @@ func (cfg *ApiConfig) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 func (cfg *ApiConfig) LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// get user data from request body
-	var user db.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	// the password rules aren't checked, accounts created before them can still log in
+	var params struct {
+		Email    string `json:"email" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+	err := decodeRequest(w, r, &params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
 	// check user password in database
-	user, err = cfg.db.LoginUser(user.Email, user.Password)
+	user, err := cfg.db.LoginUser(r.Context(), params.Email, params.Password)
 
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		if errors.Is(err, db.ErrUnauthorized) {
+			cfg.metrics.Login("failure")
+		}
+		cfg.audit(r, audit.Entry{
+			Action:  actionLogin,
+			Outcome: auditOutcome(err),
+			Details: map[string]string{"email": params.Email},
+		})
+		respondWithErr(w, r, err)
 		return
 	}
 
-	// generate JWT token
-	token, err := jwt.CreateJwtToken(strconv.Itoa(int(user.ID)), cfg.JwtSecret, cfg.JwtExpireSec)
+	// suspended and banned users can't log in
+	err = cfg.db.CheckNotSuspended(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		cfg.metrics.Login("suspended")
+		cfg.audit(r, audit.Entry{Action: actionLogin, ActorID: &user.ID, Outcome: auditOutcome(err)})
+		respondWithErr(w, r, err)
 		return
 	}
 
-	// generate refresh token
-	refreshToken, err := jwt.GenerateRefreshToken()
+	// generate JWT token and refresh token
+	// refresh token expiration time to set to 60 days by default
+	token, refreshToken, err := cfg.issueTokens(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
+
 	// return JWT token and user data
 	resJson := make(map[string]interface{})
 	resJson["token"] = token
 	resJson["user"] = user
 	resJson["refresh_token"] = refreshToken
 
-	// save refresh token in database
-	// refresh token expiration time to set to 60 days by default
+	cfg.metrics.Login("success")
+	cfg.audit(r, audit.Entry{Action: actionLogin, ActorID: &user.ID, Outcome: audit.OutcomeSuccess})
+	respondWithJSON(w, http.StatusOK, resJson)
+
+}
 
-	expire_time := time.Now().Add(time.Duration(cfg.UserFreshTokenExpireSec) * time.Second)
-	err = cfg.db.SaveToken(user.ID, refreshToken, expire_time)
+// UpdateUserHandler changes the account and the public profile of the user, fields that are left out are kept
+// PATCH /api/users {"email": "...", "password": "...", "current_password": "...", "handle": "...", "display_name": "...", "bio": "..."}
+// A new password needs the current one and signs out every other session: the refresh token
+// is revoked and older access tokens are rejected, the response has new tokens for this session.
+// A new email has to be verified again.
+func (cfg *ApiConfig) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 
+	// get user data from request body
+	var params struct {
+		Email           *string `json:"email" validate:"email"`
+		Password        *string `json:"password" validate:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Handle          *string `json:"handle" validate:"handle"`
+		DisplayName     *string `json:"display_name" validate:"max=50"`
+		Bio             *string `json:"bio" validate:"max=160"`
+	}
+	err := decodeRequest(w, r, &params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, resJson)
+	userID := r.Context().Value(userIDKey).(int)
+
+	// a stolen access token isn't enough to take over the account
+	if params.Password != nil {
+		if params.CurrentPassword == "" {
+			respondWithErr(w, r, validation.Errors{{Field: "current_password", Message: "is required to change the password"}})
+			return
+		}
+		err = cfg.db.VerifyPassword(r.Context(), userID, params.CurrentPassword)
+		if err != nil {
+			cfg.audit(r, audit.Entry{
+				Action:  actionPasswordChange,
+				ActorID: &userID,
+				Outcome: auditOutcome(err),
+				Details: map[string]string{"reason": "wrong current password"},
+			})
+			respondWithErr(w, r, err)
+			return
+		}
+	}
+
+	// update user in database
+	user, err := cfg.db.UpdateUserAccount(r.Context(), userID, db.UserUpdate{
+		Email:       params.Email,
+		Password:    params.Password,
+		Handle:      params.Handle,
+		DisplayName: params.DisplayName,
+		Bio:         params.Bio,
+	})
+	cfg.auditAccountChanges(r, userID, params.Email != nil, params.Password != nil, err)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	if params.Email != nil && !user.EmailVerified {
+		cfg.sendEmailVerification(r.Context(), userID)
+	}
+
+	res := struct {
+		db.User
+		AccessToken  string `json:"token,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}{User: user}
+
+	if params.Password != nil {
+		// close the live connections opened with the old tokens
+		cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: userID})
+
+		// this session continues with new tokens
+		res.AccessToken, res.RefreshToken, err = cfg.issueTokens(r.Context(), userID)
+		if err != nil {
+			respondWithErr(w, r, err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
 
 }
 
-// UpdateUserHandler
-func (cfg *ApiConfig) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+// auditAccountChanges records the password and email changes of an account update.
+// The new address isn't recorded, entries of the audit log can't be erased.
+func (cfg *ApiConfig) auditAccountChanges(r *http.Request, userID int, emailChanged bool, passwordChanged bool, err error) {
+	if passwordChanged {
+		cfg.audit(r, audit.Entry{Action: actionPasswordChange, ActorID: &userID, Outcome: auditOutcome(err)})
+	}
+	if emailChanged {
+		cfg.audit(r, audit.Entry{Action: actionEmailChange, ActorID: &userID, Outcome: auditOutcome(err)})
+	}
+}
 
-	// get user data from request body
-	var user db.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+// issueTokens creates an access token and a refresh token for the user,
+// the refresh token replaces the one saved before
+func (cfg *ApiConfig) issueTokens(ctx context.Context, userID int) (string, string, error) {
+	token, err := jwt.CreateJwtToken(ctx, strconv.Itoa(userID), cfg.JwtSecret, cfg.JwtExpireSec)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
-		log.Println(err)
-		return
+		return "", "", err
 	}
 
-	// 从请求头中获取Bearer token
-	token, err := GetTokenFromHeader(r)
+	refreshToken, err := jwt.GenerateRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return "", "", err
+	}
+
+	expireTime := time.Now().Add(time.Duration(cfg.UserFreshTokenExpireSec) * time.Second)
+	err = cfg.db.SaveToken(ctx, userID, refreshToken, expireTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// emailVerificationTTL is how long a mailed verification token can be used
+const emailVerificationTTL = 24 * time.Hour
+
+// sendEmailVerification mails a verification token for the current email of the user.
+// Failures are logged, the user can ask for another token.
+func (cfg *ApiConfig) sendEmailVerification(ctx context.Context, userID int) {
+	logger := logging.FromContext(ctx)
+
+	verification, err := cfg.db.CreateEmailVerification(ctx, userID, emailVerificationTTL)
+	if err != nil {
+		logger.Error("create email verification", "err", err)
 		return
 	}
 
-	// parse JWT token  claims is user id
-	claims, err := jwt.VerifyJwtToken(token, cfg.JwtSecret)
+	err = cfg.mailer.Send(ctx, mailer.Message{
+		To:      verification.Email,
+		Subject: "Confirm your Chirpy email address",
+		Body: fmt.Sprintf("Confirm this email address by sending the token below to POST /api/users/verify-email.\n\n%s\n\nThe token expires on %s.",
+			verification.Token, verification.ExpiresAt.UTC().Format(time.RFC1123)),
+	})
+	if err != nil {
+		logger.Error("send email verification", "err", err)
+	}
+}
+
+// VerifyEmailHandler confirms the email of a user with the token that was mailed to them
+// POST /api/users/verify-email {"token": "..."}
+func (cfg *ApiConfig) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Token string `json:"token" validate:"required"`
+	}
+	err := decodeRequest(w, r, &params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithErr(w, r, err)
 		return
 	}
 
-	// convert user id from string to int
-	userID, err := strconv.Atoi(claims)
+	_, err = cfg.db.VerifyEmail(r.Context(), params.Token)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithErr(w, r, err)
 		return
 	}
 
-	// update user in database
-	user, err = cfg.db.UpdateUser(userID, user.Email, user.Password)
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// ResendEmailVerificationHandler mails a new verification token, the previous ones stop working
+// POST /api/users/verify-email/resend
+func (cfg *ApiConfig) ResendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
 
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithErr(w, r, err)
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "email is already verified")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, user)
+	cfg.sendEmailVerification(r.Context(), userID)
 
+	// 204 No Content
+	respondWithJSON(w, http.StatusNoContent, nil)
 }
@@ -0,0 +1,260 @@
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors lists every invalid field of a request
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+// Add records an invalid field
+func (e *Errors) Add(field string, message string) {
+	*e = append(*e, FieldError{Field: field, Message: message})
+}
+
+// Err returns nil when no field is invalid
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Password rules, bcrypt ignores everything after 72 bytes
+const (
+	MinPasswordLength = 8
+	MaxPasswordBytes  = 72
+)
+
+// Handle rules, handles are ascii so they are easy to type and to mention
+const (
+	MinHandleLength = 3
+	MaxHandleLength = 30
+)
+
+// Struct checks the fields of a struct (or a pointer to one) against their validate tags
+// and returns Errors listing every invalid field. Fields are named after their json tag.
+//
+//	Body   string   `json:"body" validate:"required,max=140"`
+//	Email  string   `json:"email" validate:"required,email"`
+//	Reason string   `json:"reason" validate:"oneof=spam other"`
+//	Secret string   `json:"secret" validate:"omitempty,min=16"`
+//
+// Rules:
+//   - required: not the zero value, not empty
+//   - omitempty: skip the other rules when the field is empty
+//   - min=n, max=n: length in runes for strings, number of items for slices, value for numbers
+//   - oneof=a b c: one of the space separated values
+//   - email: a plain address like "user@example.com"
+//   - password: MinPasswordLength to MaxPasswordBytes long with a letter and a digit
+//   - url: an absolute http or https url
+//   - handle: MinHandleLength to MaxHandleLength letters, digits and underscores
+//
+// Pointer fields are optional: a nil pointer is only checked by required,
+// the rules apply to the value it points to.
+//
+// Only the first failing rule of a field is reported.
+func Struct(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validation: %T is not a struct", v))
+	}
+
+	var errs Errors
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag := sf.Tag.Get("validate")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		if msg := checkField(rv.Field(i), strings.Split(tag, ",")); msg != "" {
+			errs.Add(fieldName(sf), msg)
+		}
+	}
+	return errs.Err()
+}
+
+// fieldName is the json name of a field
+func fieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+func checkField(v reflect.Value, rules []string) string {
+	// optional fields are pointers, a nil pointer is an empty field
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			if rules[0] == "required" {
+				return "is required"
+			}
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if v.IsZero() || size(v) == 0 {
+				return "is required"
+			}
+		case "omitempty":
+			if v.IsZero() || size(v) == 0 {
+				return ""
+			}
+		case "min", "max":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				panic(fmt.Sprintf("validation: invalid rule %q", rule))
+			}
+			if msg := checkBound(v, name, n); msg != "" {
+				return msg
+			}
+		case "oneof":
+			allowed := strings.Fields(arg)
+			if !contains(allowed, fmt.Sprint(v.Interface())) {
+				return "must be one of " + strings.Join(allowed, ", ")
+			}
+		case "email":
+			if !IsEmail(v.String()) {
+				return "must be a valid email address"
+			}
+		case "password":
+			if msg := checkPassword(v.String()); msg != "" {
+				return msg
+			}
+		case "handle":
+			if !IsHandle(v.String()) {
+				return fmt.Sprintf("must have %d to %d letters, digits or underscores", MinHandleLength, MaxHandleLength)
+			}
+		case "url":
+			u, err := url.Parse(v.String())
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return "must be an http or https url"
+			}
+		default:
+			panic(fmt.Sprintf("validation: unknown rule %q", rule))
+		}
+	}
+	return ""
+}
+
+// size is the length of strings (in runes) and slices, -1 for other kinds
+func size(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(v.String())
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len()
+	}
+	return -1
+}
+
+func checkBound(v reflect.Value, rule string, n int) string {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		unit := "characters"
+		if v.Kind() != reflect.String {
+			unit = "items"
+		}
+		if rule == "min" && size(v) < n {
+			return fmt.Sprintf("must have at least %d %s", n, unit)
+		}
+		if rule == "max" && size(v) > n {
+			return fmt.Sprintf("must have at most %d %s", n, unit)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rule == "min" && v.Int() < int64(n) {
+			return fmt.Sprintf("must be at least %d", n)
+		}
+		if rule == "max" && v.Int() > int64(n) {
+			return fmt.Sprintf("must be at most %d", n)
+		}
+	default:
+		panic(fmt.Sprintf("validation: %s doesn't apply to %s", rule, v.Kind()))
+	}
+	return ""
+}
+
+// IsEmail reports whether s is a plain email address, without a display name.
+// Surrounding whitespace is ignored, it's trimmed when the email is normalized.
+func IsEmail(s string) bool {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return false
+	}
+	_, domain, _ := strings.Cut(s, "@")
+	return strings.Contains(domain, ".")
+}
+
+// IsHandle reports whether s can be used as a public handle like "jane_doe42"
+func IsHandle(s string) bool {
+	if len(s) < MinHandleLength || len(s) > MaxHandleLength {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPassword(password string) string {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return fmt.Sprintf("must have at least %d characters", MinPasswordLength)
+	}
+	if len(password) > MaxPasswordBytes {
+		return fmt.Sprintf("must be at most %d bytes", MaxPasswordBytes)
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return "must contain a letter and a digit"
+	}
+	return ""
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
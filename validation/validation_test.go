@@ -0,0 +1,125 @@
+package validation
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type signup struct {
+	Email    string   `json:"email" validate:"required,email"`
+	Password string   `json:"password" validate:"required,password"`
+	Body     string   `json:"body" validate:"max=5"`
+	Reason   string   `json:"reason" validate:"omitempty,oneof=spam other"`
+	Tags     []string `json:"tags" validate:"omitempty,max=2"`
+	Hours    int      `json:"hours" validate:"min=0"`
+	Hook     string   `json:"hook" validate:"omitempty,url"`
+	NewEmail *string  `json:"new_email" validate:"email"`
+	Handle   string   `json:"handle" validate:"omitempty,handle"`
+}
+
+func TestStruct(t *testing.T) {
+	valid := signup{Email: "user@example.com", Password: "hunter22"}
+
+	tests := []struct {
+		name   string
+		modify func(s *signup)
+		want   Errors
+	}{
+		{name: "Valid", modify: func(s *signup) {}},
+		{
+			name:   "Every invalid field is listed",
+			modify: func(s *signup) { s.Email = ""; s.Password = "short" },
+			want: Errors{
+				{Field: "email", Message: "is required"},
+				{Field: "password", Message: "must have at least 8 characters"},
+			},
+		},
+		{
+			name:   "Email with a display name",
+			modify: func(s *signup) { s.Email = "User <user@example.com>" },
+			want:   Errors{{Field: "email", Message: "must be a valid email address"}},
+		},
+		{
+			name:   "Password without a digit",
+			modify: func(s *signup) { s.Password = "password" },
+			want:   Errors{{Field: "password", Message: "must contain a letter and a digit"}},
+		},
+		{
+			name:   "Password longer than bcrypt accepts",
+			modify: func(s *signup) { s.Password = strings.Repeat("a1", 40) },
+			want:   Errors{{Field: "password", Message: "must be at most 72 bytes"}},
+		},
+		{
+			name:   "Length is counted in runes",
+			modify: func(s *signup) { s.Body = "héllo" },
+		},
+		{
+			name:   "Too long",
+			modify: func(s *signup) { s.Body = "hello!" },
+			want:   Errors{{Field: "body", Message: "must have at most 5 characters"}},
+		},
+		{
+			name:   "Not one of",
+			modify: func(s *signup) { s.Reason = "boring" },
+			want:   Errors{{Field: "reason", Message: "must be one of spam, other"}},
+		},
+		{
+			name:   "Too many items",
+			modify: func(s *signup) { s.Tags = []string{"a", "b", "c"} },
+			want:   Errors{{Field: "tags", Message: "must have at most 2 items"}},
+		},
+		{
+			name:   "Negative number",
+			modify: func(s *signup) { s.Hours = -1 },
+			want:   Errors{{Field: "hours", Message: "must be at least 0"}},
+		},
+		{
+			name:   "Nil pointer is not checked",
+			modify: func(s *signup) { s.NewEmail = nil },
+		},
+		{
+			name:   "Pointer is checked",
+			modify: func(s *signup) { email := "not an email"; s.NewEmail = &email },
+			want:   Errors{{Field: "new_email", Message: "must be a valid email address"}},
+		},
+		{
+			name:   "Handle",
+			modify: func(s *signup) { s.Handle = "Jane_Doe42" },
+		},
+		{
+			name:   "Handle with a dot",
+			modify: func(s *signup) { s.Handle = "jane.doe" },
+			want:   Errors{{Field: "handle", Message: "must have 3 to 30 letters, digits or underscores"}},
+		},
+		{
+			name:   "Not an http url",
+			modify: func(s *signup) { s.Hook = "ftp://example.com" },
+			want:   Errors{{Field: "hook", Message: "must be an http or https url"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid
+			tt.modify(&s)
+
+			err := Struct(&s)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Struct() = %v, want nil", err)
+				}
+				return
+			}
+
+			var got Errors
+			if !errors.As(err, &got) {
+				t.Fatalf("Struct() = %v, want Errors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Struct() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
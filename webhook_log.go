@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"server/db"
+	"server/logging"
+	"time"
+)
+
+// maxLoggedResponseBytes limits how much of the response is kept in the webhook log
+const maxLoggedResponseBytes = 1024
+
+const webhookDeliveryKey contextKey = "webhookDelivery"
+
+// discardResponseWriter is used when a stored delivery is replayed without a client
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// webhookDeliveryFromContext returns the delivery being logged, nil when the request isn't logged
+func webhookDeliveryFromContext(ctx context.Context) *db.WebhookDelivery {
+	d, _ := ctx.Value(webhookDeliveryKey).(*db.WebhookDelivery)
+	return d
+}
+
+// annotateWebhook lets middlewares and handlers add what they learned to the delivery log
+func annotateWebhook(r *http.Request, annotate func(d *db.WebhookDelivery)) {
+	if d := webhookDeliveryFromContext(r.Context()); d != nil {
+		annotate(d)
+	}
+}
+
+// webhookLogMiddleware stores every delivery with its headers, body, verification result,
+// outcome and timing
+func (cfg *ApiConfig) webhookLogMiddleware(source string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+		if err != nil {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+
+		delivery := db.WebhookDelivery{
+			Source:  source,
+			Headers: redactHeaders(r.Header),
+			Body:    string(body),
+		}
+		cfg.runLoggedWebhook(&delivery, next, w, r, body)
+	})
+}
+
+// runLoggedWebhook runs the handler with the body and saves the delivery afterwards
+func (cfg *ApiConfig) runLoggedWebhook(delivery *db.WebhookDelivery, next http.Handler, w http.ResponseWriter, r *http.Request, body []byte) (db.WebhookDelivery, error) {
+	r = r.WithContext(context.WithValue(r.Context(), webhookDeliveryKey, delivery))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := &statusRecorder{ResponseWriter: w, body: &bytes.Buffer{}, bodyLimit: maxLoggedResponseBytes}
+	start := time.Now()
+	next.ServeHTTP(rec, r)
+
+	delivery.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	delivery.StatusCode = rec.Status()
+	delivery.Response = rec.body.String()
+
+	if delivery.Outcome == "" {
+		switch {
+		case !delivery.Verified:
+			delivery.Outcome = db.WebhookRejected
+		case rec.Status() >= 400:
+			delivery.Outcome = db.WebhookFailed
+		default:
+			delivery.Outcome = db.WebhookProcessed
+		}
+	}
+
+	cfg.metrics.WebhookEvent(delivery.Source, delivery.Event, delivery.Outcome)
+
+	saved, err := cfg.db.CreateWebhookDelivery(r.Context(), *delivery)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("save webhook delivery", "source", delivery.Source, "err", err)
+	}
+	return saved, err
+}
+
+// redactHeaders copies the headers without credentials
+func redactHeaders(header http.Header) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for name, values := range header {
+		if name == "Authorization" || name == "Cookie" {
+			headers[name] = []string{"[redacted]"}
+			continue
+		}
+		headers[name] = values
+	}
+	return headers
+}
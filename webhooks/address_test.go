@@ -0,0 +1,70 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://[2606:2800:220:1:248:1893:25c8:1946]/hook", true},
+		{"http://127.0.0.1:8080/admin", false},
+		{"http://[::1]/", false},
+		{"http://10.1.2.3/", false},
+		{"http://172.16.0.1/", false},
+		{"http://192.168.1.1/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[fe80::1]/", false},
+		{"http://224.0.0.1/", false},
+		{"http://0.0.0.0/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://[fd00::1]/", false},
+	}
+
+	for _, tt := range tests {
+		err := CheckURL(context.Background(), tt.url)
+		if tt.allowed && err != nil {
+			t.Errorf("CheckURL(%q) = %v, want nil", tt.url, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("CheckURL(%q) = %v, want ErrForbiddenAddress", tt.url, err)
+		}
+	}
+}
+
+func TestDefaultClientRefusesInternalAddresses(t *testing.T) {
+	// the receiver listens on loopback like an internal service would
+	srv, calls := receiver(t, "s3cret", 0)
+
+	store := newMemStore(Delivery{ID: 1, URL: srv.URL, Secret: "s3cret", Event: "chirp.created", Payload: []byte(`{}`)})
+	if _, err := NewDispatcher(store, nil).ProcessDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls() != 0 {
+		t.Errorf("receiver called %d times, want 0", calls())
+	}
+	if got := store.attempts[0]; got.StatusCode != 0 || got.Error != ErrForbiddenAddress.Error() {
+		t.Errorf("attempt = %+v, want a refused connection", got)
+	}
+}
+
+func TestFailedDeliveryHidesResponse(t *testing.T) {
+	srv, _ := receiver(t, "s3cret", 1)
+
+	store := newMemStore(Delivery{ID: 1, URL: srv.URL, Secret: "s3cret", Event: "chirp.created", Payload: []byte(`{}`)})
+	if _, err := NewDispatcher(store, srv.Client()).ProcessDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver answered "try later"
+	if got := store.attempts[0]; got.StatusCode != http.StatusServiceUnavailable || got.Error != "unexpected response status" {
+		t.Errorf("attempt = %+v, want the status with a generic message", got)
+	}
+}
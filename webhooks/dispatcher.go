@@ -0,0 +1,293 @@
+// Package webhooks delivers signed event payloads to the URLs registered by users.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"server/signature"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// headers sent with every delivery
+const (
+	SignatureHeader = "X-Chirpy-Signature"
+	TimestampHeader = "X-Chirpy-Timestamp"
+	EventHeader     = "X-Chirpy-Event"
+	DeliveryHeader  = "X-Chirpy-Delivery"
+)
+
+// delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Delivery is a payload waiting to be sent to a webhook
+type Delivery struct {
+	ID        int
+	WebhookID int
+	URL       string
+	Secret    string
+	Event     string
+	Payload   []byte
+	// Attempts is the number of attempts made before this one
+	Attempts int
+	// TraceParent is the W3C traceparent of the request that queued the delivery
+	TraceParent string
+}
+
+// Attempt is the result of sending a delivery once
+type Attempt struct {
+	DeliveryID  int
+	Attempt     int
+	StatusCode  int
+	Error       string
+	Duration    time.Duration
+	AttemptedAt time.Time
+	// Status is the status of the delivery after the attempt
+	Status string
+	// NextAttemptAt is set when the delivery is retried
+	NextAttemptAt time.Time
+}
+
+// Store keeps the delivery queue
+type Store interface {
+	// ClaimDueDeliveries returns up to limit pending deliveries that are due and
+	// hides them from other workers for the lease duration
+	ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Delivery, error)
+	// RecordDeliveryAttempt saves an attempt and the new status of the delivery
+	RecordDeliveryAttempt(ctx context.Context, a Attempt) error
+}
+
+// Dispatcher sends due deliveries, retries failures with exponential backoff
+// and dead-letters deliveries that keep failing
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	BatchSize   int
+	// Lease must be longer than the client timeout
+	Lease time.Duration
+
+	now func() time.Time
+}
+
+// NewDispatcher creates a dispatcher, a nil client uses NewClient
+func NewDispatcher(store Store, client *http.Client) *Dispatcher {
+	if client == nil {
+		client = NewClient()
+	}
+	return &Dispatcher{
+		store:       store,
+		client:      client,
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+		BatchSize:   20,
+		Lease:       time.Minute,
+		now:         time.Now,
+	}
+}
+
+// Backoff returns the delay before retrying after the given failed attempt (1 based)
+func (d *Dispatcher) Backoff(attempt int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= d.MaxDelay {
+			return d.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Run processes due deliveries every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := d.ProcessDue(ctx)
+			if err != nil {
+				slog.Error("deliver webhooks", "err", err)
+			}
+			// keep going while there is a backlog
+			if err != nil || n < d.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue sends one batch of due deliveries and returns how many were attempted
+func (d *Dispatcher) ProcessDue(ctx context.Context) (int, error) {
+	deliveries, err := d.store.ClaimDueDeliveries(ctx, d.now(), d.BatchSize, d.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(deliveries))
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func(i int, delivery Delivery) {
+			defer wg.Done()
+			errs[i] = d.store.RecordDeliveryAttempt(ctx, d.attempt(ctx, delivery))
+		}(i, delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries), errors.Join(errs...)
+}
+
+// attempt sends a delivery once and decides what happens next
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) Attempt {
+	a := Attempt{
+		DeliveryID:  delivery.ID,
+		Attempt:     delivery.Attempts + 1,
+		AttemptedAt: d.now(),
+	}
+
+	start := time.Now()
+	a.StatusCode, a.Error = d.send(ctx, delivery)
+	a.Duration = time.Since(start)
+
+	switch {
+	case a.Error == "":
+		a.Status = StatusDelivered
+	case a.Attempt >= d.MaxAttempts:
+		a.Status = StatusDead
+	default:
+		a.Status = StatusPending
+		a.NextAttemptAt = a.AttemptedAt.Add(d.Backoff(a.Attempt))
+	}
+	return a
+}
+
+// send posts the signed payload, any 2xx response is a success.
+// The delivery continues the trace of the request that queued it.
+// Failures are recorded with a generic message, the owner of the webhook sees them and
+// must not learn anything about the responses or the network of the server.
+func (d *Dispatcher) send(ctx context.Context, delivery Delivery) (status int, errMsg string) {
+	propagator := otel.GetTextMapPropagator()
+	ctx = propagator.Extract(ctx, propagation.MapCarrier{"traceparent": delivery.TraceParent})
+	ctx, span := otel.Tracer("server/webhooks").Start(ctx, "webhook.deliver",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("webhook.event", delivery.Event),
+			attribute.Int("webhook.delivery_id", delivery.ID),
+			attribute.Int("webhook.attempt", delivery.Attempts+1),
+		),
+	)
+	defer func() {
+		if status != 0 {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		}
+		if errMsg != "" {
+			span.SetStatus(codes.Error, errMsg)
+		}
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, "invalid webhook URL"
+	}
+	span.SetAttributes(semconv.ServerAddress(req.URL.Hostname()))
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	// receivers check the timestamp against their own clock
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, signature.Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		slog.Debug("webhook delivery failed", "delivery_id", delivery.ID, "err", err)
+		return 0, sendError(err)
+	}
+	defer resp.Body.Close()
+
+	// drain so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, "unexpected response status"
+	}
+	return resp.StatusCode, ""
+}
+
+// sendError is the message recorded for a delivery that got no response
+func sendError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrForbiddenAddress):
+		return ErrForbiddenAddress.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "request timed out"
+	default:
+		return "request failed"
+	}
+}
+
+// TraceParent returns the W3C traceparent of ctx, to be stored with queued deliveries
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// payload is the JSON document delivered to webhooks
+type payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// NewPayload encodes an event with a random id that receivers can use to deduplicate retries
+func NewPayload(event string, data interface{}, now time.Time) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return json.Marshal(payload{
+		ID:        "evt_" + hex.EncodeToString(id),
+		Event:     event,
+		CreatedAt: now.UTC(),
+		Data:      data,
+	})
+}
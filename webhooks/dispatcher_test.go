@@ -0,0 +1,229 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"server/signature"
+	"server/tracing"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// memStore is an in-memory Store
+type memStore struct {
+	mu         sync.Mutex
+	deliveries map[int]*Delivery
+	status     map[int]string
+	nextAt     map[int]time.Time
+	attempts   []Attempt
+}
+
+func newMemStore(deliveries ...Delivery) *memStore {
+	s := &memStore{
+		deliveries: make(map[int]*Delivery),
+		status:     make(map[int]string),
+		nextAt:     make(map[int]time.Time),
+	}
+	for i := range deliveries {
+		d := deliveries[i]
+		s.deliveries[d.ID] = &d
+		s.status[d.ID] = StatusPending
+	}
+	return s
+}
+
+func (s *memStore) ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Delivery
+	for id, d := range s.deliveries {
+		if s.status[id] != StatusPending || s.nextAt[id].After(now) || len(due) == limit {
+			continue
+		}
+		s.nextAt[id] = now.Add(lease)
+		due = append(due, *d)
+	}
+	return due, nil
+}
+
+func (s *memStore) RecordDeliveryAttempt(ctx context.Context, a Attempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts = append(s.attempts, a)
+	s.deliveries[a.DeliveryID].Attempts = a.Attempt
+	s.status[a.DeliveryID] = a.Status
+	s.nextAt[a.DeliveryID] = a.NextAttemptAt
+	return nil
+}
+
+// receiver is an httptest server that checks signatures and fails the first failures requests
+func receiver(t *testing.T, secret string, failures int) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		err := signature.Verify(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, time.Now(), time.Minute)
+		if err != nil {
+			t.Errorf("invalid signature: %v", err)
+		}
+		if r.Header.Get(EventHeader) != "chirp.created" {
+			t.Errorf("event header = %q", r.Header.Get(EventHeader))
+		}
+
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+
+		if n <= failures {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	srv, calls := receiver(t, "s3cret", 2)
+
+	payload, err := NewPayload("chirp.created", map[string]int{"id": 1}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemStore(Delivery{ID: 1, URL: srv.URL, Secret: "s3cret", Event: "chirp.created", Payload: payload})
+
+	now := time.Now()
+	d := NewDispatcher(store, srv.Client())
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		n, err := d.ProcessDue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("attempt %d: processed %d deliveries, want 1", i+1, n)
+		}
+		if i < 2 {
+			// not due again before the backoff
+			if n, _ := d.ProcessDue(context.Background()); n != 0 {
+				t.Fatalf("delivery retried before its backoff")
+			}
+			now = now.Add(d.Backoff(i + 1))
+		}
+	}
+
+	if calls() != 3 {
+		t.Errorf("receiver called %d times, want 3", calls())
+	}
+	if store.status[1] != StatusDelivered {
+		t.Errorf("status = %q, want %q", store.status[1], StatusDelivered)
+	}
+	if got := store.attempts[0]; got.StatusCode != http.StatusServiceUnavailable || got.Error == "" {
+		t.Errorf("first attempt = %+v, want a recorded 503", got)
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	srv, calls := receiver(t, "s3cret", 100)
+
+	store := newMemStore(Delivery{ID: 1, URL: srv.URL, Secret: "s3cret", Event: "chirp.created", Payload: []byte(`{}`)})
+
+	now := time.Now()
+	d := NewDispatcher(store, srv.Client())
+	d.MaxAttempts = 3
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if _, err := d.ProcessDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(d.MaxDelay)
+	}
+
+	if calls() != 3 {
+		t.Errorf("receiver called %d times, want 3", calls())
+	}
+	if store.status[1] != StatusDead {
+		t.Errorf("status = %q, want %q", store.status[1], StatusDead)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(nil, nil)
+	d.BaseDelay = time.Second
+	d.MaxDelay = 10 * time.Second
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{30, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := d.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherPropagatesTraceContext(t *testing.T) {
+	spans, restore := tracing.InMemory()
+	defer restore()
+
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// the request that queued the delivery
+	ctx, request := otel.Tracer("test").Start(context.Background(), "POST /api/chirps")
+	traceParent := TraceParent(ctx)
+	request.End()
+
+	store := newMemStore(Delivery{ID: 1, URL: srv.URL, Secret: "s3cret", Event: "chirp.created", Payload: []byte(`{}`), TraceParent: traceParent})
+	if _, err := NewDispatcher(store, srv.Client()).ProcessDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var deliver tracetest.SpanStub
+	for _, span := range spans.GetSpans() {
+		if span.Name == "webhook.deliver" {
+			deliver = span
+		}
+	}
+	if deliver.Name == "" {
+		t.Fatal("no webhook.deliver span recorded")
+	}
+	if deliver.Parent.SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("webhook.deliver is not a child of the request span")
+	}
+
+	wantPrefix := "00-" + request.SpanContext().TraceID().String() + "-" + deliver.SpanContext.SpanID().String()
+	if !strings.HasPrefix(received, wantPrefix) {
+		t.Errorf("receiver got traceparent %q, want prefix %q", received, wantPrefix)
+	}
+}
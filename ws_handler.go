@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"server/pubsub"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	sessionRevokedEvent = "session.revoked"
+	followCreatedEvent  = "follow.created"
+
+	wsFeedTopic          = "feed"
+	wsAuthorTopic        = "author"
+	wsNotificationsTopic = "notifications"
+
+	// time allowed to write a message to the peer
+	wsWriteWait = 10 * time.Second
+	// time allowed to read the next pong message from the peer
+	wsPongWait = 60 * time.Second
+	// send pings to peer with this period, must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// maximum message size allowed from peer
+	wsMaxMessageSize = 4096
+
+	// wsProtocol is the subprotocol the server answers with
+	wsProtocol = "chirpy.v1"
+	// wsTokenProtocolPrefix marks the subprotocol that carries the JWT of browsers
+	wsTokenProtocolPrefix = "bearer."
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{wsProtocol},
+}
+
+// newFollower is the data of a follow.created notification
+type newFollower struct {
+	FollowerID int `json:"follower_id"`
+}
+
+// wsRequest is a message sent by the client
+// {"type": "subscribe", "topic": "author", "author_id": 1}
+type wsRequest struct {
+	Type     string `json:"type"`
+	Topic    string `json:"topic"`
+	AuthorID int    `json:"author_id,omitempty"`
+}
+
+// wsResponse is a message sent by the server
+type wsResponse struct {
+	Type     string      `json:"type"`
+	Topic    string      `json:"topic,omitempty"`
+	AuthorID int         `json:"author_id,omitempty"`
+	Event    string      `json:"event,omitempty"`
+	ID       uint64      `json:"id,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// wsClient holds the subscriptions of a single connection
+type wsClient struct {
+	userID int
+
+	mu            sync.Mutex
+	feed          bool
+	notifications bool
+	authors       map[int]bool
+}
+
+// accepts is the broker filter, it also lets through events that close the connection
+func (c *wsClient) accepts(e pubsub.Event) bool {
+	if e.Type == sessionRevokedEvent {
+		return e.Recipient == c.userID
+	}
+	_, ok := c.topicFor(e)
+	return ok
+}
+
+// topicFor returns the subscribed topic an event is delivered under
+func (c *wsClient) topicFor(e pubsub.Event) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e.Recipient != 0 {
+		if e.Recipient == c.userID && c.notifications {
+			return wsNotificationsTopic, true
+		}
+		return "", false
+	}
+	if c.feed {
+		return wsFeedTopic, true
+	}
+	if c.authors[e.AuthorID] {
+		return wsAuthorTopic, true
+	}
+	return "", false
+}
+
+// apply handles a subscribe or unsubscribe request and returns the reply
+func (c *wsClient) apply(req wsRequest) wsResponse {
+	var subscribe bool
+	switch req.Type {
+	case "subscribe":
+		subscribe = true
+	case "unsubscribe":
+		subscribe = false
+	default:
+		return wsResponse{Type: "error", Error: "unknown message type"}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch req.Topic {
+	case wsFeedTopic:
+		c.feed = subscribe
+	case wsNotificationsTopic:
+		c.notifications = subscribe
+	case wsAuthorTopic:
+		if req.AuthorID <= 0 {
+			return wsResponse{Type: "error", Topic: req.Topic, Error: "invalid author ID"}
+		}
+		if subscribe {
+			c.authors[req.AuthorID] = true
+		} else {
+			delete(c.authors, req.AuthorID)
+		}
+	default:
+		return wsResponse{Type: "error", Topic: req.Topic, Error: "unknown topic"}
+	}
+
+	return wsResponse{Type: req.Type + "d", Topic: req.Topic, AuthorID: req.AuthorID}
+}
+
+// wsToken reads the JWT of a WebSocket handshake from the Authorization header or, for browsers
+// that can't set headers, from the "bearer.<token>" subprotocol. Query parameters end up in
+// access logs, so the token is never read from the url.
+func wsToken(r *http.Request) (string, error) {
+	token, err := GetTokenFromHeader(r)
+	if err == nil {
+		return token, nil
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, wsTokenProtocolPrefix); ok && token != "" {
+			return token, nil
+		}
+	}
+	return "", errMissingToken
+}
+
+// wsHandler upgrades the request to a WebSocket connection for live timelines and notifications
+// GET /api/ws with "Authorization: Bearer <token>",
+// or "Sec-WebSocket-Protocol: chirpy.v1, bearer.<token>" from browsers
+func (cfg *ApiConfig) wsHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := wsToken(r)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	userID, expiresAt, err := cfg.authenticateToken(r.Context(), token)
+	if err != nil {
+		respondWithErr(w, r, err)
+		return
+	}
+
+	cfg.serveWS(w, r, userID, expiresAt)
+}
+
+// serveWS upgrades the connection of an authenticated user and delivers the events of its
+// subscriptions until the connection fails, the token expires or the session is revoked
+func (cfg *ApiConfig) serveWS(w http.ResponseWriter, r *http.Request, userID int, expiresAt time.Time) {
+	// Upgrade writes the error response itself, the token subprotocol is never echoed
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClient{
+		userID:  userID,
+		authors: make(map[int]bool),
+	}
+
+	sub, _ := cfg.hub.Subscribe(client.accepts, 0)
+	defer sub.Close()
+
+	replies := make(chan wsResponse, 16)
+	done := make(chan struct{})
+	go client.readPump(conn, replies, done)
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	// close the connection when the token expires
+	var expired <-chan time.Time
+	if !expiresAt.IsZero() {
+		timer := time.NewTimer(time.Until(expiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case reply := <-replies:
+			if err := writeWS(conn, reply); err != nil {
+				return
+			}
+
+		case event, ok := <-sub.C:
+			if !ok {
+				closeWS(conn, websocket.CloseTryAgainLater, "too slow")
+				return
+			}
+			if event.Type == sessionRevokedEvent {
+				closeWS(conn, websocket.ClosePolicyViolation, "token revoked")
+				return
+			}
+			topic, ok := client.topicFor(event)
+			if !ok {
+				continue
+			}
+			err := writeWS(conn, wsResponse{
+				Type:     "event",
+				Topic:    topic,
+				AuthorID: event.AuthorID,
+				Event:    event.Type,
+				ID:       event.ID,
+				Data:     event.Data,
+			})
+			if err != nil {
+				return
+			}
+
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-expired:
+			closeWS(conn, websocket.ClosePolicyViolation, "token expired")
+			return
+		}
+	}
+}
+
+// readPump reads client requests until the connection fails, then closes done
+func (c *wsClient) readPump(conn *websocket.Conn, replies chan<- wsResponse, done chan<- struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		select {
+		case replies <- c.apply(req):
+		default:
+			// the client sends requests faster than we can answer
+			return
+		}
+	}
+}
+
+// writeWS writes a single JSON message with a deadline
+func writeWS(conn *websocket.Conn, msg wsResponse) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(msg)
+}
+
+// closeWS sends a close frame with the given code and reason
+func closeWS(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(wsWriteWait),
+	)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"server/pubsub"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		headers map[string]string
+		want    string
+	}{
+		{name: "Authorization header", url: "/api/ws", headers: map[string]string{"Authorization": "Bearer abc.def.ghi"}, want: "abc.def.ghi"},
+		{name: "Subprotocol", url: "/api/ws", headers: map[string]string{"Sec-WebSocket-Protocol": "chirpy.v1, bearer.abc.def.ghi"}, want: "abc.def.ghi"},
+		{name: "Query parameter is ignored", url: "/api/ws?token=abc.def.ghi"},
+		{name: "Empty subprotocol token", url: "/api/ws", headers: map[string]string{"Sec-WebSocket-Protocol": "chirpy.v1, bearer."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			got, err := wsToken(r)
+			if tt.want == "" {
+				if !errors.Is(err, errMissingToken) {
+					t.Errorf("wsToken() = %q, %v, want %v", got, err, errMissingToken)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("wsToken() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// dialWS serves a WebSocket connection for userID and connects to it
+func dialWS(t *testing.T, cfg *ApiConfig, userID int) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.serveWS(w, r, userID, time.Time{})
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsProtocol}}
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("Sec-WebSocket-Protocol"); got != wsProtocol {
+		t.Errorf("subprotocol = %q, want %q", got, wsProtocol)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWS reads the next message of the connection
+func readWS(t *testing.T, conn *websocket.Conn) wsResponse {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg wsResponse
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// subscribeWS sends a subscribe request and waits for the reply, events published
+// afterwards are matched against the subscription
+func subscribeWS(t *testing.T, conn *websocket.Conn, req wsRequest) {
+	t.Helper()
+	req.Type = "subscribe"
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readWS(t, conn); reply.Type != "subscribed" || reply.Topic != req.Topic {
+		t.Fatalf("reply = %+v, want subscribed to %s", reply, req.Topic)
+	}
+}
+
+func TestWSTopics(t *testing.T) {
+	cfg := &ApiConfig{hub: pubsub.NewBroker(16, 16)}
+	conn := dialWS(t, cfg, 1)
+
+	subscribeWS(t, conn, wsRequest{Topic: wsAuthorTopic, AuthorID: 2})
+
+	// only the chirps of author 2 are delivered, notifications of other users never are
+	cfg.hub.Publish(pubsub.Event{Type: chirpCreatedEvent, AuthorID: 3})
+	cfg.hub.Publish(pubsub.Event{Type: messageCreatedEvent, Recipient: 1})
+	cfg.hub.Publish(pubsub.Event{Type: messageCreatedEvent, Recipient: 4})
+	cfg.hub.Publish(pubsub.Event{Type: chirpCreatedEvent, AuthorID: 2})
+
+	msg := readWS(t, conn)
+	if msg.Type != "event" || msg.Topic != wsAuthorTopic || msg.AuthorID != 2 || msg.Event != chirpCreatedEvent {
+		t.Errorf("event = %+v, want the chirp of author 2", msg)
+	}
+
+	subscribeWS(t, conn, wsRequest{Topic: wsNotificationsTopic})
+
+	cfg.hub.Publish(pubsub.Event{Type: followCreatedEvent, Recipient: 4})
+	cfg.hub.Publish(pubsub.Event{Type: followCreatedEvent, Recipient: 1, Data: newFollower{FollowerID: 5}})
+
+	msg = readWS(t, conn)
+	if msg.Type != "event" || msg.Topic != wsNotificationsTopic || msg.Event != followCreatedEvent {
+		t.Errorf("event = %+v, want the follow notification of user 1", msg)
+	}
+}
+
+func TestWSClosesOnSessionRevoked(t *testing.T) {
+	cfg := &ApiConfig{hub: pubsub.NewBroker(16, 16)}
+	conn := dialWS(t, cfg, 1)
+
+	// wait until the connection is subscribed to the hub
+	subscribeWS(t, conn, wsRequest{Topic: wsFeedTopic})
+
+	cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: 2})
+	cfg.hub.Publish(pubsub.Event{Type: chirpCreatedEvent, AuthorID: 3})
+	if msg := readWS(t, conn); msg.Event != chirpCreatedEvent {
+		t.Fatalf("event = %+v, want the connection to survive the revocation of another user", msg)
+	}
+
+	cfg.hub.Publish(pubsub.Event{Type: sessionRevokedEvent, Recipient: 1})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("read error = %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+}